@@ -6,9 +6,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"io"
 	"io/ioutil"
 	"net"
@@ -18,47 +20,111 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/gin-contrib/requestid"
 	"github.com/gin-gonic/gin"
-	"github.com/google/go-github/v41/github"
 	"github.com/google/uuid"
+	"github.com/lindluni/github-issue-sync/pkg/attachments"
+	"github.com/lindluni/github-issue-sync/pkg/breaker"
 	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/drift"
+	"github.com/lindluni/github-issue-sync/pkg/executor"
+	"github.com/lindluni/github-issue-sync/pkg/format"
+	"github.com/lindluni/github-issue-sync/pkg/ghclient"
 	"github.com/lindluni/github-issue-sync/pkg/handlers"
+	"github.com/lindluni/github-issue-sync/pkg/leader"
+	"github.com/lindluni/github-issue-sync/pkg/queue"
+	"github.com/lindluni/github-issue-sync/pkg/recording"
 	"github.com/lindluni/github-issue-sync/pkg/server"
+	"github.com/lindluni/github-issue-sync/pkg/tracing"
 	"github.com/lindluni/github-issue-sync/pkg/types"
-	"github.com/shurcooL/githubv4"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/writer"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"gopkg.in/yaml.v2"
 )
 
 func main() {
-	config, githubPrivateKey, clientPrivateKey := initConfig()
+	driftReport := flag.String("drift-report", "", "scan for drift, write the report to stdout as json or markdown, and exit")
+	mode := flag.String("mode", server.ModeAll, "part this replica plays when deliveries are queued: all, receiver or worker")
+	configFile := flag.String("config", "", "configuration file, overriding CONFIG_PATH")
+	replay := flag.String("replay", "", "replay the deliveries recorded in the given JSONL file, report their outcome, and exit")
+	replaySpeed := flag.Float64("replay-speed", 0, "replay deliveries at this multiple of their recorded pace, or back to back if 0")
+	replayDryRun := flag.Bool("replay-dry-run", false, "list the deliveries that would be replayed without handling them")
+	flag.Parse()
+	if *driftReport != "" && *driftReport != drift.FormatJSON && *driftReport != drift.FormatMarkdown {
+		logrus.Fatalf("Unsupported drift report format: %s", *driftReport)
+	}
+	if *mode != server.ModeAll && *mode != server.ModeReceiver && *mode != server.ModeWorker {
+		logrus.Fatalf("Unsupported mode: %s", *mode)
+	}
+
+	if *replay != "" && *replayDryRun {
+		// Listing a recording handles nothing, so it needs neither configuration nor clients.
+		replayDeliveries(logrus.StandardLogger(), nil, *replay, *replaySpeed)
+		return
+	}
+
+	config, githubPrivateKey, clientPrivateKey := initConfig(*configFile)
+	if *mode != server.ModeAll && config.Queue.Backend == "" {
+		logrus.Fatalf("Running in %s mode requires you set queue.backend", *mode)
+	}
 	logger := initLogger(config)
 
+	logger.Debug("Initializing tracing")
+	shutdownTracing, err := tracing.Init(config.Tracing)
+	if err != nil {
+		logger.Fatalf("Failed initializing tracing: %v", err)
+	}
+	defer func() {
+		err := shutdownTracing(context.Background())
+		if err != nil {
+			logger.Errorf("Failed to flush traces: %v", err)
+		}
+	}()
+	logger.Debug("Initialized tracing")
+
+	logger.Debug("Compiling templates")
+	formatter, err := format.New(config.Templates)
+	if err != nil {
+		logger.Fatalf("Invalid template configuration: %v", err)
+	}
+	logger.Debug("Compiled templates")
+
 	logger.Debug("Creating GitHub application transports")
-	itrForClient, err := ghinstallation.NewAppsTransport(http.DefaultTransport, config.Apps.Client.AppID, clientPrivateKey)
+	// Every GitHub API request goes through the same circuit breaker, so an outage stops all of them.
+	circuitBreaker := &breaker.Breaker{
+		Threshold: config.Breaker.Threshold,
+		Cooldown:  config.Breaker.Cooldown,
+		Logger:    logger,
+	}
+	transport := circuitBreaker.Transport(tracing.NewTransport(http.DefaultTransport))
+	itrForClient, err := ghclient.NewAppsTransport(config.Apps.Client, transport, clientPrivateKey)
 	if err != nil {
 		logger.Fatalf("Failed creating app authentication: %v", err)
 	}
-	itrForGitHub, err := ghinstallation.New(http.DefaultTransport, config.Apps.GitHub.AppID, config.Apps.GitHub.InstallationID, githubPrivateKey)
+	itrForGitHub, err := ghclient.NewInstallationTransport(config.Apps.GitHub, transport, config.Apps.GitHub.InstallationID, githubPrivateKey)
 	if err != nil {
 		logger.Fatalf("Failed creating installation authentication: %v", err)
 	}
 	logger.Debug("Created GitHub application installation configuration")
 
 	logger.Debug("Creating client")
-	client := github.NewClient(&http.Client{Transport: itrForClient})
+	client, err := ghclient.NewREST(config.Apps.Client, itrForClient)
+	if err != nil {
+		logger.Fatalf("Failed creating client: %v", err)
+	}
 	logger.Debug("Created client")
 
 	logger.Debug("Creating GitHub client")
-	gitHubClient := github.NewClient(&http.Client{Transport: itrForGitHub})
+	gitHubClient, err := ghclient.NewREST(config.Apps.GitHub, itrForGitHub)
+	if err != nil {
+		logger.Fatalf("Failed creating GitHub client: %v", err)
+	}
 	logger.Debug("Created GitHub client")
 
 	logger.Debug("Creating GitHub GraphQL client")
-	graphQLClient := githubv4.NewClient(&http.Client{Transport: itrForGitHub})
+	graphQLClient := ghclient.NewGraphQL(config.Apps.GitHub, itrForGitHub)
 	logger.Debug("Created GitHub GraphQL client")
 
 	logger.Info("Initialize Router")
@@ -69,18 +135,87 @@ func main() {
 		},
 	}))
 	router.Use(gin.Logger())
+	router.Use(otelgin.Middleware(config.Tracing.ServiceName))
 	logger.Debug("Initialized Router")
 
 	dbClient, err := sql.Open("mysql", "root:root@/")
 	if err != nil {
 		panic(err)
 	}
+	// Each advisory lock holds a connection for as long as its event is handled, so the pool is
+	// widened by one connection per worker to leave room for the handlers' own queries.
+	maxConns := 10
+	if config.Concurrency.AdvisoryLocks {
+		maxConns += config.Concurrency.Workers
+	}
 	dbClient.SetConnMaxLifetime(time.Minute * 3)
-	dbClient.SetMaxOpenConns(10)
-	dbClient.SetMaxIdleConns(10)
+	dbClient.SetMaxOpenConns(maxConns)
+	dbClient.SetMaxIdleConns(maxConns)
 
 	dbManager := &db.Manager{
-		Client: dbClient,
+		Client:  dbClient,
+		Timeout: config.Timeouts.Database,
+	}
+
+	var attachmentMirror *attachments.Mirror
+	if config.Attachments.Enabled {
+		logger.Debug("Creating attachment store")
+		store, err := attachments.NewStore(config.Attachments, gitHubClient, config.Timeouts.GitHub)
+		if err != nil {
+			logger.Fatalf("Failed creating attachment store: %v", err)
+		}
+		pattern, err := attachments.Pattern(config.Apps.Client.BaseURL, config.Apps.GitHub.BaseURL)
+		if err != nil {
+			logger.Fatalf("Failed creating attachment pattern: %v", err)
+		}
+		attachmentMirror = &attachments.Mirror{
+			Pattern:   pattern,
+			Store:     store,
+			DBClient:  dbManager,
+			MaxSize:   config.Attachments.MaxSize,
+			Timeout:   config.Timeouts.GitHub,
+			Logger:    logger,
+			Transport: tracing.NewTransport(http.DefaultTransport),
+		}
+		logger.Debug("Created attachment store")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	elector := &leader.Elector{
+		DBClient:      dbManager,
+		Logger:        logger,
+		Name:          "jobs",
+		Identity:      hostname + "-" + uuid.NewString()[:8],
+		LeaseDuration: config.Leadership.LeaseDuration,
+		RenewInterval: config.Leadership.RenewInterval,
+	}
+
+	var deliveries queue.Queue
+	if config.Queue.Backend != "" {
+		logger.Debugf("Creating %s queue", config.Queue.Backend)
+		deliveries, err = queue.New(config.Queue, dbManager, logger)
+		if err != nil {
+			logger.Fatalf("Failed creating queue: %v", err)
+		}
+		logger.Debugf("Created %s queue", config.Queue.Backend)
+	}
+
+	var recorder *recording.Recorder
+	if config.Recording.Path != "" && *replay == "" {
+		logger.Debug("Opening delivery recording")
+		recorder, err = recording.NewRecorder(config.Recording.Path, logger)
+		if err != nil {
+			logger.Fatalf("Failed opening delivery recording: %v", err)
+		}
+		logger.Debug("Opened delivery recording")
+	}
+
+	var locker executor.Locker
+	if config.Concurrency.AdvisoryLocks {
+		locker = dbManager
 	}
 
 	manager := &server.Manager{
@@ -95,12 +230,21 @@ func main() {
 		DBClient:      dbManager,
 		GitHubClient:  gitHubClient,
 		GraphQLClient: graphQLClient,
+		Breaker:       circuitBreaker,
+		Executor:      executor.New(config.Concurrency.Workers, locker, logger),
+		Elector:       elector,
+		Mode:          *mode,
+		Queue:         deliveries,
+		Recorder:      recorder,
 		EMUHandler: &handlers.EMU{
 			Client:        client,
 			DBClient:      dbManager,
 			GitHubClient:  gitHubClient,
 			GraphQLClient: graphQLClient,
+			Transport:     transport,
+			Attachments:   attachmentMirror,
 			Config:        config,
+			Formatter:     formatter,
 			Logger:        logger,
 		},
 		GitHubHandler: &handlers.GitHub{
@@ -108,23 +252,80 @@ func main() {
 			DBClient:      dbManager,
 			GitHubClient:  gitHubClient,
 			GraphQLClient: graphQLClient,
+			Transport:     transport,
 			Config:        config,
+			Formatter:     formatter,
 			Logger:        logger,
 		},
 	}
 
-	err = manager.DBClient.InitDB()
+	err = manager.DBClient.InitDB(context.Background())
 	if err != nil {
 		panic(err)
 	}
+
+	if *replay != "" {
+		manager.Mode, manager.Queue = server.ModeAll, nil
+		manager.SetRoutes()
+		replayDeliveries(logger, manager.Router, *replay, *replaySpeed)
+		return
+	}
+
+	if *driftReport != "" {
+		logger.Info("Scanning for drift")
+		report, err := manager.GitHubHandler.ScanDrift(context.Background())
+		if err != nil {
+			logger.Fatalf("Failed scanning for drift: %v", err)
+		}
+		data, err := report.Render(*driftReport)
+		if err != nil {
+			logger.Fatalf("Failed rendering drift report: %v", err)
+		}
+		_, err = os.Stdout.Write(data)
+		if err != nil {
+			logger.Fatalf("Failed writing drift report: %v", err)
+		}
+		return
+	}
 	manager.Serve()
 }
 
-func initConfig() (*types.Config, []byte, []byte) {
+// replayDeliveries feeds a recording back through the webhook endpoints, handling each delivery
+// in-process rather than queueing it, and exits non-zero if any is answered differently than recorded.
+// Without a handler, the deliveries are only listed.
+func replayDeliveries(logger *logrus.Logger, handler http.Handler, path string, speed float64) {
+	file, err := os.Open(path)
+	if err != nil {
+		logger.Fatalf("Failed opening recording: %v", err)
+	}
+	defer file.Close()
+
+	logger.Infof("Replaying deliveries from %s", path)
+	replayer := &recording.Replayer{
+		Handler: handler,
+		Speed:   speed,
+		DryRun:  handler == nil,
+		Out:     os.Stdout,
+	}
+	summary, err := replayer.Replay(context.Background(), file)
+	if err != nil {
+		logger.Fatalf("Failed replaying deliveries: %v", err)
+	}
+	logger.Infof("Replayed %d deliveries, %d answered differently than recorded", summary.Replayed, summary.Mismatched)
+	if summary.Mismatched > 0 {
+		file.Close()
+		os.Exit(1)
+	}
+}
+
+func initConfig(configFile string) (*types.Config, []byte, []byte) {
 	var bytes []byte
 	var err error
 	logrus.Info("Loading configuration")
 	configPath, set := os.LookupEnv("CONFIG_PATH")
+	if configFile != "" {
+		configPath, set = configFile, true
+	}
 	if set {
 		bytes, err = ioutil.ReadFile(configPath)
 	} else {
@@ -153,6 +354,139 @@ func initConfig() (*types.Config, []byte, []byte) {
 	if config.Logging.Level == "" {
 		config.Logging.Level = "info"
 	}
+
+	if config.Timeouts.Database <= 0 {
+		config.Timeouts.Database = 5 * time.Second
+	}
+	if config.Timeouts.GitHub <= 0 {
+		config.Timeouts.GitHub = 15 * time.Second
+	}
+	if config.Timeouts.GraphQL <= 0 {
+		config.Timeouts.GraphQL = 15 * time.Second
+	}
+	if config.Timeouts.Webhook <= 0 {
+		config.Timeouts.Webhook = time.Minute
+	}
+
+	if config.Attachments.Enabled {
+		switch config.Attachments.Backend {
+		case "repo":
+			if config.Attachments.Repo.Name == "" {
+				logrus.Fatal("Re-hosting attachments in a repository requires you set the following attachments values: repo.name")
+			}
+			if config.Attachments.Repo.Org == "" {
+				config.Attachments.Repo.Org = config.Repo.Org
+			}
+			if config.Attachments.Repo.Path == "" {
+				config.Attachments.Repo.Path = "attachments"
+			}
+		case "filesystem":
+			if config.Attachments.Filesystem.Directory == "" || config.Attachments.Filesystem.BaseURL == "" {
+				logrus.Fatal("Re-hosting attachments on the filesystem requires you set the following attachments values: filesystem.directory, filesystem.baseURL")
+			}
+		default:
+			logrus.Fatal("Re-hosting attachments requires you set attachments.backend to one of: repo, filesystem")
+		}
+		if config.Attachments.MaxSize <= 0 {
+			config.Attachments.MaxSize = 25 << 20
+		}
+	}
+
+	for _, direction := range []*string{&config.Moderation.Lock, &config.Moderation.Minimize} {
+		switch *direction {
+		case "":
+			*direction = "none"
+		case "none", "to-emu", "to-github", "both":
+		default:
+			logrus.Fatalf("Invalid moderation direction %q, must be one of: none, to-emu, to-github, both", *direction)
+		}
+	}
+	if config.Moderation.Interval <= 0 {
+		config.Moderation.Interval = 5 * time.Minute
+	}
+
+	if config.Breaker.Threshold <= 0 {
+		config.Breaker.Threshold = 5
+	}
+	if config.Breaker.Cooldown <= 0 {
+		config.Breaker.Cooldown = 30 * time.Second
+	}
+
+	if config.Concurrency.Workers <= 0 {
+		config.Concurrency.Workers = 10
+	}
+
+	if config.Leadership.LeaseDuration <= 0 {
+		config.Leadership.LeaseDuration = 30 * time.Second
+	}
+	if config.Leadership.RenewInterval <= 0 {
+		config.Leadership.RenewInterval = 10 * time.Second
+	}
+	if config.Leadership.RenewInterval >= config.Leadership.LeaseDuration {
+		logrus.Fatalf("Leadership renewInterval must be shorter than leaseDuration")
+	}
+
+	if config.Parking.Interval <= 0 {
+		config.Parking.Interval = time.Minute
+	}
+	if config.Parking.MaxAttempts <= 0 {
+		config.Parking.MaxAttempts = 10
+	}
+
+	if config.Poll.Interval <= 0 {
+		config.Poll.Interval = time.Minute
+	}
+
+	if config.Reconcile.OperationsInterval <= 0 {
+		config.Reconcile.OperationsInterval = 10 * time.Minute
+	}
+
+	switch config.Queue.Backend {
+	case "", "sql":
+	case "file":
+		if config.Queue.File.Directory == "" {
+			logrus.Fatal("Queueing deliveries in files requires you set the following queue values: file.directory")
+		}
+	case "nats":
+		if config.Queue.NATS.URL == "" {
+			config.Queue.NATS.URL = "nats://127.0.0.1:4222"
+		}
+		if config.Queue.NATS.Stream == "" {
+			config.Queue.NATS.Stream = "ISSUE_SYNC"
+		}
+		if config.Queue.NATS.Subject == "" {
+			config.Queue.NATS.Subject = "issue-sync.webhooks"
+		}
+		if config.Queue.NATS.Consumer == "" {
+			config.Queue.NATS.Consumer = "workers"
+		}
+	default:
+		logrus.Fatal("Queueing deliveries requires you set queue.backend to one of: sql, file, nats")
+	}
+	if config.Queue.PollInterval <= 0 {
+		config.Queue.PollInterval = time.Second
+	}
+	if config.Queue.RetryDelay <= 0 {
+		config.Queue.RetryDelay = 30 * time.Second
+	}
+	if config.Queue.VisibilityTimeout <= 0 {
+		config.Queue.VisibilityTimeout = 5 * time.Minute
+	}
+	if config.Queue.Backend != "" && config.Queue.VisibilityTimeout <= config.Timeouts.Webhook {
+		logrus.Fatalf("Queue visibilityTimeout must be longer than the webhook timeout")
+	}
+
+	if config.Reactions.Interval <= 0 {
+		config.Reactions.Interval = 5 * time.Minute
+	}
+
+	if config.Reconcile.RepositoriesInterval <= 0 {
+		config.Reconcile.RepositoriesInterval = time.Hour
+	}
+
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = "github-issue-sync"
+	}
 	logrus.Info("Configuration validated")
 
 	logrus.Info("Decoding GitHub private key")
@@ -0,0 +1,215 @@
+package attachments
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/sirupsen/logrus"
+)
+
+// Pattern returns a pattern matching links to attachments uploaded to the instances behind the given
+// API base URLs, which are only readable by members of the enterprise. An empty base URL stands for
+// github.com.
+func Pattern(baseURLs ...string) (*regexp.Regexp, error) {
+	var prefixes []string
+	seen := map[string]bool{}
+	for _, baseURL := range baseURLs {
+		host, enterpriseServer, err := webHost(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse base URL %s: %w", baseURL, err)
+		}
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		quoted := regexp.QuoteMeta(host)
+		prefixes = append(prefixes, quoted+`/user-attachments/(?:assets|files)`)
+		switch {
+		case host == "github.com":
+			prefixes = append(prefixes, `private-user-images\.githubusercontent\.com`)
+		case enterpriseServer:
+			prefixes = append(prefixes, quoted+`/storage/user`)
+		}
+	}
+	return regexp.Compile(`https://(?:` + strings.Join(prefixes, "|") + `)/[^\s()<>"'\]]+`)
+}
+
+// webHost returns the host serving the web UI of the instance behind an API base URL, and whether the
+// instance is GitHub Enterprise Server, which serves its API under /api/v3 of the web host rather than
+// on a dedicated api. host.
+func webHost(baseURL string) (string, bool, error) {
+	if baseURL == "" {
+		return "github.com", false, nil
+	}
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return "", false, err
+	}
+	if strings.HasPrefix(strings.TrimSuffix(parsed.Path, "/"), "/api/v3") {
+		return parsed.Host, true, nil
+	}
+	return strings.TrimPrefix(parsed.Host, "api."), false, nil
+}
+
+// maxRedirects bounds the redirects followed when downloading an attachment.
+const maxRedirects = 10
+
+// TokenSource supplies the installation token attachment downloads are authenticated with.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// Store persists a re-hosted attachment and returns the URL it is served from.
+type Store interface {
+	Put(ctx context.Context, name, contentType string, data []byte) (string, error)
+}
+
+// Mirror re-hosts the attachments linked from a body. Re-hosted URLs are recorded so an attachment is
+// only downloaded once, however many times the body it appears in is edited.
+type Mirror struct {
+	// Pattern matches the attachment links to re-host, see Pattern.
+	Pattern  *regexp.Regexp
+	Store    Store
+	DBClient *db.Manager
+	MaxSize  int64
+	Timeout  time.Duration
+	Logger   *logrus.Logger
+	// Transport carries the downloads. It adds no authentication, and downloads are kept out of the
+	// circuit breaker guarding the API, as attachments are served by storage hosts rather than the API.
+	Transport http.RoundTripper
+}
+
+// Rewrite returns body with every attachment link pointed at its re-hosted copy. Downloads are
+// authenticated with a token from tokens. Attachments that cannot be re-hosted keep their original link.
+func (m *Mirror) Rewrite(ctx context.Context, tokens TokenSource, body string) string {
+	rewritten := map[string]string{}
+	for _, link := range m.Pattern.FindAllString(body, -1) {
+		if _, ok := rewritten[link]; ok {
+			continue
+		}
+		hosted, err := m.rehost(ctx, tokens, link)
+		if err != nil {
+			m.Logger.Warnf("Unable to re-host attachment %s: %v", sourceKey(link), err)
+			continue
+		}
+		rewritten[link] = hosted
+	}
+	for link, hosted := range rewritten {
+		body = strings.ReplaceAll(body, link, hosted)
+	}
+	return body
+}
+
+func (m *Mirror) rehost(ctx context.Context, tokens TokenSource, link string) (string, error) {
+	key := sourceKey(link)
+	hosted, ok, err := m.DBClient.GetAttachmentURL(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return hosted, nil
+	}
+
+	data, contentType, err := m.download(ctx, tokens, link)
+	if err != nil {
+		return "", err
+	}
+	hosted, err = m.Store.Put(ctx, name(key, contentType, data), contentType, data)
+	if err != nil {
+		return "", err
+	}
+	err = m.DBClient.InsertAttachmentEntry(ctx, key, hosted)
+	if err != nil {
+		return "", err
+	}
+	return hosted, nil
+}
+
+// download fetches an attachment. Only the request to the instance the link points at carries the
+// token: attachments are served through redirects to storage hosts, which must not receive it.
+func (m *Mirror) download(ctx context.Context, tokens TokenSource, link string) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := tokens.Token(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	client := &http.Client{
+		Transport: m.Transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects downloading attachment")
+			}
+			if req.URL.Host != via[0].URL.Host {
+				req.Header.Del("Authorization")
+			}
+			return nil
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status downloading attachment: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, m.MaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > m.MaxSize {
+		return nil, "", fmt.Errorf("attachment exceeds the maximum size of %d bytes", m.MaxSize)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, nil
+}
+
+// sourceKey identifies an attachment by its link without the query string, which for
+// private-user-images carries a short-lived token.
+func sourceKey(link string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	parsed.RawQuery = ""
+	return parsed.String()
+}
+
+// name derives a stable file name from the attachment's content, keeping the extension of the
+// original link when it has one.
+func name(key, contentType string, data []byte) string {
+	sum := sha256.Sum256(data)
+	ext := path.Ext(key)
+	if ext == "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if extensions, _ := mime.ExtensionsByType(mediaType); len(extensions) > 0 {
+			ext = extensions[0]
+		}
+	}
+	return hex.EncodeToString(sum[:]) + ext
+}
@@ -0,0 +1,106 @@
+package attachments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// NewStore returns the store selected by the attachments configuration. The repo backend commits
+// attachments to an assets repository with client.
+func NewStore(config types.Attachments, client *github.Client, timeout time.Duration) (Store, error) {
+	switch config.Backend {
+	case "repo":
+		return &RepoStore{
+			Client:  client,
+			Org:     config.Repo.Org,
+			Repo:    config.Repo.Name,
+			Branch:  config.Repo.Branch,
+			Path:    config.Repo.Path,
+			Timeout: timeout,
+		}, nil
+	case "filesystem":
+		err := os.MkdirAll(config.Filesystem.Directory, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return &FileStore{
+			Directory: config.Filesystem.Directory,
+			BaseURL:   config.Filesystem.BaseURL,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown attachments backend: %s", config.Backend)
+	}
+}
+
+// RepoStore commits attachments to a repository. Attachments are served from the repository's web
+// URL, so they are visible to anyone with read access to it.
+type RepoStore struct {
+	Client  *github.Client
+	Org     string
+	Repo    string
+	Branch  string
+	Path    string
+	Timeout time.Duration
+}
+
+func (s *RepoStore) Put(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	filePath := path.Join(s.Path, name)
+	opts := &github.RepositoryContentFileOptions{
+		Message: github.String(fmt.Sprintf("Mirror attachment %s", name)),
+		Content: data,
+	}
+	if s.Branch != "" {
+		opts.Branch = &s.Branch
+	}
+	created, _, err := s.Client.Repositories.CreateFile(ctx, s.Org, s.Repo, filePath, opts)
+	if err == nil {
+		return rawURL(created.Content.GetHTMLURL()), nil
+	}
+
+	// Files are named by their content, so an existing file is the same attachment.
+	var errResp *github.ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Response.StatusCode != http.StatusUnprocessableEntity {
+		return "", err
+	}
+	existing, _, _, err := s.Client.Repositories.GetContents(ctx, s.Org, s.Repo, filePath, &github.RepositoryContentGetOptions{Ref: s.Branch})
+	if err != nil {
+		return "", err
+	}
+	return rawURL(existing.GetHTMLURL()), nil
+}
+
+func rawURL(htmlURL string) string {
+	return htmlURL + "?raw=true"
+}
+
+// FileStore writes attachments to a local directory, which the server exposes under BaseURL.
+type FileStore struct {
+	Directory string
+	BaseURL   string
+}
+
+func (s *FileStore) Put(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	filePath := filepath.Join(s.Directory, name)
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		err = ioutil.WriteFile(filePath, data, 0644)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + name, nil
+}
@@ -0,0 +1,194 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrOpen is returned instead of sending a request while the breaker is open.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// IsOpen reports whether err is a request rejected by an open breaker. Besides the usual wrapping, it
+// sees through the errors installation transports return when a token refresh is rejected, which keep
+// the rejection as their root cause without unwrapping to it.
+func IsOpen(err error) bool {
+	if errors.Is(err, ErrOpen) {
+		return true
+	}
+	var httpErr *ghinstallation.HTTPError
+	if errors.As(err, &httpErr) {
+		return IsOpen(httpErr.RootCause)
+	}
+	return false
+}
+
+// State is the state of a breaker.
+type State string
+
+const (
+	// Closed lets every request through.
+	Closed State = "closed"
+	// Open rejects every request until the cooldown has passed.
+	Open State = "open"
+	// HalfOpen lets a single probe through, whose outcome closes or reopens the breaker.
+	HalfOpen State = "half-open"
+)
+
+// Breaker stops requests to GitHub once Threshold consecutive requests have failed with a 5xx or a
+// timeout, so an outage is not made worse by every delivery retrying against it. After Cooldown a
+// single probe is let through: if it succeeds the breaker closes, otherwise it opens again.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	Logger    *logrus.Logger
+
+	mutex    sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Status is a snapshot of a breaker, as reported on the status endpoint.
+type Status struct {
+	State    State      `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+}
+
+// Status returns the breaker's current state.
+func (b *Breaker) Status() Status {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	status := Status{State: b.current(), Failures: b.failures}
+	if status.State != Closed {
+		openedAt, retryAt := b.openedAt.UTC(), b.openedAt.Add(b.Cooldown).UTC()
+		status.OpenedAt, status.RetryAt = &openedAt, &retryAt
+	}
+	return status
+}
+
+// RetryAfter returns how long until the breaker lets a probe through, or zero if it is not open.
+func (b *Breaker) RetryAfter() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.current() != Open {
+		return 0
+	}
+	return time.Until(b.openedAt.Add(b.Cooldown))
+}
+
+// current returns the state, treating an open breaker whose cooldown has passed as half-open.
+func (b *Breaker) current() State {
+	switch {
+	case b.state == "":
+		return Closed
+	case b.state == Open && time.Since(b.openedAt) >= b.Cooldown:
+		return HalfOpen
+	default:
+		return b.state
+	}
+}
+
+// allow reports whether a request may be sent, and whether it is the half-open probe.
+func (b *Breaker) allow() (bool, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.current() {
+	case Closed:
+		return true, false
+	case HalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.state, b.probing = HalfOpen, true
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// record updates the breaker with the outcome of a request. Requests cancelled by their caller say
+// nothing about GitHub's health and only give up the probe.
+func (b *Breaker) record(probe bool, outcome outcome) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+	switch outcome {
+	case success:
+		if b.state != Closed && b.state != "" {
+			b.Logger.Info("GitHub requests are succeeding again, closing circuit breaker")
+		}
+		b.state, b.failures = Closed, 0
+	case failure:
+		b.failures++
+		if probe || (b.current() == Closed && b.failures >= b.Threshold) {
+			b.Logger.Warnf("Opening circuit breaker for %s after %d consecutive failed GitHub requests", b.Cooldown, b.failures)
+			b.state, b.openedAt = Open, time.Now()
+		}
+	}
+}
+
+type outcome int
+
+const (
+	ignored outcome = iota
+	success
+	failure
+)
+
+// classify decides whether a request counts towards tripping the breaker.
+func classify(resp *http.Response, err error) outcome {
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return failure
+		}
+		if errors.Is(err, context.Canceled) {
+			return ignored
+		}
+		return failure
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return failure
+	}
+	return success
+}
+
+// Transport wraps the given transport so requests go through the breaker. Requests are rejected
+// with ErrOpen while it is open.
+func (b *Breaker) Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{breaker: b, base: base}
+}
+
+type transport struct {
+	breaker *Breaker
+	base    http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	allowed, probe := t.breaker.allow()
+	if !allowed {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrOpen
+	}
+	resp, err := t.base.RoundTrip(req)
+	t.breaker.record(probe, classify(resp, err))
+	return resp, err
+}
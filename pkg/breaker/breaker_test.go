@@ -0,0 +1,228 @@
+package breaker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/sirupsen/logrus"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// step is a request sent through the breaker's transport. A zero status sends nothing upstream and
+// expects the request to be rejected.
+type step struct {
+	status int
+	err    error
+	// elapse moves the breaker's clock past the cooldown before the request is sent.
+	elapse bool
+	want   State
+}
+
+func TestTransport(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "stays closed below the threshold",
+			steps: []step{
+				{status: http.StatusBadGateway, want: Closed},
+				{status: http.StatusBadGateway, want: Closed},
+				{status: http.StatusOK, want: Closed},
+				{status: http.StatusBadGateway, want: Closed},
+				{status: http.StatusBadGateway, want: Closed},
+			},
+		},
+		{
+			name: "opens at the threshold and rejects requests",
+			steps: []step{
+				{status: http.StatusBadGateway, want: Closed},
+				{status: http.StatusServiceUnavailable, want: Closed},
+				{err: context.DeadlineExceeded, want: Open},
+				{want: Open},
+			},
+		},
+		{
+			name: "client errors and cancellations do not count",
+			steps: []step{
+				{status: http.StatusNotFound, want: Closed},
+				{status: http.StatusUnprocessableEntity, want: Closed},
+				{err: context.Canceled, want: Closed},
+				{err: context.Canceled, want: Closed},
+				{err: context.Canceled, want: Closed},
+			},
+		},
+		{
+			name: "closes after a successful probe",
+			steps: []step{
+				{status: http.StatusBadGateway, want: Closed},
+				{status: http.StatusBadGateway, want: Closed},
+				{status: http.StatusBadGateway, want: Open},
+				{status: http.StatusOK, elapse: true, want: Closed},
+				{status: http.StatusOK, want: Closed},
+			},
+		},
+		{
+			name: "reopens after a failed probe",
+			steps: []step{
+				{status: http.StatusBadGateway, want: Closed},
+				{status: http.StatusBadGateway, want: Closed},
+				{status: http.StatusBadGateway, want: Open},
+				{status: http.StatusInternalServerError, elapse: true, want: Open},
+				{want: Open},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &Breaker{Threshold: 3, Cooldown: time.Hour, Logger: logrus.New()}
+			for i, s := range test.steps {
+				if s.elapse {
+					b.mutex.Lock()
+					b.openedAt = b.openedAt.Add(-b.Cooldown)
+					b.mutex.Unlock()
+				}
+				sent := false
+				transport := b.Transport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+					sent = true
+					if s.err != nil {
+						return nil, s.err
+					}
+					return &http.Response{StatusCode: s.status, Body: http.NoBody}, nil
+				}))
+
+				_, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "https://api.github.com/", nil))
+				rejected := s.status == 0 && s.err == nil
+				if rejected != errors.Is(err, ErrOpen) {
+					t.Fatalf("step %d: got error %v, want rejected %t", i, err, rejected)
+				}
+				if sent == rejected {
+					t.Fatalf("step %d: request sent %t, want %t", i, sent, !rejected)
+				}
+				if got := b.Status().State; got != s.want {
+					t.Fatalf("step %d: got state %s, want %s", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHalfOpenAllowsOneProbe(t *testing.T) {
+	b := &Breaker{Threshold: 1, Cooldown: time.Hour, Logger: logrus.New()}
+	b.record(false, failure)
+	b.openedAt = b.openedAt.Add(-b.Cooldown)
+	if got := b.Status().State; got != HalfOpen {
+		t.Fatalf("got state %s, want %s", got, HalfOpen)
+	}
+	if got := b.RetryAfter(); got != 0 {
+		t.Fatalf("got retry after %s while half-open, want 0", got)
+	}
+
+	allowed, probe := b.allow()
+	if !allowed || !probe {
+		t.Fatalf("first request: got allowed %t probe %t, want the probe", allowed, probe)
+	}
+	if allowed, _ := b.allow(); allowed {
+		t.Fatalf("second request was allowed while the probe is in flight")
+	}
+	b.record(true, ignored)
+	if allowed, probe := b.allow(); !allowed || !probe {
+		t.Fatalf("request after a cancelled probe: got allowed %t probe %t, want a new probe", allowed, probe)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	b := &Breaker{Threshold: 1, Cooldown: time.Minute, Logger: logrus.New()}
+	if got := b.RetryAfter(); got != 0 {
+		t.Fatalf("got retry after %s while closed, want 0", got)
+	}
+	b.record(false, failure)
+	if got := b.RetryAfter(); got <= 0 || got > time.Minute {
+		t.Fatalf("got retry after %s while open, want up to %s", got, time.Minute)
+	}
+}
+
+func TestIsOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "other error", err: errors.New("boom"), want: false},
+		{name: "rejection", err: ErrOpen, want: true},
+		{name: "wrapped rejection", err: fmt.Errorf("request failed: %w", ErrOpen), want: true},
+		{name: "url error", err: &url.Error{Op: "Get", URL: "https://api.github.com/", Err: ErrOpen}, want: true},
+		{name: "token refresh rejection", err: &ghinstallation.HTTPError{Message: "could not get access_tokens", RootCause: ErrOpen}, want: true},
+		{
+			name: "wrapped token refresh rejection",
+			err:  &url.Error{Op: "Get", URL: "https://api.github.com/", Err: fmt.Errorf("could not refresh token: %w", &ghinstallation.HTTPError{RootCause: ErrOpen})},
+			want: true,
+		},
+		{name: "token refresh failure", err: &ghinstallation.HTTPError{Message: "received non 2xx response", RootCause: nil}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsOpen(test.err); got != test.want {
+				t.Fatalf("IsOpen(%v) = %t, want %t", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+// TestInstallationTransport checks a rejection is still recognised after passing through an
+// installation transport, which reports it from the token refresh it failed.
+func TestInstallationTransport(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	b := &Breaker{Threshold: 1, Cooldown: time.Hour, Logger: logrus.New()}
+	b.record(false, failure)
+	base := roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		t.Fatal("request sent while the breaker is open")
+		return nil, nil
+	})
+	itr, err := ghinstallation.New(b.Transport(base), 1, 2, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: itr}
+	resp, err := client.Get("https://api.github.com/repos/octo/repo/issues/1")
+	if resp != nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatal("request succeeded while the breaker is open")
+	}
+	if !IsOpen(err) {
+		t.Fatalf("IsOpen(%v) = false, want true", err)
+	}
+	if !strings.Contains(err.Error(), "access_tokens") {
+		t.Fatalf("got error %v, want the token refresh to have been rejected", err)
+	}
+}
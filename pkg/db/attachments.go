@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+)
+
+// GetAttachmentURL returns the re-hosted URL of an attachment, and whether it has been re-hosted.
+func (m *Manager) GetAttachmentURL(ctx context.Context, sourceURL string) (string, bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetAttachmentURL", "SELECT url FROM issue_sync.attachments WHERE source_url = ? LIMIT 1", sourceURL)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+
+	var url string
+	if rows.Next() {
+		err = rows.Scan(&url)
+		if err != nil {
+			return "", false, err
+		}
+		return url, true, nil
+	}
+	return "", false, rows.Err()
+}
+
+func (m *Manager) InsertAttachmentEntry(ctx context.Context, sourceURL, url string) error {
+	err := m.exec(ctx, "InsertAttachmentEntry", "INSERT INTO issue_sync.attachments (source_url, url) VALUES (?, ?) ON DUPLICATE KEY UPDATE url = VALUES(url)", sourceURL, url)
+	if err != nil {
+		return err
+	}
+	return nil
+}
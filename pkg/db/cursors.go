@@ -0,0 +1,61 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PollCursor is how far polling of one listing has got. Position is the last updated_at seen, in unix
+// seconds, or the last event id for listings without a since parameter. Seen holds the ids of the
+// items seen at Position, which a since listing returns again. ETag is the listing's last ETag, for a
+// conditional request.
+type PollCursor struct {
+	Name     string
+	Position int64
+	Seen     []int64
+	ETag     string
+}
+
+// GetPollCursor returns the named cursor, or nil if polling of its listing has not started.
+func (m *Manager) GetPollCursor(ctx context.Context, name string) (*PollCursor, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetPollCursor", "SELECT position, COALESCE(seen, ''), COALESCE(etag, '') FROM issue_sync.poll_cursors WHERE name = ? LIMIT 1", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	cursor := &PollCursor{Name: name}
+	var seen string
+	err = rows.Scan(&cursor.Position, &seen, &cursor.ETag)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range strings.Split(seen, ",") {
+		parsed, err := strconv.ParseInt(id, 10, 64)
+		if err == nil {
+			cursor.Seen = append(cursor.Seen, parsed)
+		}
+	}
+	return cursor, nil
+}
+
+// SavePollCursor records how far polling of a listing has got.
+func (m *Manager) SavePollCursor(ctx context.Context, cursor *PollCursor) error {
+	seen := make([]string, len(cursor.Seen))
+	for i, id := range cursor.Seen {
+		seen[i] = strconv.FormatInt(id, 10)
+	}
+	err := m.exec(ctx, "SavePollCursor", "INSERT INTO issue_sync.poll_cursors (name, position, seen, etag, updated_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE position = VALUES(position), seen = VALUES(seen), etag = VALUES(etag), updated_at = VALUES(updated_at)", cursor.Name, cursor.Position, strings.Join(seen, ","), cursor.ETag, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// DebouncedEdit is the latest edit of an issue held back until its debounce window closes. Key is the
+// key the issue's events are serialized on.
+type DebouncedEdit struct {
+	IssueID int64
+	Key     string
+	Payload []byte
+	// Revision counts the edits held for the issue, identifying the one that was read.
+	Revision int64
+}
+
+// DebounceEdit holds an edit event, replacing the edit already held for the issue unless that one is
+// newer, and pushes the issue's flush back to due.
+func (m *Manager) DebounceEdit(ctx context.Context, edit *DebouncedEdit, updatedAt, due time.Time) error {
+	err := m.exec(ctx, "DebounceEdit", "INSERT INTO issue_sync.debounced_edits (issue_id, event_key, payload, updated_at, due_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE payload = IF(VALUES(updated_at) >= updated_at, VALUES(payload), payload), updated_at = GREATEST(updated_at, VALUES(updated_at)), revision = revision + 1, due_at = VALUES(due_at)", edit.IssueID, edit.Key, string(edit.Payload), watermark(updatedAt), due.Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetDebouncedEdit returns the edit held for an issue, or nil if there is none.
+func (m *Manager) GetDebouncedEdit(ctx context.Context, issueID int64) (*DebouncedEdit, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetDebouncedEdit", "SELECT event_key, payload, revision FROM issue_sync.debounced_edits WHERE issue_id = ? LIMIT 1", issueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	edit := &DebouncedEdit{IssueID: issueID}
+	var payload string
+	err = rows.Scan(&edit.Key, &payload, &edit.Revision)
+	if err != nil {
+		return nil, err
+	}
+	edit.Payload = []byte(payload)
+	return edit, nil
+}
+
+// DeleteDebouncedEdit removes a flushed edit, unless a newer edit has replaced it since it was read.
+func (m *Manager) DeleteDebouncedEdit(ctx context.Context, edit *DebouncedEdit) error {
+	err := m.exec(ctx, "DeleteDebouncedEdit", "DELETE FROM issue_sync.debounced_edits WHERE issue_id = ? AND revision = ?", edit.IssueID, edit.Revision)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListDueDebouncedEdits returns the edits whose flush was due before the given time, without their
+// payloads.
+func (m *Manager) ListDueDebouncedEdits(ctx context.Context, before time.Time) ([]*DebouncedEdit, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ListDueDebouncedEdits", "SELECT issue_id, event_key FROM issue_sync.debounced_edits WHERE due_at < ? ORDER BY due_at", before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edits []*DebouncedEdit
+	for rows.Next() {
+		edit := &DebouncedEdit{}
+		err = rows.Scan(&edit.IssueID, &edit.Key)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
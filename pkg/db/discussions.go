@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// Discussions are mirrored either as discussions (kind 'discussion') or as issues (kind 'issue') in
+// the GitHub repository. synced_node_id is always set; synced_number holds the mirrored discussion or
+// issue number.
+
+func (m *Manager) InsertDiscussionEntry(ctx context.Context, webhook *types.WebHook, kind, syncedNodeID string, syncedNumber int) error {
+	d := webhook.Discussion
+	err := m.UpsertRepositoryEntry(ctx, webhook.Repository)
+	if err != nil {
+		return err
+	}
+	err = m.exec(ctx, "InsertDiscussionEntry", "INSERT INTO issue_sync.discussions (id, node_id, login, title, body, org, repo, discussion_number, kind, synced_node_id, synced_number, repo_node_id, updated_at, updated_delivery) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", d.ID, d.NodeID, d.User.GetLogin(), d.Title, d.Body, webhook.Repository.Owner.GetLogin(), webhook.Repository.GetName(), d.Number, kind, syncedNodeID, syncedNumber, webhook.Repository.GetNodeID(), watermark(d.UpdatedAt), webhook.DeliveryID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) UpdateDiscussionEntry(ctx context.Context, webhook *types.WebHook) error {
+	d := webhook.Discussion
+	err := m.exec(ctx, "UpdateDiscussionEntry", "UPDATE issue_sync.discussions SET login = ?, title = ?, body = ?, "+advanceWatermark+" WHERE id = ?", d.User.GetLogin(), d.Title, d.Body, watermark(d.UpdatedAt), webhook.DeliveryID, watermark(d.UpdatedAt), d.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) DeleteDiscussionEntry(ctx context.Context, webhook *types.WebHook) error {
+	err := m.exec(ctx, "DeleteDiscussionEntry", "DELETE FROM issue_sync.discussions WHERE id = ?", webhook.Discussion.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetSyncedDiscussionEntry returns the kind, node id and number of the item a discussion is mirrored to.
+func (m *Manager) GetSyncedDiscussionEntry(ctx context.Context, webhook *types.WebHook) (string, string, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetSyncedDiscussionEntry", "SELECT kind, synced_node_id, synced_number FROM issue_sync.discussions WHERE id = ? LIMIT 1", webhook.Discussion.ID)
+	if err != nil {
+		return "", "", -1, err
+	}
+	defer rows.Close()
+
+	var kind, syncedNodeID string
+	var syncedNumber int
+	if rows.Next() {
+		err = rows.Scan(&kind, &syncedNodeID, &syncedNumber)
+		if err != nil {
+			return "", "", -1, err
+		}
+		return kind, syncedNodeID, syncedNumber, nil
+	}
+	return "", "", -1, fmt.Errorf("unable to locate parent discussion: %w", ErrNotFound)
+}
+
+// GetEMUDiscussionEntry returns the id, node id and org of the EMU discussion mirrored to the given
+// GitHub discussion.
+func (m *Manager) GetEMUDiscussionEntry(ctx context.Context, webhook *types.WebHook) (int64, string, string, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetEMUDiscussionEntry", "SELECT issue_sync.discussions.id, issue_sync.discussions.node_id, COALESCE(issue_sync.repositories.org, issue_sync.discussions.org) FROM issue_sync.discussions LEFT JOIN issue_sync.repositories ON issue_sync.repositories.node_id = issue_sync.discussions.repo_node_id WHERE kind = 'discussion' AND synced_node_id = ? LIMIT 1", webhook.Discussion.NodeID)
+	if err != nil {
+		return -1, "", "", err
+	}
+	defer rows.Close()
+
+	var id int64
+	var nodeID, org string
+	if rows.Next() {
+		err = rows.Scan(&id, &nodeID, &org)
+		if err != nil {
+			return -1, "", "", err
+		}
+		return id, nodeID, org, nil
+	}
+	return -1, "", "", fmt.Errorf("unable to locate parent discussion: %w", ErrNotFound)
+}
+
+func (m *Manager) InsertDiscussionCommentEntry(ctx context.Context, webhook *types.WebHook, discussionID, syncedID int64, syncedNodeID string) error {
+	c := webhook.DiscussionComment
+	err := m.exec(ctx, "InsertDiscussionCommentEntry", "INSERT INTO issue_sync.discussion_comments (id, discussion_id, node_id, synced_id, synced_node_id, login, body, updated_at, updated_delivery) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", c.ID, discussionID, c.NodeID, syncedID, syncedNodeID, c.User.GetLogin(), c.Body, watermark(c.UpdatedAt), webhook.DeliveryID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) UpdateDiscussionCommentEntry(ctx context.Context, webhook *types.WebHook) error {
+	c := webhook.DiscussionComment
+	err := m.exec(ctx, "UpdateDiscussionCommentEntry", "UPDATE issue_sync.discussion_comments SET login = ?, body = ?, "+advanceWatermark+" WHERE id = ?", c.User.GetLogin(), c.Body, watermark(c.UpdatedAt), webhook.DeliveryID, watermark(c.UpdatedAt), c.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) DeleteDiscussionCommentEntry(ctx context.Context, webhook *types.WebHook) error {
+	err := m.exec(ctx, "DeleteDiscussionCommentEntry", "DELETE FROM issue_sync.discussion_comments WHERE id = ?", webhook.DiscussionComment.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetSyncedDiscussionCommentEntry returns the id and node id of the item a discussion comment is
+// mirrored to.
+func (m *Manager) GetSyncedDiscussionCommentEntry(ctx context.Context, id int64) (int64, string, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetSyncedDiscussionCommentEntry", "SELECT synced_id, synced_node_id FROM issue_sync.discussion_comments WHERE id = ? LIMIT 1", id)
+	if err != nil {
+		return -1, "", err
+	}
+	defer rows.Close()
+
+	var syncedID int64
+	var syncedNodeID string
+	if rows.Next() {
+		err = rows.Scan(&syncedID, &syncedNodeID)
+		if err != nil {
+			return -1, "", err
+		}
+		return syncedID, syncedNodeID, nil
+	}
+	return -1, "", fmt.Errorf("unable to locate discussion comment id: %w", ErrNotFound)
+}
+
+// GetSourceDiscussionCommentEntry returns the id and node id of the discussion comment mirrored to the
+// comment with the given id. Replies to a mirror are threaded under the comment it mirrors.
+func (m *Manager) GetSourceDiscussionCommentEntry(ctx context.Context, syncedID int64) (int64, string, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetSourceDiscussionCommentEntry", "SELECT id, node_id FROM issue_sync.discussion_comments WHERE synced_id = ? LIMIT 1", syncedID)
+	if err != nil {
+		return -1, "", err
+	}
+	defer rows.Close()
+
+	var id int64
+	var nodeID string
+	if rows.Next() {
+		err = rows.Scan(&id, &nodeID)
+		if err != nil {
+			return -1, "", err
+		}
+		return id, nodeID, nil
+	}
+	return -1, "", fmt.Errorf("unable to locate discussion comment synced to id: %w", ErrNotFound)
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+)
+
+// IssueSnapshot is the stored copy of a mapped issue or pull request, as compared by drift scans.
+type IssueSnapshot struct {
+	ID                int64
+	Kind              string
+	Org               string
+	Repo              string
+	IssueNumber       int
+	SyncedIssueNumber int
+	Title             string
+	Body              string
+	State             string
+}
+
+// CommentSnapshot is the stored copy of a mapped comment. Body is the body of the source comment,
+// which lives on the GitHub side when Origin is github.
+type CommentSnapshot struct {
+	ID              int64
+	SyncedCommentID int64
+	Origin          string
+	Body            string
+}
+
+func (m *Manager) ListIssueSnapshots(ctx context.Context) ([]*IssueSnapshot, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ListIssueSnapshots", "SELECT id, kind, org, repo, issue_number, synced_issue_number, COALESCE(title, ''), COALESCE(body, ''), COALESCE(state, '') FROM issue_sync.issues ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []*IssueSnapshot
+	for rows.Next() {
+		snapshot := &IssueSnapshot{}
+		err = rows.Scan(&snapshot.ID, &snapshot.Kind, &snapshot.Org, &snapshot.Repo, &snapshot.IssueNumber, &snapshot.SyncedIssueNumber, &snapshot.Title, &snapshot.Body, &snapshot.State)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+func (m *Manager) ListCommentSnapshots(ctx context.Context, issueID int64) ([]*CommentSnapshot, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ListCommentSnapshots", "SELECT id, synced_comment_id, origin, COALESCE(body, '') FROM issue_sync.comments WHERE issue_id = ? ORDER BY id", issueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []*CommentSnapshot
+	for rows.Next() {
+		snapshot := &CommentSnapshot{}
+		err = rows.Scan(&snapshot.ID, &snapshot.SyncedCommentID, &snapshot.Origin, &snapshot.Body)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, rows.Err()
+}
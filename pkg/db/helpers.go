@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/lindluni/github-issue-sync/pkg/db")
+
+func startSpan(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "db."+name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "mysql"),
+		attribute.String("db.name", "issue_sync"),
+		attribute.String("db.statement", query),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (m *Manager) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, m.Timeout)
+}
+
+func (m *Manager) exec(ctx context.Context, name, query string, args ...interface{}) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, name, query)
+	_, err := m.Client.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	return err
+}
+
+func (m *Manager) query(ctx context.Context, name, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startSpan(ctx, name, query)
+	rows, err := m.Client.QueryContext(ctx, query, args...)
+	endSpan(span, err)
+	return rows, err
+}
+
+// transact runs fn in a transaction, committing it if fn succeeds and rolling it back otherwise.
+func (m *Manager) transact(ctx context.Context, name string, fn func(ctx context.Context, tx *sql.Tx) error) (err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, name, "BEGIN")
+	defer func() { endSpan(span, err) }()
+	tx, err := m.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(ctx, tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insert runs an INSERT statement and returns the id generated for the new row.
+func (m *Manager) insert(ctx context.Context, name, query string, args ...interface{}) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, name, query)
+	result, err := m.Client.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	if err != nil {
+		return -1, err
+	}
+	return result.LastInsertId()
+}
+
+// update runs an UPDATE or INSERT statement and returns the number of rows it changed.
+func (m *Manager) update(ctx context.Context, name, query string, args ...interface{}) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, name, query)
+	result, err := m.Client.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	if err != nil {
+		return -1, err
+	}
+	return result.RowsAffected()
+}
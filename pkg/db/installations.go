@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+
+	"github.com/google/go-github/v41/github"
+)
+
+// Installations of both apps are recorded as their lifecycle events arrive, along with the
+// repositories each can access. app is 'client' for installations on EMU organizations and 'github'
+// for installations of the GitHub app.
+
+func (m *Manager) UpsertInstallationEntry(ctx context.Context, installation *github.Installation, app string) error {
+	err := m.exec(ctx, "UpsertInstallationEntry", "INSERT INTO issue_sync.installations (id, app, account, repository_selection, suspended) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE app = VALUES(app), account = VALUES(account), repository_selection = VALUES(repository_selection), suspended = VALUES(suspended)", installation.GetID(), app, installation.Account.GetLogin(), installation.GetRepositorySelection(), installation.SuspendedAt != nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) DeleteInstallationEntry(ctx context.Context, id int64) error {
+	err := m.exec(ctx, "DeleteInstallationEntry", "DELETE FROM issue_sync.installations WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) SetInstallationSuspended(ctx context.Context, id int64, suspended bool) error {
+	err := m.exec(ctx, "SetInstallationSuspended", "UPDATE issue_sync.installations SET suspended = ? WHERE id = ?", suspended, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsInstallationSuspended reports whether an installation is recorded as suspended. Installations
+// that were never recorded are assumed to be active.
+func (m *Manager) IsInstallationSuspended(ctx context.Context, id int64) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "IsInstallationSuspended", "SELECT suspended FROM issue_sync.installations WHERE id = ? LIMIT 1", id)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var suspended bool
+	if rows.Next() {
+		err = rows.Scan(&suspended)
+		if err != nil {
+			return false, err
+		}
+	}
+	return suspended, rows.Err()
+}
+
+func (m *Manager) AddInstallationRepositories(ctx context.Context, id int64, repositories []*github.Repository) error {
+	for _, repository := range repositories {
+		err := m.exec(ctx, "AddInstallationRepositories", "INSERT INTO issue_sync.installation_repositories (installation_id, repo_id, full_name) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE full_name = VALUES(full_name)", id, repository.GetID(), repository.GetFullName())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) RemoveInstallationRepositories(ctx context.Context, id int64, repositories []*github.Repository) error {
+	for _, repository := range repositories {
+		err := m.exec(ctx, "RemoveInstallationRepositories", "DELETE FROM issue_sync.installation_repositories WHERE installation_id = ? AND repo_id = ?", id, repository.GetID())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
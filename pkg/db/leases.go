@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Leases are held by one replica at a time until they expire. Times are taken from the database's
+// clock, in milliseconds, so that replicas with skewed clocks agree on when a lease has expired.
+const dbNow = "ROUND(UNIX_TIMESTAMP(NOW(3)) * 1000)"
+
+// Lease is the current holder of a named lease.
+type Lease struct {
+	Name      string
+	Holder    string
+	ExpiresAt time.Time
+	RenewedAt time.Time
+}
+
+// AcquireLease takes or renews the named lease for holder for the given duration, and reports whether
+// holder now has it. A lease held by another holder can only be taken once it has expired.
+func (m *Manager) AcquireLease(ctx context.Context, name, holder string, duration time.Duration) (bool, error) {
+	affected, err := m.update(ctx, "AcquireLease", "UPDATE issue_sync.leases SET holder = ?, expires_at = "+dbNow+" + ?, renewed_at = "+dbNow+" WHERE name = ? AND (holder = ? OR expires_at < "+dbNow+")", holder, duration.Milliseconds(), name, holder)
+	if err != nil {
+		return false, err
+	}
+	if affected > 0 {
+		return true, nil
+	}
+	affected, err = m.update(ctx, "AcquireLease", "INSERT IGNORE INTO issue_sync.leases (name, holder, expires_at, renewed_at) VALUES (?, ?, "+dbNow+" + ?, "+dbNow+")", name, holder, duration.Milliseconds())
+	if err != nil || affected > 0 {
+		return affected > 0, err
+	}
+	// A renewal that leaves the row unchanged, within the same millisecond, reports no affected rows.
+	lease, held, err := m.GetLease(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return held && lease.Holder == holder, nil
+}
+
+// ReleaseLease expires the named lease if holder has it, so another replica can take it without
+// waiting.
+func (m *Manager) ReleaseLease(ctx context.Context, name, holder string) error {
+	err := m.exec(ctx, "ReleaseLease", "UPDATE issue_sync.leases SET expires_at = 0 WHERE name = ? AND holder = ?", name, holder)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetLease returns the named lease, and whether it is currently held by anyone.
+func (m *Manager) GetLease(ctx context.Context, name string) (*Lease, bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetLease", "SELECT holder, expires_at, renewed_at, expires_at >= "+dbNow+" FROM issue_sync.leases WHERE name = ? LIMIT 1", name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+	lease := &Lease{Name: name}
+	var expiresAt, renewedAt int64
+	var held bool
+	err = rows.Scan(&lease.Holder, &expiresAt, &renewedAt, &held)
+	if err != nil {
+		return nil, false, err
+	}
+	lease.ExpiresAt, lease.RenewedAt = time.UnixMilli(expiresAt), time.UnixMilli(renewedAt)
+	return lease, held, nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+)
+
+// defaultLockWait bounds the wait for an advisory lock when the context has no deadline.
+const defaultLockWait = time.Minute
+
+// Lock takes a MySQL advisory lock named after key, waiting until the context's deadline for it. The
+// lock belongs to a connection set aside for it, which is returned to the pool when the lock is
+// released.
+func (m *Manager) Lock(ctx context.Context, key string) (func() error, error) {
+	name := lockName(key)
+	wait := defaultLockWait
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline)
+	}
+
+	conn, err := m.Client.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT GET_LOCK(?, ?)"
+	lockCtx, span := startSpan(ctx, "Lock", query)
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(lockCtx, query, name, int(math.Ceil(wait.Seconds()))).Scan(&locked)
+	endSpan(span, err)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("timed out waiting for lock on %s", key)
+	}
+
+	return func() error {
+		defer conn.Close()
+		ctx, cancel := m.withTimeout(context.Background())
+		defer cancel()
+		query := "SELECT RELEASE_LOCK(?)"
+		ctx, span := startSpan(ctx, "Unlock", query)
+		_, err := conn.ExecContext(ctx, query, name)
+		endSpan(span, err)
+		return err
+	}, nil
+}
+
+// lockName returns the advisory lock name for key, hashing keys that would exceed MySQL's limit of 64
+// characters.
+func lockName(key string) string {
+	name := "issue_sync:" + key
+	if len(name) <= 64 {
+		return name
+	}
+	sum := sha1.Sum([]byte(key))
+	return "issue_sync:" + hex.EncodeToString(sum[:])
+}
@@ -1,8 +1,10 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/lindluni/github-issue-sync/pkg/types"
@@ -10,86 +12,98 @@ import (
 
 type Manager struct {
 	Client *sql.DB
+
+	// Timeout bounds every individual statement; zero disables the limit.
+	Timeout time.Duration
 }
 
-func (m *Manager) InitDB() error {
-	_, err := m.Client.Exec("CREATE DATABASE IF NOT EXISTS issue_sync")
+func (m *Manager) InitDB(ctx context.Context) error {
+	err := m.exec(ctx, "InitDB", "CREATE DATABASE IF NOT EXISTS issue_sync")
 	if err != nil {
 		return err
 	}
-	_, err = m.Client.Exec("CREATE TABLE IF NOT EXISTS issue_sync.issues (id int NOT NULL, login VARCHAR(255), title VARCHAR(255), body TEXT, org VARCHAR(255), repo VARCHAR(255), issue_number int, state VARCHAR(255), synced_issue_number int, PRIMARY KEY (id))")
+	err = m.exec(ctx, "InitDB", "CREATE TABLE IF NOT EXISTS issue_sync.issues (id int NOT NULL, login VARCHAR(255), title VARCHAR(255), body TEXT, org VARCHAR(255), repo VARCHAR(255), issue_number int, state VARCHAR(255), synced_issue_number int, PRIMARY KEY (id))")
 	if err != nil {
 		return err
 	}
-	_, err = m.Client.Exec("CREATE TABLE IF NOT EXISTS issue_sync.comments (id int NOT NULL, issue_id int NOT NULL, synced_comment_id int, login VARCHAR(255), body TEXT, PRIMARY KEY (id), FOREIGN KEY (issue_id) REFERENCES issue_sync.issues(id) ON DELETE CASCADE)")
+	err = m.exec(ctx, "InitDB", "CREATE TABLE IF NOT EXISTS issue_sync.comments (id int NOT NULL, issue_id int NOT NULL, synced_comment_id int, login VARCHAR(255), body TEXT, PRIMARY KEY (id), FOREIGN KEY (issue_id) REFERENCES issue_sync.issues(id) ON DELETE CASCADE)")
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return m.migrate(ctx)
 }
 
-func (m *Manager) InsertIssueEntry(webhook *types.WebHook, syncedIssueNumber int) error {
-	_, err := m.Client.Exec("INSERT INTO issue_sync.issues (id, login, title, body, org, repo, issue_number, state, synced_issue_number) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", webhook.Issue.GetID(), webhook.Issue.User.GetLogin(), webhook.Issue.GetTitle(), webhook.Issue.GetBody(), webhook.Repository.Owner.GetLogin(), webhook.Repository.GetName(), webhook.Issue.GetNumber(), webhook.Issue.GetState(), syncedIssueNumber)
+func (m *Manager) InsertIssueEntry(ctx context.Context, webhook *types.WebHook, syncedIssueNumber int) error {
+	err := m.UpsertRepositoryEntry(ctx, webhook.Repository)
+	if err != nil {
+		return err
+	}
+	err = m.exec(ctx, "InsertIssueEntry", "INSERT INTO issue_sync.issues (id, login, title, body, org, repo, issue_number, state, synced_issue_number, repo_node_id, updated_at, updated_delivery) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", webhook.Issue.GetID(), webhook.Issue.User.GetLogin(), webhook.Issue.GetTitle(), webhook.Issue.GetBody(), webhook.Repository.Owner.GetLogin(), webhook.Repository.GetName(), webhook.Issue.GetNumber(), webhook.Issue.GetState(), syncedIssueNumber, webhook.Repository.GetNodeID(), watermark(webhook.Issue.GetUpdatedAt()), webhook.DeliveryID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *Manager) InsertCommentEntry(webhook *types.WebHook, syncedCommentID int64) error {
-	_, err := m.Client.Exec("INSERT INTO issue_sync.comments (id, issue_id, login, body, synced_comment_id) VALUES (?, ?, ?, ?, ?)", webhook.Comment.GetID(), webhook.Issue.GetID(), webhook.Comment.User.GetLogin(), webhook.Comment.GetBody(), syncedCommentID)
+func (m *Manager) InsertCommentEntry(ctx context.Context, webhook *types.WebHook, syncedCommentID int64) error {
+	err := m.exec(ctx, "InsertCommentEntry", "INSERT INTO issue_sync.comments (id, issue_id, login, body, synced_comment_id, updated_at, updated_delivery) VALUES (?, ?, ?, ?, ?, ?, ?)", webhook.Comment.GetID(), webhook.Issue.GetID(), webhook.Comment.User.GetLogin(), webhook.Comment.GetBody(), syncedCommentID, watermark(webhook.Comment.GetUpdatedAt()), webhook.DeliveryID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *Manager) InsertGitHubCommentEntry(webhook *types.WebHook, emuIssueId, syncedCommentID int64) error {
-	_, err := m.Client.Exec("INSERT INTO issue_sync.comments (id, issue_id, login, body, synced_comment_id) VALUES (?, ?, ?, ?, ?)", webhook.Comment.GetID(), emuIssueId, webhook.Comment.User.GetLogin(), webhook.Comment.GetBody(), syncedCommentID)
+func (m *Manager) InsertGitHubCommentEntry(ctx context.Context, webhook *types.WebHook, emuIssueId, syncedCommentID int64) error {
+	err := m.exec(ctx, "InsertGitHubCommentEntry", "INSERT INTO issue_sync.comments (id, issue_id, login, body, synced_comment_id, origin, updated_at, updated_delivery) VALUES (?, ?, ?, ?, ?, 'github', ?, ?)", webhook.Comment.GetID(), emuIssueId, webhook.Comment.User.GetLogin(), webhook.Comment.GetBody(), syncedCommentID, watermark(webhook.Comment.GetUpdatedAt()), webhook.DeliveryID)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *Manager) UpdateIssueEntry(webhook *types.WebHook) error {
-	_, err := m.Client.Exec("UPDATE issue_sync.issues SET login = ?, title = ?, body = ?, state = ? WHERE id = ?", webhook.Issue.User.GetLogin(), webhook.Issue.GetTitle(), webhook.Issue.GetBody(), webhook.Issue.GetState(), webhook.Issue.GetID())
+func (m *Manager) UpdateIssueEntry(ctx context.Context, webhook *types.WebHook) error {
+	err := m.exec(ctx, "UpdateIssueEntry", "UPDATE issue_sync.issues SET login = ?, title = ?, body = ?, state = ?, state_reason = ?, "+advanceWatermark+" WHERE id = ?", webhook.Issue.User.GetLogin(), webhook.Issue.GetTitle(), webhook.Issue.GetBody(), webhook.Issue.GetState(), webhook.StateReason, watermark(webhook.Issue.GetUpdatedAt()), webhook.DeliveryID, watermark(webhook.Issue.GetUpdatedAt()), webhook.Issue.GetID())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *Manager) UpdateCommentEntry(webhook *types.WebHook) error {
-	_, err := m.Client.Exec("UPDATE issue_sync.comments SET login = ?, body = ? WHERE id = ?", webhook.Comment.User.GetLogin(), webhook.Comment.GetBody(), webhook.Comment.GetID())
+func (m *Manager) UpdateCommentEntry(ctx context.Context, webhook *types.WebHook) error {
+	err := m.exec(ctx, "UpdateCommentEntry", "UPDATE issue_sync.comments SET login = ?, body = ?, "+advanceWatermark+" WHERE id = ?", webhook.Comment.User.GetLogin(), webhook.Comment.GetBody(), watermark(webhook.Comment.GetUpdatedAt()), webhook.DeliveryID, watermark(webhook.Comment.GetUpdatedAt()), webhook.Comment.GetID())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *Manager) DeleteIssueEntry(webhook *types.WebHook) error {
-	_, err := m.Client.Exec("DELETE FROM issue_sync.issues WHERE id = ?", webhook.Issue.GetID())
+func (m *Manager) DeleteIssueEntry(ctx context.Context, webhook *types.WebHook) error {
+	err := m.exec(ctx, "DeleteIssueEntry", "DELETE FROM issue_sync.issues WHERE id = ?", webhook.Issue.GetID())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *Manager) DeleteCommentEntry(webhook *types.WebHook) error {
-	_, err := m.Client.Exec("DELETE FROM issue_sync.comments WHERE id = ?", webhook.Comment.GetID())
+func (m *Manager) DeleteCommentEntry(ctx context.Context, webhook *types.WebHook) error {
+	err := m.exec(ctx, "DeleteCommentEntry", "DELETE FROM issue_sync.comments WHERE id = ?", webhook.Comment.GetID())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (m *Manager) GetEMUIssueIDFromGitHubCommentEntry(webhook *types.WebHook) (int64, string, string, int, error) {
-	rows, err := m.Client.Query("SELECT issue_sync.issues.id, issue_sync.issues.org, issue_sync.issues.repo, issue_sync.issues.issue_number FROM issue_sync.issues WHERE synced_issue_number = ? LIMIT 1", webhook.Issue.GetNumber())
+func (m *Manager) GetEMUIssueIDFromGitHubCommentEntry(ctx context.Context, webhook *types.WebHook) (int64, string, string, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetEMUIssueIDFromGitHubCommentEntry", "SELECT issue_sync.issues.id, COALESCE(issue_sync.repositories.org, issue_sync.issues.org), COALESCE(issue_sync.repositories.repo, issue_sync.issues.repo), issue_sync.issues.issue_number FROM issue_sync.issues LEFT JOIN issue_sync.repositories ON issue_sync.repositories.node_id = issue_sync.issues.repo_node_id WHERE synced_issue_number = ? LIMIT 1", webhook.Issue.GetNumber())
 	if err != nil {
 		return -1, "", "", -1, err
 	}
+	defer rows.Close()
+
 	var org, repo string
 	var id int64
 	var issueNumber int
@@ -100,14 +114,19 @@ func (m *Manager) GetEMUIssueIDFromGitHubCommentEntry(webhook *types.WebHook) (i
 		}
 		return id, org, repo, issueNumber, nil
 	}
-	return -1, "", "", -1, fmt.Errorf("unable to locate parent issues")
+	return -1, "", "", -1, fmt.Errorf("unable to locate parent issues: %w", ErrNotFound)
 }
 
-func (m *Manager) GetGitHubIssueIDEntry(webhook *types.WebHook) (int, error) {
-	rows, err := m.Client.Query("SELECT synced_issue_number FROM issue_sync.issues WHERE id = ? LIMIT 1", webhook.Issue.GetID())
+func (m *Manager) GetGitHubIssueIDEntry(ctx context.Context, webhook *types.WebHook) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetGitHubIssueIDEntry", "SELECT synced_issue_number FROM issue_sync.issues WHERE id = ? LIMIT 1", webhook.Issue.GetID())
 	if err != nil {
 		return -1, err
 	}
+	defer rows.Close()
+
 	var id int
 	if rows.Next() {
 		err = rows.Scan(&id)
@@ -116,14 +135,19 @@ func (m *Manager) GetGitHubIssueIDEntry(webhook *types.WebHook) (int, error) {
 		}
 		return id, nil
 	}
-	return -1, fmt.Errorf("unable to locate parent issues")
+	return -1, fmt.Errorf("unable to locate parent issues: %w", ErrNotFound)
 }
 
-func (m *Manager) GetGitHubCommentIDEntry(webhook *types.WebHook) (int, error) {
-	rows, err := m.Client.Query("SELECT synced_comment_id FROM issue_sync.comments WHERE id = ? LIMIT 1", webhook.Comment.GetID())
+func (m *Manager) GetGitHubCommentIDEntry(ctx context.Context, webhook *types.WebHook) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetGitHubCommentIDEntry", "SELECT synced_comment_id FROM issue_sync.comments WHERE id = ? LIMIT 1", webhook.Comment.GetID())
 	if err != nil {
 		return -1, err
 	}
+	defer rows.Close()
+
 	var id int
 	if rows.Next() {
 		err = rows.Scan(&id)
@@ -132,14 +156,19 @@ func (m *Manager) GetGitHubCommentIDEntry(webhook *types.WebHook) (int, error) {
 		}
 		return id, nil
 	}
-	return -1, fmt.Errorf("unable to locate comment id")
+	return -1, fmt.Errorf("unable to locate comment id: %w", ErrNotFound)
 }
 
-func (m *Manager) GetEMUCommentIDEntry(webhook *types.WebHook) (string, string, int64, error) {
-	rows, err := m.Client.Query("SELECT issue_sync.issues.org, issue_sync.issues.repo, issue_sync.comments.synced_comment_id FROM issue_sync.issues, issue_sync.comments WHERE issue_sync.issues.id = issue_sync.comments.issue_id AND issue_sync.comments.id = ? LIMIT 1", webhook.Comment.GetID())
+func (m *Manager) GetEMUCommentIDEntry(ctx context.Context, webhook *types.WebHook) (string, string, int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetEMUCommentIDEntry", "SELECT COALESCE(issue_sync.repositories.org, issue_sync.issues.org), COALESCE(issue_sync.repositories.repo, issue_sync.issues.repo), issue_sync.comments.synced_comment_id FROM issue_sync.comments JOIN issue_sync.issues ON issue_sync.issues.id = issue_sync.comments.issue_id LEFT JOIN issue_sync.repositories ON issue_sync.repositories.node_id = issue_sync.issues.repo_node_id WHERE issue_sync.comments.id = ? LIMIT 1", webhook.Comment.GetID())
 	if err != nil {
 		return "", "", -1, err
 	}
+	defer rows.Close()
+
 	var org, repo string
 	var id int64
 	if rows.Next() {
@@ -149,14 +178,19 @@ func (m *Manager) GetEMUCommentIDEntry(webhook *types.WebHook) (string, string,
 		}
 		return org, repo, id, nil
 	}
-	return "", "", -1, fmt.Errorf("unable to locate comment id")
+	return "", "", -1, fmt.Errorf("unable to locate comment id: %w", ErrNotFound)
 }
 
-func (m *Manager) GetEMUIssue(webhook *types.WebHook) (string, string, int, error) {
-	rows, err := m.Client.Query("SELECT issue_sync.issues.org, issue_sync.issues.repo, issue_sync.issues.issue_number FROM issue_sync.issues WHERE issue_sync.issues.synced_issue_number = ? LIMIT 1", webhook.Issue.GetNumber())
+func (m *Manager) GetEMUIssue(ctx context.Context, webhook *types.WebHook) (string, string, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetEMUIssue", "SELECT COALESCE(issue_sync.repositories.org, issue_sync.issues.org), COALESCE(issue_sync.repositories.repo, issue_sync.issues.repo), issue_sync.issues.issue_number FROM issue_sync.issues LEFT JOIN issue_sync.repositories ON issue_sync.repositories.node_id = issue_sync.issues.repo_node_id WHERE issue_sync.issues.synced_issue_number = ? LIMIT 1", webhook.Issue.GetNumber())
 	if err != nil {
 		return "", "", -1, err
 	}
+	defer rows.Close()
+
 	var org, repo string
 	var issueNumber int
 	if rows.Next() {
@@ -166,5 +200,31 @@ func (m *Manager) GetEMUIssue(webhook *types.WebHook) (string, string, int, erro
 		}
 		return org, repo, issueNumber, nil
 	}
-	return "", "", -1, fmt.Errorf("unable to locate org")
+	return "", "", -1, fmt.Errorf("unable to locate org: %w", ErrNotFound)
+}
+
+func (m *Manager) IssueEntryExists(ctx context.Context, id int64) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "IssueEntryExists", "SELECT 1 FROM issue_sync.issues WHERE id = ? LIMIT 1", id)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	return rows.Next(), rows.Err()
+}
+
+func (m *Manager) CommentEntryExists(ctx context.Context, id int64) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "CommentEntryExists", "SELECT 1 FROM issue_sync.comments WHERE id = ? LIMIT 1", id)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	return rows.Next(), rows.Err()
 }
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// migrations are applied in order after the base tables are created, and each is recorded in
+// issue_sync.schema_migrations so it runs exactly once. Only ever append to this list.
+var migrations = []string{
+	"ALTER TABLE issue_sync.issues ADD COLUMN kind VARCHAR(32) NOT NULL DEFAULT 'issue'",
+	"CREATE TABLE IF NOT EXISTS issue_sync.discussions (id BIGINT NOT NULL, node_id VARCHAR(255), login VARCHAR(255), title VARCHAR(255), body TEXT, org VARCHAR(255), repo VARCHAR(255), discussion_number int, kind VARCHAR(32) NOT NULL, synced_node_id VARCHAR(255), synced_number int, PRIMARY KEY (id))",
+	"CREATE TABLE IF NOT EXISTS issue_sync.discussion_comments (id BIGINT NOT NULL, discussion_id BIGINT NOT NULL, node_id VARCHAR(255), synced_id BIGINT, synced_node_id VARCHAR(255), login VARCHAR(255), body TEXT, PRIMARY KEY (id), FOREIGN KEY (discussion_id) REFERENCES issue_sync.discussions(id) ON DELETE CASCADE)",
+	"ALTER TABLE issue_sync.discussion_comments ADD INDEX (synced_id)",
+	"ALTER TABLE issue_sync.comments ADD COLUMN origin VARCHAR(16) NOT NULL DEFAULT 'emu'",
+	"ALTER TABLE issue_sync.issues ADD COLUMN reactions TEXT, ADD COLUMN synced_reactions TEXT, ADD COLUMN mirrored_reactions TEXT",
+	"ALTER TABLE issue_sync.comments ADD COLUMN reactions TEXT, ADD COLUMN synced_reactions TEXT, ADD COLUMN mirrored_reactions TEXT",
+	"CREATE TABLE IF NOT EXISTS issue_sync.attachments (source_url VARCHAR(768) NOT NULL, url TEXT NOT NULL, PRIMARY KEY (source_url))",
+	"ALTER TABLE issue_sync.issues ADD COLUMN state_reason VARCHAR(32)",
+	"ALTER TABLE issue_sync.comments ADD COLUMN minimized BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN synced_minimized BOOLEAN NOT NULL DEFAULT FALSE",
+	"CREATE TABLE IF NOT EXISTS issue_sync.repositories (node_id VARCHAR(255) NOT NULL, id BIGINT, org VARCHAR(255), repo VARCHAR(255), PRIMARY KEY (node_id))",
+	"ALTER TABLE issue_sync.issues ADD COLUMN repo_node_id VARCHAR(255), ADD INDEX issues_repo_node_id (repo_node_id)",
+	"ALTER TABLE issue_sync.discussions ADD COLUMN repo_node_id VARCHAR(255), ADD INDEX discussions_repo_node_id (repo_node_id)",
+	"CREATE TABLE IF NOT EXISTS issue_sync.installations (id BIGINT NOT NULL, app VARCHAR(16) NOT NULL, account VARCHAR(255), repository_selection VARCHAR(16), suspended BOOLEAN NOT NULL DEFAULT FALSE, PRIMARY KEY (id))",
+	"CREATE TABLE IF NOT EXISTS issue_sync.installation_repositories (installation_id BIGINT NOT NULL, repo_id BIGINT NOT NULL, full_name VARCHAR(255), PRIMARY KEY (installation_id, repo_id), FOREIGN KEY (installation_id) REFERENCES issue_sync.installations(id) ON DELETE CASCADE)",
+	"CREATE TABLE IF NOT EXISTS issue_sync.operations (id BIGINT NOT NULL AUTO_INCREMENT, kind VARCHAR(32) NOT NULL, source_id BIGINT NOT NULL, parent_id BIGINT, payload MEDIUMTEXT, state VARCHAR(16) NOT NULL, synced_id BIGINT, created_at BIGINT NOT NULL, updated_at BIGINT NOT NULL, PRIMARY KEY (id), INDEX (state, updated_at))",
+	"ALTER TABLE issue_sync.issues ADD COLUMN updated_at BIGINT",
+	"ALTER TABLE issue_sync.comments ADD COLUMN updated_at BIGINT",
+	"CREATE TABLE IF NOT EXISTS issue_sync.parked_events (id BIGINT NOT NULL AUTO_INCREMENT, endpoint VARCHAR(16) NOT NULL, event VARCHAR(64) NOT NULL, delivery_id VARCHAR(64), payload MEDIUMTEXT NOT NULL, attempts int NOT NULL DEFAULT 0, last_error TEXT, next_attempt_at BIGINT NOT NULL, created_at BIGINT NOT NULL, PRIMARY KEY (id), INDEX (next_attempt_at))",
+	"ALTER TABLE issue_sync.parked_events ADD COLUMN installation_id BIGINT, ADD INDEX (installation_id)",
+	"ALTER TABLE issue_sync.issues ADD COLUMN updated_delivery VARCHAR(64)",
+	"ALTER TABLE issue_sync.comments ADD COLUMN updated_delivery VARCHAR(64)",
+	"CREATE TABLE IF NOT EXISTS issue_sync.leases (name VARCHAR(64) NOT NULL, holder VARCHAR(255) NOT NULL, expires_at BIGINT NOT NULL, renewed_at BIGINT NOT NULL, PRIMARY KEY (name))",
+	"CREATE TABLE IF NOT EXISTS issue_sync.debounced_edits (issue_id BIGINT NOT NULL, event_key VARCHAR(255) NOT NULL, payload MEDIUMTEXT NOT NULL, updated_at BIGINT NOT NULL, revision int NOT NULL DEFAULT 0, due_at BIGINT NOT NULL, PRIMARY KEY (issue_id), INDEX (due_at))",
+	"ALTER TABLE issue_sync.parked_events ADD INDEX (delivery_id)",
+	"CREATE TABLE IF NOT EXISTS issue_sync.poll_cursors (name VARCHAR(255) NOT NULL, position BIGINT NOT NULL, seen TEXT, etag VARCHAR(255), updated_at BIGINT NOT NULL, PRIMARY KEY (name))",
+	"CREATE TABLE IF NOT EXISTS issue_sync.queue_messages (id BIGINT NOT NULL AUTO_INCREMENT, endpoint VARCHAR(16) NOT NULL, event VARCHAR(64) NOT NULL, delivery_id VARCHAR(64), payload MEDIUMTEXT NOT NULL, attempts int NOT NULL DEFAULT 0, claim VARCHAR(64), available_at BIGINT NOT NULL, created_at BIGINT NOT NULL, PRIMARY KEY (id), INDEX (available_at), INDEX (claim))",
+	"ALTER TABLE issue_sync.operations ADD COLUMN synced_node_id VARCHAR(255)",
+	"ALTER TABLE issue_sync.discussions ADD COLUMN updated_at BIGINT",
+	"ALTER TABLE issue_sync.discussions ADD COLUMN updated_delivery VARCHAR(64)",
+	"ALTER TABLE issue_sync.discussion_comments ADD COLUMN updated_at BIGINT",
+	"ALTER TABLE issue_sync.discussion_comments ADD COLUMN updated_delivery VARCHAR(64)",
+}
+
+// Errors MySQL reports for a schema change that has already been made.
+const (
+	errTableExists    = 1050
+	errDuplicateField = 1060
+	errDuplicateKey   = 1061
+)
+
+// migrate applies the migrations that have not been applied yet. Replicas starting together take
+// turns under an advisory lock, and each re-reads the applied version once it holds the lock. A
+// migration whose change is already in place, such as one interrupted before it was recorded, is
+// recorded without being applied again.
+func (m *Manager) migrate(ctx context.Context) error {
+	err := m.exec(ctx, "migrate", "CREATE TABLE IF NOT EXISTS issue_sync.schema_migrations (version int NOT NULL, PRIMARY KEY (version))")
+	if err != nil {
+		return err
+	}
+
+	unlock, err := m.Lock(ctx, "migrations")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var version int
+	rows, err := m.query(ctx, "migrate", "SELECT COALESCE(MAX(version), 0) FROM issue_sync.schema_migrations")
+	if err != nil {
+		return err
+	}
+	if rows.Next() {
+		err = rows.Scan(&version)
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		err = m.exec(ctx, "migrate", migrations[version])
+		if alreadyApplied(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		err = m.exec(ctx, "migrate", "INSERT IGNORE INTO issue_sync.schema_migrations (version) VALUES (?)", version+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alreadyApplied reports whether a migration failed because the table, column or index it adds
+// already exists.
+func alreadyApplied(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case errTableExists, errDuplicateField, errDuplicateKey:
+		return true
+	}
+	return false
+}
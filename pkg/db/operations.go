@@ -0,0 +1,180 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// Operations record each write that creates a mirror before it is sent to GitHub, so a mirror
+// created without its mapping can be found and finished later. An operation is pending until the
+// write returns, applied once the id of the mirror is known, and done once the mapping is stored.
+const (
+	OperationPending     = "pending"
+	OperationApplied     = "applied"
+	OperationDone        = "done"
+	OperationFailed      = "failed"
+	OperationCompensated = "compensated"
+)
+
+// Operation kinds name the mapping an operation stores once its write succeeds.
+const (
+	OperationIssue              = "issue"
+	OperationPullRequest        = "pull_request"
+	OperationComment            = "comment"
+	OperationPullRequestComment = "pull_request_comment"
+	OperationGitHubComment      = "github_comment"
+	// Discussions are mirrored as discussions, or as issues when discussions.convertToIssue is set.
+	OperationDiscussion              = "discussion"
+	OperationDiscussionIssue         = "discussion_issue"
+	OperationDiscussionComment       = "discussion_comment"
+	OperationGitHubDiscussionComment = "github_discussion_comment"
+)
+
+type Operation struct {
+	ID       int64
+	Kind     string
+	SourceID int64
+	// ParentID is the id of the issue or pull request a comment's mapping is stored under.
+	ParentID int64
+	Webhook  *types.WebHook
+	State    string
+	SyncedID int64
+	// SyncedNodeID is the node id of the mirror, for the discussion kinds, whose mirrors are addressed
+	// by node id.
+	SyncedNodeID string
+	CreatedAt    time.Time
+}
+
+// BeginOperation records a pending operation and sets its id. The delivery the webhook was decoded
+// from is stored when there is one, since marshalling the webhook loses the fields it decodes itself.
+func (m *Manager) BeginOperation(ctx context.Context, op *Operation) error {
+	payload := []byte(op.Webhook.Payload)
+	if len(payload) == 0 {
+		var err error
+		payload, err = json.Marshal(op.Webhook)
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	id, err := m.insert(ctx, "BeginOperation", "INSERT INTO issue_sync.operations (kind, source_id, parent_id, payload, state, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)", op.Kind, op.SourceID, op.ParentID, string(payload), OperationPending, now.Unix(), now.Unix())
+	if err != nil {
+		return err
+	}
+	op.ID, op.State, op.CreatedAt = id, OperationPending, now
+	return nil
+}
+
+// MarkOperationApplied records the mirror an operation created, along with op.SyncedNodeID when it is
+// set.
+func (m *Manager) MarkOperationApplied(ctx context.Context, op *Operation, syncedID int64) error {
+	err := m.exec(ctx, "MarkOperationApplied", "UPDATE issue_sync.operations SET state = ?, synced_id = ?, synced_node_id = ?, updated_at = ? WHERE id = ?", OperationApplied, syncedID, op.SyncedNodeID, time.Now().Unix(), op.ID)
+	if err != nil {
+		return err
+	}
+	op.State, op.SyncedID = OperationApplied, syncedID
+	return nil
+}
+
+func (m *Manager) FinishOperation(ctx context.Context, op *Operation, state string) error {
+	err := m.exec(ctx, "FinishOperation", "UPDATE issue_sync.operations SET state = ?, updated_at = ? WHERE id = ?", state, time.Now().Unix(), op.ID)
+	if err != nil {
+		return err
+	}
+	op.State = state
+	return nil
+}
+
+// ListUnfinishedOperations returns the pending and applied operations last touched before the given
+// time, oldest first.
+func (m *Manager) ListUnfinishedOperations(ctx context.Context, before time.Time) ([]*Operation, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ListUnfinishedOperations", "SELECT id, kind, source_id, COALESCE(parent_id, 0), payload, state, COALESCE(synced_id, 0), COALESCE(synced_node_id, ''), created_at FROM issue_sync.operations WHERE state IN (?, ?) AND updated_at < ? ORDER BY id", OperationPending, OperationApplied, before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ops []*Operation
+	for rows.Next() {
+		op := &Operation{}
+		var payload string
+		var createdAt int64
+		err = rows.Scan(&op.ID, &op.Kind, &op.SourceID, &op.ParentID, &payload, &op.State, &op.SyncedID, &op.SyncedNodeID, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		op.Webhook = &types.WebHook{}
+		err = json.Unmarshal([]byte(payload), op.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		op.CreatedAt = time.Unix(createdAt, 0)
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+// HasUnfinishedOperation reports whether a mirror of the given source is being created, so its mapping
+// is still to come.
+func (m *Manager) HasUnfinishedOperation(ctx context.Context, sourceID int64) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "HasUnfinishedOperation", "SELECT 1 FROM issue_sync.operations WHERE source_id = ? AND state IN (?, ?) LIMIT 1", sourceID, OperationPending, OperationApplied)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// DeleteFinishedOperations removes done, failed and compensated operations last touched before the
+// given time.
+func (m *Manager) DeleteFinishedOperations(ctx context.Context, before time.Time) error {
+	err := m.exec(ctx, "DeleteFinishedOperations", "DELETE FROM issue_sync.operations WHERE state IN (?, ?, ?) AND updated_at < ?", OperationDone, OperationFailed, OperationCompensated, before.Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetOperationMapping returns the id of the mirror recorded for an operation's source, and whether a
+// mapping has been recorded at all. Issue, pull request and discussion mirrors are identified by
+// number.
+func (m *Manager) GetOperationMapping(ctx context.Context, op *Operation) (int64, bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var query string
+	switch op.Kind {
+	case OperationIssue, OperationPullRequest:
+		query = "SELECT synced_issue_number FROM issue_sync.issues WHERE id = ? LIMIT 1"
+	case OperationDiscussion, OperationDiscussionIssue:
+		query = "SELECT synced_number FROM issue_sync.discussions WHERE id = ? LIMIT 1"
+	case OperationDiscussionComment, OperationGitHubDiscussionComment:
+		query = "SELECT synced_id FROM issue_sync.discussion_comments WHERE id = ? LIMIT 1"
+	default:
+		query = "SELECT synced_comment_id FROM issue_sync.comments WHERE id = ? LIMIT 1"
+	}
+	rows, err := m.query(ctx, "GetOperationMapping", query, op.SourceID)
+	if err != nil {
+		return -1, false, err
+	}
+	defer rows.Close()
+
+	var id int64
+	if rows.Next() {
+		err = rows.Scan(&id)
+		if err != nil {
+			return -1, false, err
+		}
+		return id, true, nil
+	}
+	return -1, false, rows.Err()
+}
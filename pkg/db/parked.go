@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// suspendedAttemptAt is the next attempt of events parked for a suspended installation, which are
+// only retried once ResumeParkedEvents is called.
+const suspendedAttemptAt = math.MaxInt64
+
+// ParkedEvent is a webhook delivery that arrived before the mapping it depends on existed, held for
+// a later retry.
+type ParkedEvent struct {
+	ID         int64
+	Endpoint   string
+	Event      string
+	DeliveryID string
+	Payload    []byte
+	Attempts   int
+}
+
+func (m *Manager) ParkEvent(ctx context.Context, endpoint, event, deliveryID string, payload []byte, reason string, next time.Time) error {
+	err := m.exec(ctx, "ParkEvent", "INSERT INTO issue_sync.parked_events (endpoint, event, delivery_id, payload, last_error, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)", endpoint, event, deliveryID, string(payload), reason, next.Unix(), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ParkSuspendedEvent holds a delivery that would have acted through a suspended installation until
+// the installation is unsuspended.
+func (m *Manager) ParkSuspendedEvent(ctx context.Context, endpoint, event, deliveryID string, payload []byte, reason string, installationID int64) error {
+	err := m.exec(ctx, "ParkSuspendedEvent", "INSERT INTO issue_sync.parked_events (endpoint, event, delivery_id, payload, last_error, installation_id, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", endpoint, event, deliveryID, string(payload), reason, installationID, int64(suspendedAttemptAt), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SuspendParkedEvent holds a parked event that failed because its installation is suspended until the
+// installation is unsuspended. The attempt is not counted.
+func (m *Manager) SuspendParkedEvent(ctx context.Context, event *ParkedEvent, reason string, installationID int64) error {
+	err := m.exec(ctx, "SuspendParkedEvent", "UPDATE issue_sync.parked_events SET last_error = ?, installation_id = ?, next_attempt_at = ? WHERE id = ?", reason, installationID, int64(suspendedAttemptAt), event.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResumeParkedEvents makes the events parked for a suspended installation due at now, and returns how
+// many there were.
+func (m *Manager) ResumeParkedEvents(ctx context.Context, installationID int64, now time.Time) (int64, error) {
+	return m.update(ctx, "ResumeParkedEvents", "UPDATE issue_sync.parked_events SET installation_id = NULL, next_attempt_at = ? WHERE installation_id = ?", now.Unix(), installationID)
+}
+
+// DeleteSuspendedParkedEvents drops the events parked for an installation that was removed.
+func (m *Manager) DeleteSuspendedParkedEvents(ctx context.Context, installationID int64) error {
+	err := m.exec(ctx, "DeleteSuspendedParkedEvents", "DELETE FROM issue_sync.parked_events WHERE installation_id = ?", installationID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListDueParkedEvents returns up to limit parked events due for a retry at now, oldest first.
+func (m *Manager) ListDueParkedEvents(ctx context.Context, now time.Time, limit int) ([]*ParkedEvent, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ListDueParkedEvents", "SELECT id, endpoint, event, COALESCE(delivery_id, ''), payload, attempts FROM issue_sync.parked_events WHERE next_attempt_at <= ? ORDER BY id LIMIT ?", now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*ParkedEvent
+	for rows.Next() {
+		event := &ParkedEvent{}
+		var payload string
+		err = rows.Scan(&event.ID, &event.Endpoint, &event.Event, &event.DeliveryID, &payload, &event.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		event.Payload = []byte(payload)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (m *Manager) RescheduleParkedEvent(ctx context.Context, event *ParkedEvent, reason string, next time.Time) error {
+	err := m.exec(ctx, "RescheduleParkedEvent", "UPDATE issue_sync.parked_events SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?", reason, next.Unix(), event.ID)
+	if err != nil {
+		return err
+	}
+	event.Attempts++
+	return nil
+}
+
+func (m *Manager) DeleteParkedEvent(ctx context.Context, event *ParkedEvent) error {
+	err := m.exec(ctx, "DeleteParkedEvent", "DELETE FROM issue_sync.parked_events WHERE id = ?", event.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteParkedDelivery removes the parked copies of a delivery that has since been handled.
+func (m *Manager) DeleteParkedDelivery(ctx context.Context, deliveryID string) error {
+	err := m.exec(ctx, "DeleteParkedDelivery", "DELETE FROM issue_sync.parked_events WHERE delivery_id = ?", deliveryID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// Pull requests are tracked in issue_sync.issues with kind 'pull_request', keyed by the pull request
+// id, so comments on them share issue_sync.comments with ordinary issues.
+
+func (m *Manager) InsertPullRequestEntry(ctx context.Context, webhook *types.WebHook, syncedIssueNumber int) error {
+	pr := webhook.PullRequest
+	err := m.UpsertRepositoryEntry(ctx, webhook.Repository)
+	if err != nil {
+		return err
+	}
+	err = m.exec(ctx, "InsertPullRequestEntry", "INSERT INTO issue_sync.issues (id, login, title, body, org, repo, issue_number, state, synced_issue_number, kind, repo_node_id, updated_at, updated_delivery) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'pull_request', ?, ?, ?)", pr.GetID(), pr.User.GetLogin(), pr.GetTitle(), pr.GetBody(), webhook.Repository.Owner.GetLogin(), webhook.Repository.GetName(), pr.GetNumber(), pr.GetState(), syncedIssueNumber, webhook.Repository.GetNodeID(), watermark(pr.GetUpdatedAt()), webhook.DeliveryID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) UpdatePullRequestEntry(ctx context.Context, webhook *types.WebHook) error {
+	pr := webhook.PullRequest
+	err := m.exec(ctx, "UpdatePullRequestEntry", "UPDATE issue_sync.issues SET login = ?, title = ?, body = ?, state = ?, "+advanceWatermark+" WHERE id = ?", pr.User.GetLogin(), pr.GetTitle(), pr.GetBody(), pr.GetState(), watermark(pr.GetUpdatedAt()), webhook.DeliveryID, watermark(pr.GetUpdatedAt()), pr.GetID())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) InsertPullRequestCommentEntry(ctx context.Context, webhook *types.WebHook, pullRequestID, syncedCommentID int64) error {
+	err := m.exec(ctx, "InsertPullRequestCommentEntry", "INSERT INTO issue_sync.comments (id, issue_id, login, body, synced_comment_id, updated_at, updated_delivery) VALUES (?, ?, ?, ?, ?, ?, ?)", webhook.Comment.GetID(), pullRequestID, webhook.Comment.User.GetLogin(), webhook.Comment.GetBody(), syncedCommentID, watermark(webhook.Comment.GetUpdatedAt()), webhook.DeliveryID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) GetGitHubIssueIDForPullRequestEntry(ctx context.Context, webhook *types.WebHook) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetGitHubIssueIDForPullRequestEntry", "SELECT synced_issue_number FROM issue_sync.issues WHERE id = ? LIMIT 1", webhook.PullRequest.GetID())
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+
+	var id int
+	if rows.Next() {
+		err = rows.Scan(&id)
+		if err != nil {
+			return -1, err
+		}
+		return id, nil
+	}
+	return -1, fmt.Errorf("unable to locate tracking issue: %w", ErrNotFound)
+}
+
+// GetPullRequestEntry looks a pull request up by its coordinates, for events such as issue_comment
+// that only carry the pull request's issue representation.
+func (m *Manager) GetPullRequestEntry(ctx context.Context, webhook *types.WebHook) (int64, int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetPullRequestEntry", "SELECT id, synced_issue_number FROM issue_sync.issues WHERE kind = 'pull_request' AND (repo_node_id = ? OR (repo_node_id IS NULL AND org = ? AND repo = ?)) AND issue_number = ? LIMIT 1", webhook.Repository.GetNodeID(), webhook.Repository.Owner.GetLogin(), webhook.Repository.GetName(), webhook.Issue.GetNumber())
+	if err != nil {
+		return -1, -1, err
+	}
+	defer rows.Close()
+
+	var id int64
+	var syncedIssueNumber int
+	if rows.Next() {
+		err = rows.Scan(&id, &syncedIssueNumber)
+		if err != nil {
+			return -1, -1, err
+		}
+		return id, syncedIssueNumber, nil
+	}
+	return -1, -1, fmt.Errorf("unable to locate tracking issue: %w", ErrNotFound)
+}
+
+// GetSyncedCommentID returns the mirrored id of a comment given its source id.
+func (m *Manager) GetSyncedCommentID(ctx context.Context, id int64) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetSyncedCommentID", "SELECT synced_comment_id FROM issue_sync.comments WHERE id = ? LIMIT 1", id)
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+
+	var syncedID int64
+	if rows.Next() {
+		err = rows.Scan(&syncedID)
+		if err != nil {
+			return -1, err
+		}
+		return syncedID, nil
+	}
+	return -1, fmt.Errorf("unable to locate comment id: %w", ErrNotFound)
+}
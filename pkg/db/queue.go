@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// QueuedMessage is a webhook delivery waiting in the SQL queue to be handled by a worker.
+type QueuedMessage struct {
+	ID         int64
+	Endpoint   string
+	Event      string
+	DeliveryID string
+	Payload    []byte
+	Attempts   int
+}
+
+func (m *Manager) EnqueueMessage(ctx context.Context, message *QueuedMessage) error {
+	now := time.Now().Unix()
+	err := m.exec(ctx, "EnqueueMessage", "INSERT INTO issue_sync.queue_messages (endpoint, event, delivery_id, payload, available_at, created_at) VALUES (?, ?, ?, ?, ?, ?)", message.Endpoint, message.Event, message.DeliveryID, string(message.Payload), now, now)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClaimMessages claims up to limit available messages, oldest first, under claim. Claimed messages are
+// hidden from other workers for the visibility timeout, after which they are claimed again unless they
+// have been deleted or released.
+func (m *Manager) ClaimMessages(ctx context.Context, claim string, visibility time.Duration, limit int) ([]*QueuedMessage, error) {
+	now := time.Now()
+	_, err := m.update(ctx, "ClaimMessages", "UPDATE issue_sync.queue_messages SET claim = ?, available_at = ? WHERE available_at <= ? ORDER BY id LIMIT ?", claim, now.Add(visibility).Unix(), now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ClaimMessages", "SELECT id, endpoint, event, COALESCE(delivery_id, ''), payload, attempts FROM issue_sync.queue_messages WHERE claim = ? ORDER BY id", claim)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*QueuedMessage
+	for rows.Next() {
+		message := &QueuedMessage{}
+		var payload string
+		err = rows.Scan(&message.ID, &message.Endpoint, &message.Event, &message.DeliveryID, &payload, &message.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		message.Payload = []byte(payload)
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// DeleteMessage removes a handled message from the queue.
+func (m *Manager) DeleteMessage(ctx context.Context, message *QueuedMessage) error {
+	err := m.exec(ctx, "DeleteMessage", "DELETE FROM issue_sync.queue_messages WHERE id = ?", message.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReleaseMessage returns a message that could not be handled to the queue, to be claimed again once
+// delay has passed.
+func (m *Manager) ReleaseMessage(ctx context.Context, message *QueuedMessage, delay time.Duration) error {
+	err := m.exec(ctx, "ReleaseMessage", "UPDATE issue_sync.queue_messages SET claim = NULL, attempts = attempts + 1, available_at = ? WHERE id = ?", time.Now().Add(delay).Unix(), message.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lindluni/github-issue-sync/pkg/reactions"
+)
+
+// Reactions are stored as JSON alongside each mapping: the user reaction counts on the source item,
+// the user reaction counts on its mirror, and the ids of the reactions the service added to the
+// source item to reflect the mirror's reactions.
+
+type IssueEntry struct {
+	ID                int64
+	Org               string
+	Repo              string
+	IssueNumber       int
+	SyncedIssueNumber int
+
+	Reactions         reactions.Counts
+	SyncedReactions   reactions.Counts
+	MirroredReactions reactions.IDs
+}
+
+type CommentEntry struct {
+	ID              int64
+	IssueID         int64
+	SyncedCommentID int64
+	Origin          string
+
+	Reactions         reactions.Counts
+	SyncedReactions   reactions.Counts
+	MirroredReactions reactions.IDs
+
+	Minimized       bool
+	SyncedMinimized bool
+}
+
+// ListOpenIssueEntries returns the mappings of open issues, which are the ones whose reactions are
+// kept in sync.
+func (m *Manager) ListOpenIssueEntries(ctx context.Context) ([]*IssueEntry, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ListOpenIssueEntries", "SELECT issue_sync.issues.id, COALESCE(issue_sync.repositories.org, issue_sync.issues.org), COALESCE(issue_sync.repositories.repo, issue_sync.issues.repo), issue_number, synced_issue_number, reactions, synced_reactions, mirrored_reactions FROM issue_sync.issues LEFT JOIN issue_sync.repositories ON issue_sync.repositories.node_id = issue_sync.issues.repo_node_id WHERE kind = 'issue' AND state = 'open'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*IssueEntry
+	for rows.Next() {
+		entry := &IssueEntry{}
+		var counts, syncedCounts, ids sql.NullString
+		err = rows.Scan(&entry.ID, &entry.Org, &entry.Repo, &entry.IssueNumber, &entry.SyncedIssueNumber, &counts, &syncedCounts, &ids)
+		if err != nil {
+			return nil, err
+		}
+		entry.Reactions, entry.SyncedReactions, entry.MirroredReactions = decodeReactions(counts, syncedCounts, ids)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (m *Manager) ListCommentEntries(ctx context.Context, issueID int64) ([]*CommentEntry, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ListCommentEntries", "SELECT id, issue_id, synced_comment_id, origin, reactions, synced_reactions, mirrored_reactions, minimized, synced_minimized FROM issue_sync.comments WHERE issue_id = ?", issueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*CommentEntry
+	for rows.Next() {
+		entry := &CommentEntry{}
+		var counts, syncedCounts, ids sql.NullString
+		err = rows.Scan(&entry.ID, &entry.IssueID, &entry.SyncedCommentID, &entry.Origin, &counts, &syncedCounts, &ids, &entry.Minimized, &entry.SyncedMinimized)
+		if err != nil {
+			return nil, err
+		}
+		entry.Reactions, entry.SyncedReactions, entry.MirroredReactions = decodeReactions(counts, syncedCounts, ids)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (m *Manager) UpdateIssueReactions(ctx context.Context, entry *IssueEntry) error {
+	counts, syncedCounts, ids := encodeReactions(entry.Reactions, entry.SyncedReactions, entry.MirroredReactions)
+	err := m.exec(ctx, "UpdateIssueReactions", "UPDATE issue_sync.issues SET reactions = ?, synced_reactions = ?, mirrored_reactions = ? WHERE id = ?", counts, syncedCounts, ids, entry.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) UpdateCommentReactions(ctx context.Context, entry *CommentEntry) error {
+	counts, syncedCounts, ids := encodeReactions(entry.Reactions, entry.SyncedReactions, entry.MirroredReactions)
+	err := m.exec(ctx, "UpdateCommentReactions", "UPDATE issue_sync.comments SET reactions = ?, synced_reactions = ?, mirrored_reactions = ? WHERE id = ?", counts, syncedCounts, ids, entry.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetIssueReactions returns the stored user reaction counts of a source issue.
+func (m *Manager) GetIssueReactions(ctx context.Context, id int64) (reactions.Counts, error) {
+	return m.getReactions(ctx, "GetIssueReactions", "SELECT reactions FROM issue_sync.issues WHERE id = ? LIMIT 1", id)
+}
+
+// GetCommentReactions returns the stored user reaction counts of a source comment.
+func (m *Manager) GetCommentReactions(ctx context.Context, id int64) (reactions.Counts, error) {
+	return m.getReactions(ctx, "GetCommentReactions", "SELECT reactions FROM issue_sync.comments WHERE id = ? LIMIT 1", id)
+}
+
+func (m *Manager) getReactions(ctx context.Context, name, query string, id int64) (reactions.Counts, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, name, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := reactions.Counts{}
+	if rows.Next() {
+		var raw sql.NullString
+		err = rows.Scan(&raw)
+		if err != nil {
+			return nil, err
+		}
+		if raw.Valid {
+			_ = json.Unmarshal([]byte(raw.String), &counts)
+		}
+	}
+	return counts, rows.Err()
+}
+
+func decodeReactions(counts, syncedCounts, ids sql.NullString) (reactions.Counts, reactions.Counts, reactions.IDs) {
+	decodedCounts, decodedSyncedCounts, decodedIDs := reactions.Counts{}, reactions.Counts{}, reactions.IDs{}
+	if counts.Valid {
+		_ = json.Unmarshal([]byte(counts.String), &decodedCounts)
+	}
+	if syncedCounts.Valid {
+		_ = json.Unmarshal([]byte(syncedCounts.String), &decodedSyncedCounts)
+	}
+	if ids.Valid {
+		_ = json.Unmarshal([]byte(ids.String), &decodedIDs)
+	}
+	return decodedCounts, decodedSyncedCounts, decodedIDs
+}
+
+func encodeReactions(counts, syncedCounts reactions.Counts, ids reactions.IDs) (string, string, string) {
+	encodedCounts, _ := json.Marshal(counts)
+	encodedSyncedCounts, _ := json.Marshal(syncedCounts)
+	encodedIDs, _ := json.Marshal(ids)
+	return string(encodedCounts), string(encodedSyncedCounts), string(encodedIDs)
+}
+
+func (m *Manager) UpdateCommentMinimized(ctx context.Context, entry *CommentEntry) error {
+	err := m.exec(ctx, "UpdateCommentMinimized", "UPDATE issue_sync.comments SET minimized = ?, synced_minimized = ? WHERE id = ?", entry.Minimized, entry.SyncedMinimized, entry.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"context"
+)
+
+// GetSyncedNumber returns the number of the GitHub issue or discussion mirroring an EMU issue, pull
+// request or discussion, and whether it is mirrored.
+func (m *Manager) GetSyncedNumber(ctx context.Context, org, repo string, number int) (int, bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetSyncedNumber", "SELECT synced_issue_number FROM issue_sync.issues WHERE "+byRepository+" AND issue_number = ? UNION ALL SELECT synced_number FROM issue_sync.discussions WHERE "+byRepository+" AND discussion_number = ? LIMIT 1", org, repo, org, repo, number, org, repo, org, repo, number)
+	if err != nil {
+		return -1, false, err
+	}
+	defer rows.Close()
+
+	var syncedNumber int
+	if rows.Next() {
+		err = rows.Scan(&syncedNumber)
+		if err != nil {
+			return -1, false, err
+		}
+		return syncedNumber, true, nil
+	}
+	return -1, false, rows.Err()
+}
+
+// GetSourceNumber returns the EMU coordinates of the item mirrored as the given GitHub issue or
+// discussion number, and whether there is one.
+func (m *Manager) GetSourceNumber(ctx context.Context, syncedNumber int) (string, string, int, bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "GetSourceNumber", "SELECT COALESCE(issue_sync.repositories.org, issue_sync.issues.org), COALESCE(issue_sync.repositories.repo, issue_sync.issues.repo), issue_number FROM issue_sync.issues LEFT JOIN issue_sync.repositories ON issue_sync.repositories.node_id = issue_sync.issues.repo_node_id WHERE synced_issue_number = ? UNION ALL SELECT COALESCE(issue_sync.repositories.org, issue_sync.discussions.org), COALESCE(issue_sync.repositories.repo, issue_sync.discussions.repo), discussion_number FROM issue_sync.discussions LEFT JOIN issue_sync.repositories ON issue_sync.repositories.node_id = issue_sync.discussions.repo_node_id WHERE synced_number = ? LIMIT 1", syncedNumber, syncedNumber)
+	if err != nil {
+		return "", "", -1, false, err
+	}
+	defer rows.Close()
+
+	var org, repo string
+	var number int
+	if rows.Next() {
+		err = rows.Scan(&org, &repo, &number)
+		if err != nil {
+			return "", "", -1, false, err
+		}
+		return org, repo, number, true, nil
+	}
+	return "", "", -1, false, rows.Err()
+}
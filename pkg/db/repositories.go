@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/v41/github"
+)
+
+// EMU repositories are identified by their node ID, which survives renames and transfers. Mappings
+// record the node ID of their repository alongside the org and repo they were created under, and are
+// looked up by node ID, resolving the current org and repo through issue_sync.repositories. Mappings
+// created before node IDs were recorded are matched by their org and repo until BackfillRepository
+// assigns them one.
+
+// byRepository matches the mappings of the repository currently named org/repo. It takes the org and
+// repo twice.
+const byRepository = "(repo_node_id IN (SELECT node_id FROM issue_sync.repositories WHERE org = ? AND repo = ?) OR (repo_node_id IS NULL AND org = ? AND repo = ?))"
+
+func (m *Manager) UpsertRepositoryEntry(ctx context.Context, repository *github.Repository) error {
+	if repository.GetNodeID() == "" {
+		return nil
+	}
+	err := m.exec(ctx, "UpsertRepositoryEntry", "INSERT INTO issue_sync.repositories (node_id, id, org, repo) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = VALUES(id), org = VALUES(org), repo = VALUES(repo)", repository.GetNodeID(), repository.GetID(), repository.Owner.GetLogin(), repository.GetName())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RenameRepository moves the mappings of a repository that was renamed or transferred from
+// oldOrg/oldRepo to its current coordinates.
+func (m *Manager) RenameRepository(ctx context.Context, repository *github.Repository, oldOrg, oldRepo string) error {
+	err := m.UpsertRepositoryEntry(ctx, repository)
+	if err != nil {
+		return err
+	}
+	org, repo, nodeID := repository.Owner.GetLogin(), repository.GetName(), repository.GetNodeID()
+	for _, table := range []string{"issues", "discussions"} {
+		err = m.exec(ctx, "RenameRepository", "UPDATE issue_sync."+table+" SET org = ?, repo = ?, repo_node_id = ? WHERE repo_node_id = ? OR (repo_node_id IS NULL AND org = ? AND repo = ?)", org, repo, nodeID, nodeID, oldOrg, oldRepo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameOrganization moves the mappings of every repository in a renamed organization.
+func (m *Manager) RenameOrganization(ctx context.Context, oldOrg, org string) error {
+	for _, table := range []string{"repositories", "issues", "discussions"} {
+		err := m.exec(ctx, "RenameOrganization", "UPDATE issue_sync."+table+" SET org = ? WHERE org = ?", org, oldOrg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListUnresolvedRepositories returns the org and repo of every repository with mappings that do not
+// record its node ID.
+func (m *Manager) ListUnresolvedRepositories(ctx context.Context) ([][2]string, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, "ListUnresolvedRepositories", "SELECT org, repo FROM issue_sync.issues WHERE repo_node_id IS NULL UNION SELECT org, repo FROM issue_sync.discussions WHERE repo_node_id IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var repositories [][2]string
+	for rows.Next() {
+		var org, repo string
+		err = rows.Scan(&org, &repo)
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, [2]string{org, repo})
+	}
+	return repositories, rows.Err()
+}
+
+// BackfillRepository assigns the node ID of repository to the mappings created under org/repo before
+// node IDs were recorded.
+func (m *Manager) BackfillRepository(ctx context.Context, repository *github.Repository, org, repo string) error {
+	if repository.GetNodeID() == "" {
+		return fmt.Errorf("repository %s/%s has no node ID", org, repo)
+	}
+	err := m.UpsertRepositoryEntry(ctx, repository)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"issues", "discussions"} {
+		err = m.exec(ctx, "BackfillRepository", "UPDATE issue_sync."+table+" SET repo_node_id = ? WHERE repo_node_id IS NULL AND org = ? AND repo = ?", repository.GetNodeID(), org, repo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/go-github/v41/github"
+)
+
+// TransferIssueEntry re-keys the mapping of an issue transferred to another repository, which gives
+// it a new id and number. Its comments keep their ids and move with it.
+func (m *Manager) TransferIssueEntry(ctx context.Context, oldID int64, issue *github.Issue, repository *github.Repository) error {
+	err := m.UpsertRepositoryEntry(ctx, repository)
+	if err != nil {
+		return err
+	}
+	return m.transact(ctx, "TransferIssueEntry", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO issue_sync.issues (id, login, title, body, org, repo, issue_number, state, synced_issue_number, kind, reactions, synced_reactions, mirrored_reactions, state_reason, repo_node_id) SELECT ?, login, title, body, ?, ?, ?, state, synced_issue_number, kind, reactions, synced_reactions, mirrored_reactions, state_reason, ? FROM issue_sync.issues WHERE id = ?", issue.GetID(), repository.Owner.GetLogin(), repository.GetName(), issue.GetNumber(), repository.GetNodeID(), oldID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE issue_sync.comments SET issue_id = ? WHERE issue_id = ?", issue.GetID(), oldID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM issue_sync.issues WHERE id = ?", oldID)
+		return err
+	})
+}
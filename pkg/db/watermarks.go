@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when a lookup finds no mapping, which for a webhook usually means the event
+// it depends on has not been handled yet.
+var ErrNotFound = errors.New("not found")
+
+// Watermarks record the updated_at of the latest event applied to each issue, pull request,
+// discussion and comment, along with the delivery it arrived with. GitHub does not guarantee delivery order, so an
+// event older than the watermark would revert a newer change and is ignored instead. updated_at only
+// has second precision, so an event from the same second is only ignored when it is a redelivery of
+// the event that set the watermark; events from different deliveries in the same second cannot be
+// ordered and are applied.
+
+// IsStaleIssueEvent reports whether an event for an issue or pull request last updated at updatedAt
+// is older than one already applied, or is a redelivery of it.
+func (m *Manager) IsStaleIssueEvent(ctx context.Context, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	return m.isStale(ctx, "IsStaleIssueEvent", "SELECT COALESCE(updated_at, 0), COALESCE(updated_delivery, '') FROM issue_sync.issues WHERE id = ? LIMIT 1", id, updatedAt, deliveryID)
+}
+
+// IsStaleCommentEvent reports whether an event for a comment last updated at updatedAt is older than
+// one already applied, or is a redelivery of it.
+func (m *Manager) IsStaleCommentEvent(ctx context.Context, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	return m.isStale(ctx, "IsStaleCommentEvent", "SELECT COALESCE(updated_at, 0), COALESCE(updated_delivery, '') FROM issue_sync.comments WHERE id = ? LIMIT 1", id, updatedAt, deliveryID)
+}
+
+// IsStaleDiscussionEvent reports whether an event for a discussion last updated at updatedAt is older
+// than one already applied, or is a redelivery of it.
+func (m *Manager) IsStaleDiscussionEvent(ctx context.Context, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	return m.isStale(ctx, "IsStaleDiscussionEvent", "SELECT COALESCE(updated_at, 0), COALESCE(updated_delivery, '') FROM issue_sync.discussions WHERE id = ? LIMIT 1", id, updatedAt, deliveryID)
+}
+
+// IsStaleDiscussionCommentEvent reports whether an event for a discussion comment last updated at
+// updatedAt is older than one already applied, or is a redelivery of it.
+func (m *Manager) IsStaleDiscussionCommentEvent(ctx context.Context, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	return m.isStale(ctx, "IsStaleDiscussionCommentEvent", "SELECT COALESCE(updated_at, 0), COALESCE(updated_delivery, '') FROM issue_sync.discussion_comments WHERE id = ? LIMIT 1", id, updatedAt, deliveryID)
+}
+
+// AdvanceIssueWatermark records an event applied to an issue on its behalf, such as a change made to
+// its mirror, without touching the rest of its mapping.
+func (m *Manager) AdvanceIssueWatermark(ctx context.Context, id int64, updatedAt time.Time, deliveryID string) error {
+	err := m.exec(ctx, "AdvanceIssueWatermark", "UPDATE issue_sync.issues SET "+advanceWatermark+" WHERE id = ?", watermark(updatedAt), deliveryID, watermark(updatedAt), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// advanceWatermark moves a watermark forward to an applied event. It takes the event's watermark, its
+// delivery id and its watermark again. MySQL assigns from left to right, so the delivery is compared
+// with the watermark before it moves.
+const advanceWatermark = "updated_delivery = IF(? >= COALESCE(updated_at, 0), ?, updated_delivery), updated_at = GREATEST(COALESCE(updated_at, 0), ?)"
+
+func (m *Manager) isStale(ctx context.Context, name, query string, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	if updatedAt.IsZero() {
+		return false, nil
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := m.query(ctx, name, query, id)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var applied int64
+	var appliedDelivery string
+	if rows.Next() {
+		err = rows.Scan(&applied, &appliedDelivery)
+		if err != nil {
+			return false, err
+		}
+	}
+	current := watermark(updatedAt)
+	redelivered := current == applied && deliveryID != "" && deliveryID == appliedDelivery
+	return current < applied || redelivered, rows.Err()
+}
+
+// watermark converts an updated_at timestamp to the stored form, with zero for a missing timestamp.
+func watermark(updatedAt time.Time) int64 {
+	if updatedAt.IsZero() {
+		return 0
+	}
+	return updatedAt.Unix()
+}
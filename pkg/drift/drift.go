@@ -0,0 +1,121 @@
+package drift
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Finding kinds.
+const (
+	// SourceMissing is a mapped item whose source can no longer be read.
+	SourceMissing = "source-missing"
+	// MirrorMissing is a mapped item whose mirror can no longer be read.
+	MirrorMissing = "mirror-missing"
+	// MarkerMismatch is a mirror whose marker names a different source than its mapping.
+	MarkerMismatch = "marker-mismatch"
+	// Title, Body and State are a live value that disagrees with the stored one.
+	Title = "title"
+	Body  = "body"
+	State = "state"
+	// Orphan is a mirror in the GitHub repository with no mapping.
+	Orphan = "orphan"
+)
+
+// Report formats.
+const (
+	FormatJSON     = "json"
+	FormatMarkdown = "markdown"
+)
+
+// Finding is a single disagreement between the database and GitHub.
+type Finding struct {
+	Kind string `json:"kind"`
+	// Item is issue, pull_request or comment.
+	Item string `json:"item"`
+	// Side is the side the live value was read from: emu or github.
+	Side   string `json:"side"`
+	Org    string `json:"org"`
+	Repo   string `json:"repo"`
+	Number int    `json:"number"`
+	// CommentID is set for comment findings.
+	CommentID    int64  `json:"comment_id,omitempty"`
+	SyncedNumber int    `json:"synced_number,omitempty"`
+	Stored       string `json:"stored,omitempty"`
+	Live         string `json:"live,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Report is the result of a drift scan.
+type Report struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Issues      int       `json:"issues"`
+	Comments    int       `json:"comments"`
+	Mirrors     int       `json:"mirrors"`
+	Findings    []Finding `json:"findings"`
+}
+
+func (r *Report) Add(finding Finding) {
+	r.Findings = append(r.Findings, finding)
+}
+
+// Render encodes the report in the given format.
+func (r *Report) Render(format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.MarshalIndent(r, "", "  ")
+	case FormatMarkdown:
+		return []byte(r.Markdown()), nil
+	default:
+		return nil, fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// ContentType returns the media type of a report format.
+func ContentType(format string) string {
+	if format == FormatMarkdown {
+		return "text/markdown; charset=utf-8"
+	}
+	return "application/json; charset=utf-8"
+}
+
+// Markdown renders the report as a summary followed by a table of findings.
+func (r *Report) Markdown() string {
+	var builder strings.Builder
+	builder.WriteString("# Drift report\n\n")
+	fmt.Fprintf(&builder, "Generated at %s.\n\n", r.GeneratedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&builder, "Scanned %d issues, %d comments and %d mirrors; found %d disagreements.\n", r.Issues, r.Comments, r.Mirrors, len(r.Findings))
+	if len(r.Findings) == 0 {
+		return builder.String()
+	}
+
+	builder.WriteString("\n| Kind | Item | Side | Source | Mirror | Stored | Live |\n")
+	builder.WriteString("| --- | --- | --- | --- | --- | --- | --- |\n")
+	for _, finding := range r.Findings {
+		source := fmt.Sprintf("%s/%s#%d", finding.Org, finding.Repo, finding.Number)
+		if finding.CommentID != 0 {
+			source += fmt.Sprintf(" comment %d", finding.CommentID)
+		}
+		mirror := ""
+		if finding.SyncedNumber != 0 {
+			mirror = fmt.Sprintf("#%d", finding.SyncedNumber)
+		}
+		live := finding.Live
+		if finding.Error != "" {
+			live = finding.Error
+		}
+		fmt.Fprintf(&builder, "| %s | %s | %s | %s | %s | %s | %s |\n", finding.Kind, finding.Item, finding.Side, source, mirror, cell(finding.Stored), cell(live))
+	}
+	return builder.String()
+}
+
+// cell shortens a value and escapes it for use in a table cell.
+func cell(value string) string {
+	const limit = 80
+	value = strings.Join(strings.Fields(value), " ")
+	if runes := []rune(value); len(runes) > limit {
+		value = string(runes[:limit]) + "…"
+	}
+	return strings.ReplaceAll(value, "|", "\\|")
+}
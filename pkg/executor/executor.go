@@ -0,0 +1,150 @@
+package executor
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Locker takes a lock on a key that is shared with other replicas, returning a function that
+// releases it.
+type Locker interface {
+	Lock(ctx context.Context, key string) (func() error, error)
+}
+
+// Executor runs functions one at a time per key, in the order they were submitted, while functions
+// for different keys run in parallel up to a limit on the number of workers. When Locker is set, each
+// function also holds its key's lock, so that replicas do not process the same key at once; order
+// across replicas is not guaranteed.
+type Executor struct {
+	Locker Locker
+	Logger *logrus.Logger
+
+	workers chan struct{}
+	mutex   sync.Mutex
+	queues  map[string][]chan struct{}
+}
+
+// New returns an executor that runs at most workers functions at once.
+func New(workers int, locker Locker, logger *logrus.Logger) *Executor {
+	return &Executor{
+		Locker:  locker,
+		Logger:  logger,
+		workers: make(chan struct{}, workers),
+		queues:  map[string][]chan struct{}{},
+	}
+}
+
+// Do runs fn once every function submitted earlier for the same key has returned and a worker is
+// free. Functions with an empty key are only limited by the number of workers.
+func (e *Executor) Do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	return e.run(ctx, key, e.enqueue(key), fn)
+}
+
+// Go is Do in the background: fn takes its place behind the functions submitted earlier for key
+// before Go returns, so functions submitted one after another keep their order. The error fn returns
+// is sent on the returned channel.
+func (e *Executor) Go(ctx context.Context, key string, fn func(ctx context.Context) error) <-chan error {
+	ready := e.enqueue(key)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.run(ctx, key, ready, fn)
+	}()
+	return done
+}
+
+func (e *Executor) run(ctx context.Context, key string, ready chan struct{}, fn func(ctx context.Context) error) error {
+	if key != "" {
+		err := e.wait(ctx, key, ready)
+		if err != nil {
+			return err
+		}
+		defer e.done(key)
+	}
+
+	select {
+	case e.workers <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-e.workers }()
+
+	if e.Locker != nil && key != "" {
+		release, err := e.Locker.Lock(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := release()
+			if err != nil {
+				e.Logger.Warnf("Unable to release lock on %s: %v", key, err)
+			}
+		}()
+	}
+	return fn(ctx)
+}
+
+// enqueue queues behind the functions already submitted for key, returning a channel closed once at
+// the front. Empty keys are not queued.
+func (e *Executor) enqueue(key string) chan struct{} {
+	if key == "" {
+		return nil
+	}
+	ready := make(chan struct{})
+	e.mutex.Lock()
+	e.queues[key] = append(e.queues[key], ready)
+	if len(e.queues[key]) == 1 {
+		close(ready)
+	}
+	e.mutex.Unlock()
+	return ready
+}
+
+// wait returns once ready is at the front of key's queue, or leaves the queue if ctx ends first.
+func (e *Executor) wait(ctx context.Context, key string, ready chan struct{}) error {
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		select {
+		case <-ready:
+			// Reached the front as the context ended; hand the turn on.
+			e.advance(key)
+		default:
+			e.remove(key, ready)
+		}
+		return ctx.Err()
+	}
+}
+
+// done hands the key to the next function queued for it.
+func (e *Executor) done(key string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.advance(key)
+}
+
+// advance removes the front of key's queue and wakes the next waiter. The caller holds the mutex.
+func (e *Executor) advance(key string) {
+	queue := e.queues[key][1:]
+	if len(queue) == 0 {
+		delete(e.queues, key)
+		return
+	}
+	e.queues[key] = queue
+	close(queue[0])
+}
+
+// remove drops a waiter that gave up before reaching the front. The caller holds the mutex.
+func (e *Executor) remove(key string, ready chan struct{}) {
+	queue := e.queues[key]
+	for i, waiter := range queue {
+		if waiter == ready {
+			e.queues[key] = append(queue[:i:i], queue[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// timeout bounds how long a test waits for something that should happen.
+const timeout = 5 * time.Second
+
+func TestPerKeyOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		keys    []string
+	}{
+		{name: "one key", workers: 4, keys: []string{"a"}},
+		{name: "interleaved keys", workers: 4, keys: []string{"a", "b", "c"}},
+		{name: "one worker", workers: 1, keys: []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := New(test.workers, nil, logrus.New())
+			var mutex sync.Mutex
+			got := map[string][]int{}
+			var results []<-chan error
+			for i := 0; i < 50; i++ {
+				key, i := test.keys[i%len(test.keys)], i
+				results = append(results, e.Go(context.Background(), key, func(context.Context) error {
+					// Give later functions a chance to overtake, were the order not kept.
+					time.Sleep(time.Millisecond)
+					mutex.Lock()
+					defer mutex.Unlock()
+					got[key] = append(got[key], i)
+					return nil
+				}))
+			}
+			for _, result := range results {
+				err := <-result
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, key := range test.keys {
+				for j := 1; j < len(got[key]); j++ {
+					if got[key][j] < got[key][j-1] {
+						t.Fatalf("key %s ran out of order: %v", key, got[key])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParallelism(t *testing.T) {
+	tests := []struct {
+		name     string
+		workers  int
+		keys     [2]string
+		parallel bool
+	}{
+		{name: "different keys", workers: 2, keys: [2]string{"a", "b"}, parallel: true},
+		{name: "empty keys", workers: 2, keys: [2]string{"", ""}, parallel: true},
+		{name: "same key", workers: 2, keys: [2]string{"a", "a"}, parallel: false},
+		{name: "no free worker", workers: 1, keys: [2]string{"a", "b"}, parallel: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := New(test.workers, nil, logrus.New())
+			started, release := make(chan struct{}), make(chan struct{})
+			first := e.Go(context.Background(), test.keys[0], func(context.Context) error {
+				close(started)
+				<-release
+				return nil
+			})
+			<-started
+
+			secondStarted := make(chan struct{})
+			second := e.Go(context.Background(), test.keys[1], func(context.Context) error {
+				close(secondStarted)
+				return nil
+			})
+			select {
+			case <-secondStarted:
+				if !test.parallel {
+					t.Fatal("second function ran while the first was running")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if test.parallel {
+					t.Fatal("second function did not run while the first was running")
+				}
+			}
+
+			close(release)
+			for _, result := range []<-chan error{first, second} {
+				select {
+				case err := <-result:
+					if err != nil {
+						t.Fatal(err)
+					}
+				case <-time.After(timeout):
+					t.Fatal("function did not run")
+				}
+			}
+		})
+	}
+}
+
+// fakeLocker records the locks taken and released.
+type fakeLocker struct {
+	err error
+
+	mutex    sync.Mutex
+	locked   []string
+	released []string
+}
+
+func (l *fakeLocker) Lock(_ context.Context, key string) (func() error, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.locked = append(l.locked, key)
+	return func() error {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.released = append(l.released, key)
+		return nil
+	}, nil
+}
+
+func TestLocker(t *testing.T) {
+	errHandler, errLock := errors.New("handler failed"), errors.New("lock failed")
+	tests := []struct {
+		name       string
+		key        string
+		handlerErr error
+		lockErr    error
+		wantRun    bool
+		wantLocked int
+	}{
+		{name: "success", key: "a", wantRun: true, wantLocked: 1},
+		{name: "handler error", key: "a", handlerErr: errHandler, wantRun: true, wantLocked: 1},
+		{name: "lock error", key: "a", lockErr: errLock, wantRun: false},
+		{name: "empty key", key: "", wantRun: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			locker := &fakeLocker{err: test.lockErr}
+			e := New(1, locker, logrus.New())
+			ran := false
+			err := e.Do(context.Background(), test.key, func(context.Context) error {
+				ran = true
+				return test.handlerErr
+			})
+			want := test.handlerErr
+			if test.lockErr != nil {
+				want = test.lockErr
+			}
+			if !errors.Is(err, want) {
+				t.Fatalf("got error %v, want %v", err, want)
+			}
+			if ran != test.wantRun {
+				t.Fatalf("function ran %t, want %t", ran, test.wantRun)
+			}
+			if len(locker.locked) != test.wantLocked || len(locker.released) != test.wantLocked {
+				t.Fatalf("got %d locks taken and %d released, want %d", len(locker.locked), len(locker.released), test.wantLocked)
+			}
+
+			// The key and the worker are handed on whatever happened.
+			done := make(chan error, 1)
+			go func() {
+				done <- e.Do(context.Background(), test.key, func(context.Context) error { return nil })
+			}()
+			select {
+			case <-done:
+			case <-time.After(timeout):
+				t.Fatal("next function for the key did not run")
+			}
+		})
+	}
+}
+
+func TestCancelWhileQueued(t *testing.T) {
+	e := New(2, nil, logrus.New())
+	started, release := make(chan struct{}), make(chan struct{})
+	first := e.Go(context.Background(), "a", func(context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := e.Go(ctx, "a", func(context.Context) error {
+		t.Error("cancelled function ran")
+		return nil
+	})
+	third := e.Go(context.Background(), "a", func(context.Context) error {
+		return nil
+	})
+
+	cancel()
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(timeout):
+		t.Fatal("cancelled function did not return")
+	}
+
+	close(release)
+	for _, result := range []<-chan error{first, third} {
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(timeout):
+			t.Fatal("function queued behind a cancelled one did not run")
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package format
+
+import (
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/markdown"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// IssueData builds the template model for the issue carried by a webhook.
+func IssueData(webhook *types.WebHook) *Data {
+	return &Data{
+		Author:    webhook.Issue.User.GetLogin(),
+		Mention:   mention(webhook.Issue.User.GetLogin()),
+		Org:       webhook.Repository.Owner.GetLogin(),
+		Repo:      webhook.Repository.GetName(),
+		Number:    webhook.Issue.GetNumber(),
+		Title:     webhook.Issue.GetTitle(),
+		Body:      webhook.Issue.GetBody(),
+		URL:       webhook.Issue.GetHTMLURL(),
+		IssueURL:  webhook.Issue.GetHTMLURL(),
+		CreatedAt: webhook.Issue.GetCreatedAt(),
+		UpdatedAt: webhook.Issue.GetUpdatedAt(),
+		Labels:    labelNames(webhook.Issue.Labels),
+	}
+}
+
+// CommentData builds the template model for the comment carried by a webhook.
+func CommentData(webhook *types.WebHook) *Data {
+	return &Data{
+		Author:    webhook.Comment.User.GetLogin(),
+		Mention:   mention(webhook.Comment.User.GetLogin()),
+		Org:       webhook.Repository.Owner.GetLogin(),
+		Repo:      webhook.Repository.GetName(),
+		Number:    webhook.Issue.GetNumber(),
+		Title:     webhook.Issue.GetTitle(),
+		Body:      webhook.Comment.GetBody(),
+		URL:       webhook.Comment.GetHTMLURL(),
+		IssueURL:  webhook.Issue.GetHTMLURL(),
+		CreatedAt: webhook.Comment.GetCreatedAt(),
+		UpdatedAt: webhook.Comment.GetUpdatedAt(),
+		Labels:    labelNames(webhook.Issue.Labels),
+	}
+}
+
+// PullRequestData builds the template model for the pull request carried by a webhook.
+func PullRequestData(webhook *types.WebHook) *Data {
+	pr := webhook.PullRequest
+	return &Data{
+		Author:    pr.User.GetLogin(),
+		Mention:   mention(pr.User.GetLogin()),
+		Org:       webhook.Repository.Owner.GetLogin(),
+		Repo:      webhook.Repository.GetName(),
+		Number:    pr.GetNumber(),
+		Title:     pr.GetTitle(),
+		Body:      pr.GetBody(),
+		URL:       pr.GetHTMLURL(),
+		IssueURL:  pr.GetHTMLURL(),
+		CreatedAt: pr.GetCreatedAt(),
+		UpdatedAt: pr.GetUpdatedAt(),
+		Labels:    labelNames(pr.Labels),
+		PullRequest: PullRequest{
+			Head:         pr.Head.GetRef(),
+			Base:         pr.Base.GetRef(),
+			Commits:      pr.GetCommits(),
+			ChangedFiles: pr.GetChangedFiles(),
+			Additions:    pr.GetAdditions(),
+			Deletions:    pr.GetDeletions(),
+			Merged:       pr.GetMerged(),
+		},
+	}
+}
+
+// ReviewCommentData builds the template model for the review comment carried by a webhook.
+// inReplyToURL is the mirrored parent comment, if any.
+func ReviewCommentData(webhook *types.WebHook, inReplyToURL string) *Data {
+	data := PullRequestData(webhook)
+	comment := webhook.ReviewComment
+	data.Author = comment.User.GetLogin()
+	data.Mention = mention(data.Author)
+	data.Body = comment.GetBody()
+	data.URL = comment.GetHTMLURL()
+	data.CreatedAt = comment.GetCreatedAt()
+	data.UpdatedAt = comment.GetUpdatedAt()
+	data.ReviewComment = ReviewComment{
+		Path:         comment.GetPath(),
+		Line:         comment.GetLine(),
+		DiffHunk:     comment.GetDiffHunk(),
+		InReplyToURL: inReplyToURL,
+	}
+	return data
+}
+
+// DiscussionData builds the template model for the discussion carried by a webhook.
+func DiscussionData(webhook *types.WebHook) *Data {
+	d := webhook.Discussion
+	return &Data{
+		Author:    d.User.GetLogin(),
+		Mention:   mention(d.User.GetLogin()),
+		Org:       webhook.Repository.Owner.GetLogin(),
+		Repo:      webhook.Repository.GetName(),
+		Number:    d.Number,
+		Title:     d.Title,
+		Body:      d.Body,
+		URL:       d.HTMLURL,
+		IssueURL:  d.HTMLURL,
+		CreatedAt: d.CreatedAt,
+		UpdatedAt: d.UpdatedAt,
+		Labels:    []string{},
+	}
+}
+
+// DiscussionCommentData builds the template model for the discussion comment carried by a webhook.
+func DiscussionCommentData(webhook *types.WebHook) *Data {
+	data := DiscussionData(webhook)
+	c := webhook.DiscussionComment
+	data.Author = c.User.GetLogin()
+	data.Mention = mention(data.Author)
+	data.Body = c.Body
+	data.URL = c.HTMLURL
+	data.CreatedAt = c.CreatedAt
+	data.UpdatedAt = c.UpdatedAt
+	return data
+}
+
+// mention refers to login without notifying anyone, for authors whose login on the other side is
+// not known.
+func mention(login string) string {
+	return markdown.Neutralize("@" + login)
+}
+
+func labelNames(labels []*github.Label) []string {
+	names := make([]string, 0, len(labels))
+	for _, label := range labels {
+		names = append(names, label.GetName())
+	}
+	return names
+}
@@ -0,0 +1,204 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+const (
+	DefaultIssueTitle         = "{{.Org}}/{{.Repo}}#{{.Number}}: {{.Title}}"
+	DefaultIssueBody          = "{{.Mention}} posted:\n\n{{.Body}}"
+	DefaultCommentBody        = "{{.Mention}} posted:\n\n{{.Body}}"
+	DefaultReverseCommentBody = "{{.Mention}} posted:\n\n{{.Body}}"
+	DefaultPullRequestBody    = "{{.Mention}} opened {{.URL}}\n\n{{.Body}}\n\n---\n" +
+		"`{{.PullRequest.Head}}` → `{{.PullRequest.Base}}` · {{.PullRequest.Commits}} commits · " +
+		"{{.PullRequest.ChangedFiles}} files changed · +{{.PullRequest.Additions}} −{{.PullRequest.Deletions}}" +
+		"{{if .PullRequest.Merged}} · merged{{end}}"
+	DefaultReviewCommentBody = "{{.Mention}} commented on `{{.ReviewComment.Path}}`" +
+		"{{if .ReviewComment.Line}} line {{.ReviewComment.Line}}{{end}}" +
+		"{{if .ReviewComment.InReplyToURL}} in reply to {{.ReviewComment.InReplyToURL}}{{end}}:\n\n" +
+		"```diff\n{{.ReviewComment.DiffHunk}}\n```\n\n{{.Body}}"
+)
+
+// Data is the model made available to every template. For comments, Number, Title and IssueURL
+// describe the parent issue while Body, URL and the timestamps describe the comment itself. Mention
+// refers to Author on the side the body is mirrored to: a mention of the same person when their login
+// there is mapped, and otherwise the login as a code span, which notifies no one.
+type Data struct {
+	Author    string
+	Mention   string
+	Org       string
+	Repo      string
+	Number    int
+	Title     string
+	Body      string
+	URL       string
+	IssueURL  string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Labels    []string
+
+	PullRequest   PullRequest
+	ReviewComment ReviewComment
+}
+
+// PullRequest holds the pull request details available to the pull request body template.
+type PullRequest struct {
+	Head         string
+	Base         string
+	Commits      int
+	ChangedFiles int
+	Additions    int
+	Deletions    int
+	Merged       bool
+}
+
+// ReviewComment holds the review details available to the review comment template. InReplyToURL links
+// to the mirrored parent comment when the review comment is a reply in a thread.
+type ReviewComment struct {
+	Path         string
+	Line         int
+	DiffHunk     string
+	InReplyToURL string
+}
+
+// Formatter renders mirrored titles and bodies from the configured templates.
+type Formatter struct {
+	issueTitle         *template.Template
+	issueBody          *template.Template
+	commentBody        *template.Template
+	reverseCommentBody *template.Template
+	pullRequestBody    *template.Template
+	reviewCommentBody  *template.Template
+}
+
+var funcs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"quote": func(s string) string {
+		return "> " + strings.ReplaceAll(s, "\n", "\n> ")
+	},
+}
+
+// New parses the configured templates, falling back to the defaults for any that are unset, and
+// validates each one by rendering it against sample data.
+func New(config types.Templates) (*Formatter, error) {
+	f := &Formatter{}
+	var err error
+	f.issueTitle, err = parse("issueTitle", config.IssueTitle, DefaultIssueTitle)
+	if err != nil {
+		return nil, err
+	}
+	f.issueBody, err = parse("issueBody", config.IssueBody, DefaultIssueBody)
+	if err != nil {
+		return nil, err
+	}
+	f.commentBody, err = parse("commentBody", config.CommentBody, DefaultCommentBody)
+	if err != nil {
+		return nil, err
+	}
+	f.reverseCommentBody, err = parse("reverseCommentBody", config.ReverseCommentBody, DefaultReverseCommentBody)
+	if err != nil {
+		return nil, err
+	}
+	f.pullRequestBody, err = parse("pullRequestBody", config.PullRequestBody, DefaultPullRequestBody)
+	if err != nil {
+		return nil, err
+	}
+	f.reviewCommentBody, err = parse("reviewCommentBody", config.ReviewCommentBody, DefaultReviewCommentBody)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parse(name, text, fallback string) (*template.Template, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s template: %v", name, err)
+	}
+	sample := &Data{
+		Author:    "octocat",
+		Mention:   "@octocat",
+		Org:       "octo-org",
+		Repo:      "octo-repo",
+		Number:    1,
+		Title:     "Sample title",
+		Body:      "Sample body",
+		URL:       "https://github.com/octo-org/octo-repo/issues/1",
+		IssueURL:  "https://github.com/octo-org/octo-repo/issues/1",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+		Labels:    []string{"bug"},
+		PullRequest: PullRequest{
+			Head:         "feature",
+			Base:         "main",
+			Commits:      1,
+			ChangedFiles: 1,
+			Additions:    1,
+			Deletions:    1,
+		},
+		ReviewComment: ReviewComment{
+			Path:     "README.md",
+			Line:     1,
+			DiffHunk: "@@ -1 +1 @@",
+		},
+	}
+	err = tmpl.Execute(&bytes.Buffer{}, sample)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render %s template: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+func render(tmpl *template.Template, data *Data) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// IssueTitle renders the title of an issue mirrored from EMU to GitHub.
+func (f *Formatter) IssueTitle(data *Data) (string, error) {
+	title, err := render(f.issueTitle, data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(title), nil
+}
+
+// IssueBody renders the body of an issue mirrored from EMU to GitHub.
+func (f *Formatter) IssueBody(data *Data) (string, error) {
+	return render(f.issueBody, data)
+}
+
+// CommentBody renders the body of a comment mirrored from EMU to GitHub.
+func (f *Formatter) CommentBody(data *Data) (string, error) {
+	return render(f.commentBody, data)
+}
+
+// ReverseCommentBody renders the body of a comment mirrored from GitHub back to EMU.
+func (f *Formatter) ReverseCommentBody(data *Data) (string, error) {
+	return render(f.reverseCommentBody, data)
+}
+
+// PullRequestBody renders the body of the tracking issue mirrored from an EMU pull request.
+func (f *Formatter) PullRequestBody(data *Data) (string, error) {
+	return render(f.pullRequestBody, data)
+}
+
+// ReviewCommentBody renders a pull request review comment mirrored from EMU to GitHub.
+func (f *Formatter) ReviewCommentBody(data *Data) (string, error) {
+	return render(f.reviewCommentBody, data)
+}
@@ -0,0 +1,68 @@
+package format
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+func TestDefaultTemplates(t *testing.T) {
+	f, err := New(types.Templates{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook := &types.WebHook{
+		Issue: &github.Issue{
+			Number: github.Int(7),
+			Title:  github.String("Title"),
+			Body:   github.String("Body"),
+			User:   &github.User{Login: github.String("octocat_emu")},
+		},
+		Repository: &github.Repository{Name: github.String("repo"), Owner: &github.User{Login: github.String("octo")}},
+	}
+	data := IssueData(webhook)
+	data.PullRequest = PullRequest{Head: "feature", Base: "main"}
+	data.ReviewComment = ReviewComment{Path: "README.md", DiffHunk: "@@ -1 +1 @@"}
+
+	renderers := map[string]func(*Data) (string, error){
+		"issueBody":          f.IssueBody,
+		"commentBody":        f.CommentBody,
+		"reverseCommentBody": f.ReverseCommentBody,
+		"pullRequestBody":    f.PullRequestBody,
+		"reviewCommentBody":  f.ReviewCommentBody,
+	}
+	tests := []struct {
+		name    string
+		mention string
+		want    string
+	}{
+		{name: "unmapped author", mention: data.Mention, want: "`@octocat_emu` "},
+		{name: "mapped author", mention: "@octocat", want: "@octocat "},
+	}
+
+	for _, test := range tests {
+		for name, render := range renderers {
+			t.Run(test.name+"/"+name, func(t *testing.T) {
+				data := *data
+				data.Mention = test.mention
+				body, err := render(&data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(body, test.want) {
+					t.Fatalf("%s rendered %q, want it to start with %q", name, body, test.want)
+				}
+			})
+		}
+	}
+
+	title, err := f.IssueTitle(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "octo/repo#7: Title" {
+		t.Fatalf("issueTitle rendered %q, want %q", title, "octo/repo#7: Title")
+	}
+}
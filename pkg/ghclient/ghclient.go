@@ -0,0 +1,91 @@
+package ghclient
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"github.com/shurcooL/githubv4"
+)
+
+// NewAppsTransport returns a transport authenticated as the app itself, pointed at the app's
+// configured API endpoint.
+func NewAppsTransport(app types.App, base http.RoundTripper, privateKey []byte) (*ghinstallation.AppsTransport, error) {
+	itr, err := ghinstallation.NewAppsTransport(base, app.AppID, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if app.BaseURL != "" {
+		itr.BaseURL = strings.TrimSuffix(app.BaseURL, "/")
+	}
+	return itr, nil
+}
+
+// NewInstallationTransport returns a transport authenticated as the given installation of the app,
+// requesting its tokens from the app's configured API endpoint.
+func NewInstallationTransport(app types.App, base http.RoundTripper, installationID int64, privateKey []byte) (*ghinstallation.Transport, error) {
+	itr, err := ghinstallation.New(base, app.AppID, installationID, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if app.BaseURL != "" {
+		itr.BaseURL = strings.TrimSuffix(app.BaseURL, "/")
+	}
+	return itr, nil
+}
+
+// NewREST returns a REST client for the app's API endpoint. Apps without a base URL talk to
+// api.github.com.
+func NewREST(app types.App, transport http.RoundTripper) (*github.Client, error) {
+	client := github.NewClient(&http.Client{Transport: transport})
+	if app.BaseURL == "" {
+		return client, nil
+	}
+
+	baseURL, err := url.Parse(withTrailingSlash(app.BaseURL))
+	if err != nil {
+		return nil, err
+	}
+	client.BaseURL = baseURL
+
+	uploadURL := baseURL
+	if app.UploadURL != "" {
+		uploadURL, err = url.Parse(withTrailingSlash(app.UploadURL))
+		if err != nil {
+			return nil, err
+		}
+	} else if strings.HasSuffix(baseURL.Path, "/api/v3/") {
+		uploadURL = &url.URL{Scheme: baseURL.Scheme, Host: baseURL.Host, Path: strings.TrimSuffix(baseURL.Path, "v3/") + "uploads/"}
+	}
+	client.UploadURL = uploadURL
+	return client, nil
+}
+
+// NewGraphQL returns a GraphQL client for the app's API endpoint. When no GraphQL URL is configured
+// it is derived from the base URL: GitHub Enterprise Server serves GraphQL at /api/graphql, while
+// GHE.com tenants serve it at /graphql on the API host.
+func NewGraphQL(app types.App, transport http.RoundTripper) *githubv4.Client {
+	httpClient := &http.Client{Transport: transport}
+	if app.GraphQLURL != "" {
+		return githubv4.NewEnterpriseClient(app.GraphQLURL, httpClient)
+	}
+	if app.BaseURL == "" {
+		return githubv4.NewClient(httpClient)
+	}
+
+	baseURL := withTrailingSlash(app.BaseURL)
+	if strings.HasSuffix(baseURL, "/api/v3/") {
+		return githubv4.NewEnterpriseClient(strings.TrimSuffix(baseURL, "v3/")+"graphql", httpClient)
+	}
+	return githubv4.NewEnterpriseClient(baseURL+"graphql", httpClient)
+}
+
+func withTrailingSlash(s string) string {
+	if strings.HasSuffix(s, "/") {
+		return s
+	}
+	return s + "/"
+}
@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"context"
+	"time"
+)
+
+// withTimeout derives a context bounded by the configured timeout for an operation class. A zero
+// timeout leaves the parent deadline, if any, in place.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
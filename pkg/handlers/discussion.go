@@ -0,0 +1,600 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/format"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"github.com/shurcooL/githubv4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	discussionKindDiscussion = "discussion"
+	discussionKindIssue      = "issue"
+)
+
+var (
+	repositoryIDMutex  sync.Mutex
+	cachedRepositoryID githubv4.ID
+)
+
+// HandleDiscussion mirrors an EMU discussion to the GitHub repository, either as a discussion in the
+// configured category or, when discussions.convertToIssue is set, as an issue.
+func (e *EMU) HandleDiscussion(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandleDiscussion", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "edited":
+		stale, err := staleDiscussion(ctx, e.DBClient, e.Logger, webhook.Discussion.ID, webhook.Discussion.UpdatedAt, webhook.DeliveryID)
+		if err != nil || stale {
+			return err
+		}
+	}
+
+	switch webhook.Action {
+	case "created":
+		kind := db.OperationDiscussion
+		if e.Config.Discussions.ConvertToIssue {
+			kind = db.OperationDiscussionIssue
+		}
+		op := &db.Operation{Kind: kind, SourceID: webhook.Discussion.ID, Webhook: webhook}
+		err := mirrorCreate(ctx, e.DBClient, op, func() (int64, error) {
+			nodeID, number, err := e.createDiscussion(ctx, webhook)
+			op.SyncedNodeID = nodeID
+			return int64(number), err
+		})
+		if err != nil {
+			return err
+		}
+	case "edited":
+		err := e.editDiscussion(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.UpdateDiscussionEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	case "deleted":
+		err := e.deleteDiscussion(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.DeleteDiscussionEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleDiscussionComment mirrors EMU discussion comments, preserving reply threads when the
+// discussion is mirrored as a discussion.
+func (e *EMU) HandleDiscussionComment(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandleDiscussionComment", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "edited":
+		stale, err := staleDiscussionComment(ctx, e.DBClient, e.Logger, webhook.DiscussionComment.ID, webhook.DiscussionComment.UpdatedAt, webhook.DeliveryID)
+		if err != nil || stale {
+			return err
+		}
+	}
+
+	switch webhook.Action {
+	case "created":
+		op := &db.Operation{Kind: db.OperationDiscussionComment, SourceID: webhook.DiscussionComment.ID, ParentID: webhook.Discussion.ID, Webhook: webhook}
+		err := mirrorCreate(ctx, e.DBClient, op, func() (int64, error) {
+			id, nodeID, err := e.createDiscussionComment(ctx, webhook)
+			op.SyncedNodeID = nodeID
+			return id, err
+		})
+		if err != nil {
+			return err
+		}
+	case "edited":
+		err := e.editDiscussionComment(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.UpdateDiscussionCommentEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	case "deleted":
+		err := e.deleteDiscussionComment(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.DeleteDiscussionCommentEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *EMU) createDiscussion(ctx context.Context, webhook *types.WebHook) (string, int, error) {
+	newTitle, newBody, err := e.formatDiscussion(ctx, webhook)
+	if err != nil {
+		return "", -1, err
+	}
+
+	if e.Config.Discussions.ConvertToIssue {
+		apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+		defer cancel()
+		issue, _, err := e.GitHubClient.Issues.Create(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, &github.IssueRequest{
+			Title: &newTitle,
+			Body:  &newBody,
+		})
+		if err != nil {
+			return "", -1, err
+		}
+		return issue.GetNodeID(), issue.GetNumber(), nil
+	}
+
+	if e.Config.Discussions.CategoryID == "" {
+		return "", -1, fmt.Errorf("discussions.categoryID must be configured to mirror discussions")
+	}
+	repoID, err := e.repositoryID(ctx)
+	if err != nil {
+		return "", -1, err
+	}
+
+	var mutation struct {
+		CreateDiscussion struct {
+			Discussion struct {
+				ID     string
+				Number int
+			}
+		} `graphql:"createDiscussion(input: $input)"`
+	}
+	input := githubv4.CreateDiscussionInput{
+		RepositoryID: repoID,
+		CategoryID:   githubv4.ID(e.Config.Discussions.CategoryID),
+		Title:        githubv4.String(newTitle),
+		Body:         githubv4.String(newBody),
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, e.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	err = e.GraphQLClient.Mutate(gqlCtx, &mutation, input, nil)
+	if err != nil {
+		return "", -1, err
+	}
+	return mutation.CreateDiscussion.Discussion.ID, mutation.CreateDiscussion.Discussion.Number, nil
+}
+
+func (e *EMU) editDiscussion(ctx context.Context, webhook *types.WebHook) error {
+	kind, nodeID, number, err := e.DBClient.GetSyncedDiscussionEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	newTitle, newBody, err := e.formatDiscussion(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	if kind == discussionKindIssue {
+		apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+		defer cancel()
+		_, _, err = e.GitHubClient.Issues.Edit(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, number, &github.IssueRequest{
+			Title: &newTitle,
+			Body:  &newBody,
+		})
+		return err
+	}
+
+	var mutation struct {
+		UpdateDiscussion struct {
+			Discussion struct {
+				ID string
+			}
+		} `graphql:"updateDiscussion(input: $input)"`
+	}
+	title := githubv4.String(newTitle)
+	body := githubv4.String(newBody)
+	input := githubv4.UpdateDiscussionInput{
+		DiscussionID: githubv4.ID(nodeID),
+		Title:        &title,
+		Body:         &body,
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, e.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	return e.GraphQLClient.Mutate(gqlCtx, &mutation, input, nil)
+}
+
+func (e *EMU) deleteDiscussion(ctx context.Context, webhook *types.WebHook) error {
+	kind, nodeID, _, err := e.DBClient.GetSyncedDiscussionEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	gqlCtx, gqlCancel := withTimeout(ctx, e.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	if kind == discussionKindIssue {
+		var mutation struct {
+			DeleteIssue struct {
+				Repository struct {
+					ID string
+				}
+			} `graphql:"deleteIssue(input: $input)"`
+		}
+		return e.GraphQLClient.Mutate(gqlCtx, &mutation, githubv4.DeleteIssueInput{IssueID: githubv4.ID(nodeID)}, nil)
+	}
+
+	var mutation struct {
+		DeleteDiscussion struct {
+			Discussion struct {
+				ID string
+			}
+		} `graphql:"deleteDiscussion(input: $input)"`
+	}
+	return e.GraphQLClient.Mutate(gqlCtx, &mutation, githubv4.DeleteDiscussionInput{ID: githubv4.ID(nodeID)}, nil)
+}
+
+func (e *EMU) createDiscussionComment(ctx context.Context, webhook *types.WebHook) (int64, string, error) {
+	kind, nodeID, number, err := e.DBClient.GetSyncedDiscussionEntry(ctx, webhook)
+	if err != nil {
+		return -1, "", err
+	}
+	newBody, err := e.formatDiscussionComment(ctx, webhook)
+	if err != nil {
+		return -1, "", err
+	}
+
+	if kind == discussionKindIssue {
+		apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+		defer cancel()
+		comment, _, err := e.GitHubClient.Issues.CreateComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, number, &github.IssueComment{
+			Body: &newBody,
+		})
+		if err != nil {
+			return -1, "", err
+		}
+		return comment.GetID(), comment.GetNodeID(), nil
+	}
+
+	var mutation struct {
+		AddDiscussionComment struct {
+			Comment struct {
+				ID         string
+				DatabaseID int64
+			}
+		} `graphql:"addDiscussionComment(input: $input)"`
+	}
+	input := githubv4.AddDiscussionCommentInput{
+		DiscussionID: githubv4.ID(nodeID),
+		Body:         githubv4.String(newBody),
+	}
+	if parentID := webhook.DiscussionComment.ParentID; parentID != 0 {
+		input.ReplyToID = replyToID(ctx, e.DBClient, e.Logger, webhook.DiscussionComment.ID, parentID)
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, e.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	err = e.GraphQLClient.Mutate(gqlCtx, &mutation, input, nil)
+	if err != nil {
+		return -1, "", err
+	}
+	return mutation.AddDiscussionComment.Comment.DatabaseID, mutation.AddDiscussionComment.Comment.ID, nil
+}
+
+func (e *EMU) editDiscussionComment(ctx context.Context, webhook *types.WebHook) error {
+	kind, _, _, err := e.DBClient.GetSyncedDiscussionEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	syncedID, syncedNodeID, err := e.DBClient.GetSyncedDiscussionCommentEntry(ctx, webhook.DiscussionComment.ID)
+	if err != nil {
+		return err
+	}
+	newBody, err := e.formatDiscussionComment(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	if kind == discussionKindIssue {
+		apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+		defer cancel()
+		_, _, err = e.GitHubClient.Issues.EditComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, syncedID, &github.IssueComment{
+			Body: &newBody,
+		})
+		return err
+	}
+
+	var mutation struct {
+		UpdateDiscussionComment struct {
+			Comment struct {
+				ID string
+			}
+		} `graphql:"updateDiscussionComment(input: $input)"`
+	}
+	input := githubv4.UpdateDiscussionCommentInput{
+		CommentID: githubv4.ID(syncedNodeID),
+		Body:      githubv4.String(newBody),
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, e.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	return e.GraphQLClient.Mutate(gqlCtx, &mutation, input, nil)
+}
+
+func (e *EMU) deleteDiscussionComment(ctx context.Context, webhook *types.WebHook) error {
+	kind, _, _, err := e.DBClient.GetSyncedDiscussionEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	syncedID, syncedNodeID, err := e.DBClient.GetSyncedDiscussionCommentEntry(ctx, webhook.DiscussionComment.ID)
+	if err != nil {
+		return err
+	}
+
+	if kind == discussionKindIssue {
+		apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+		defer cancel()
+		_, err = e.GitHubClient.Issues.DeleteComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, syncedID)
+		return err
+	}
+
+	var mutation struct {
+		DeleteDiscussionComment struct {
+			Comment struct {
+				ID string
+			}
+		} `graphql:"deleteDiscussionComment(input: $input)"`
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, e.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	return e.GraphQLClient.Mutate(gqlCtx, &mutation, githubv4.DeleteDiscussionCommentInput{ID: githubv4.ID(syncedNodeID)}, nil)
+}
+
+func (e *EMU) formatDiscussion(ctx context.Context, webhook *types.WebHook) (string, string, error) {
+	data := format.DiscussionData(webhook)
+	e.rewriteBody(ctx, webhook, data)
+	title, err := e.Formatter.IssueTitle(data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := e.Formatter.IssueBody(data)
+	if err != nil {
+		return "", "", err
+	}
+	body = marker.Embed(title, body, marker.Marker{
+		Kind:   marker.KindDiscussion,
+		Source: marker.SourceEMU,
+		ID:     webhook.Discussion.ID,
+		Org:    data.Org,
+		Repo:   data.Repo,
+		Number: data.Number,
+	})
+	return title, body, nil
+}
+
+func (e *EMU) formatDiscussionComment(ctx context.Context, webhook *types.WebHook) (string, error) {
+	data := format.DiscussionCommentData(webhook)
+	e.rewriteBody(ctx, webhook, data)
+	body, err := e.Formatter.CommentBody(data)
+	if err != nil {
+		return "", err
+	}
+	return marker.Embed("", body, marker.Marker{
+		Kind:   marker.KindDiscussionComment,
+		Source: marker.SourceEMU,
+		ID:     webhook.DiscussionComment.ID,
+		Org:    data.Org,
+		Repo:   data.Repo,
+		Number: data.Number,
+	}), nil
+}
+
+// repositoryID returns the node ID of the GitHub repository, which discussion creation requires.
+func (e *EMU) repositoryID(ctx context.Context) (githubv4.ID, error) {
+	repositoryIDMutex.Lock()
+	defer repositoryIDMutex.Unlock()
+	if cachedRepositoryID != nil {
+		return cachedRepositoryID, nil
+	}
+
+	var query struct {
+		Repository struct {
+			ID githubv4.ID
+		} `graphql:"repository(owner: $owner, name: $name)"`
+	}
+	variables := map[string]interface{}{
+		"owner": githubv4.String(e.Config.Repo.Org),
+		"name":  githubv4.String(e.Config.Repo.Name),
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, e.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	err := e.GraphQLClient.Query(gqlCtx, &query, variables)
+	if err != nil {
+		return nil, err
+	}
+	cachedRepositoryID = query.Repository.ID
+	return cachedRepositoryID, nil
+}
+
+// HandleDiscussionComment mirrors comments made on a mirrored discussion back to the EMU discussion.
+// Comments on discussions converted to issues arrive as issue comments and are not mirrored back.
+func (g *GitHub) HandleDiscussionComment(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "GitHub.HandleDiscussionComment", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "edited":
+		stale, err := staleDiscussionComment(ctx, g.DBClient, g.Logger, webhook.DiscussionComment.ID, webhook.DiscussionComment.UpdatedAt, webhook.DeliveryID)
+		if err != nil || stale {
+			return err
+		}
+	}
+
+	switch webhook.Action {
+	case "created":
+		emuDiscussionID, emuNodeID, emuOrg, err := g.DBClient.GetEMUDiscussionEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		op := &db.Operation{Kind: db.OperationGitHubDiscussionComment, SourceID: webhook.DiscussionComment.ID, ParentID: emuDiscussionID, Webhook: webhook}
+		err = mirrorCreate(ctx, g.DBClient, op, func() (int64, error) {
+			id, nodeID, err := g.createDiscussionComment(ctx, webhook, emuNodeID, emuOrg)
+			op.SyncedNodeID = nodeID
+			return id, err
+		})
+		if err != nil {
+			return err
+		}
+	case "edited":
+		err := g.editDiscussionComment(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = g.DBClient.UpdateDiscussionCommentEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	case "deleted":
+		err := g.deleteDiscussionComment(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = g.DBClient.DeleteDiscussionCommentEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *GitHub) createDiscussionComment(ctx context.Context, webhook *types.WebHook, emuNodeID, emuOrg string) (int64, string, error) {
+	newBody, err := g.formatDiscussionComment(ctx, webhook)
+	if err != nil {
+		return -1, "", err
+	}
+	client, err := g.retrieveOrgInstallationGraphQLClient(ctx, emuOrg)
+	if err != nil {
+		return -1, "", err
+	}
+
+	var mutation struct {
+		AddDiscussionComment struct {
+			Comment struct {
+				ID         string
+				DatabaseID int64
+			}
+		} `graphql:"addDiscussionComment(input: $input)"`
+	}
+	input := githubv4.AddDiscussionCommentInput{
+		DiscussionID: githubv4.ID(emuNodeID),
+		Body:         githubv4.String(newBody),
+	}
+	if parentID := webhook.DiscussionComment.ParentID; parentID != 0 {
+		input.ReplyToID = replyToID(ctx, g.DBClient, g.Logger, webhook.DiscussionComment.ID, parentID)
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	err = client.Mutate(gqlCtx, &mutation, input, nil)
+	if err != nil {
+		return -1, "", err
+	}
+	return mutation.AddDiscussionComment.Comment.DatabaseID, mutation.AddDiscussionComment.Comment.ID, nil
+}
+
+func (g *GitHub) editDiscussionComment(ctx context.Context, webhook *types.WebHook) error {
+	_, _, emuOrg, err := g.DBClient.GetEMUDiscussionEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	_, syncedNodeID, err := g.DBClient.GetSyncedDiscussionCommentEntry(ctx, webhook.DiscussionComment.ID)
+	if err != nil {
+		return err
+	}
+	newBody, err := g.formatDiscussionComment(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	client, err := g.retrieveOrgInstallationGraphQLClient(ctx, emuOrg)
+	if err != nil {
+		return err
+	}
+
+	var mutation struct {
+		UpdateDiscussionComment struct {
+			Comment struct {
+				ID string
+			}
+		} `graphql:"updateDiscussionComment(input: $input)"`
+	}
+	input := githubv4.UpdateDiscussionCommentInput{
+		CommentID: githubv4.ID(syncedNodeID),
+		Body:      githubv4.String(newBody),
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	return client.Mutate(gqlCtx, &mutation, input, nil)
+}
+
+func (g *GitHub) deleteDiscussionComment(ctx context.Context, webhook *types.WebHook) error {
+	_, _, emuOrg, err := g.DBClient.GetEMUDiscussionEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	_, syncedNodeID, err := g.DBClient.GetSyncedDiscussionCommentEntry(ctx, webhook.DiscussionComment.ID)
+	if err != nil {
+		return err
+	}
+	client, err := g.retrieveOrgInstallationGraphQLClient(ctx, emuOrg)
+	if err != nil {
+		return err
+	}
+
+	var mutation struct {
+		DeleteDiscussionComment struct {
+			Comment struct {
+				ID string
+			}
+		} `graphql:"deleteDiscussionComment(input: $input)"`
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	return client.Mutate(gqlCtx, &mutation, githubv4.DeleteDiscussionCommentInput{ID: githubv4.ID(syncedNodeID)}, nil)
+}
+
+func (g *GitHub) formatDiscussionComment(ctx context.Context, webhook *types.WebHook) (string, error) {
+	data := format.DiscussionCommentData(webhook)
+	g.rewriteReferences(ctx, data)
+	body, err := g.Formatter.ReverseCommentBody(data)
+	if err != nil {
+		return "", err
+	}
+	return marker.Embed("", body, marker.Marker{
+		Kind:   marker.KindDiscussionComment,
+		Source: marker.SourceGitHub,
+		ID:     webhook.DiscussionComment.ID,
+		Org:    g.Config.Repo.Org,
+		Repo:   g.Config.Repo.Name,
+		Number: webhook.Discussion.Number,
+	}), nil
+}
+
+// replyToID returns the node id of the comment a reply to parentID is threaded under on the other side:
+// the parent's mirror, or, when the parent is itself a mirror, the comment it mirrors. A reply whose
+// parent cannot be located is posted as a top level comment.
+func replyToID(ctx context.Context, dbClient *db.Manager, logger *logrus.Logger, commentID, parentID int64) *githubv4.ID {
+	_, nodeID, err := dbClient.GetSyncedDiscussionCommentEntry(ctx, parentID)
+	if errors.Is(err, db.ErrNotFound) {
+		_, nodeID, err = dbClient.GetSourceDiscussionCommentEntry(ctx, parentID)
+	}
+	if err != nil {
+		logger.Warnf("Unable to locate the counterpart of parent %d of discussion comment %d, posting it unthreaded: %v", parentID, commentID, err)
+		return nil
+	}
+	id := githubv4.ID(nodeID)
+	return &id
+}
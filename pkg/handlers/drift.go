@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/drift"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+)
+
+// ScanDrift compares every mapped issue, pull request and comment with the live items on both sides,
+// and reports mirrors in the GitHub repository that have no mapping. The title, body and state of
+// sources are compared with the stored copies; mirrors are rendered through templates, so they are
+// checked for existence, state and the source their marker names. Items that cannot be scanned are
+// logged and skipped.
+func (g *GitHub) ScanDrift(ctx context.Context) (*drift.Report, error) {
+	report := &drift.Report{GeneratedAt: time.Now()}
+	snapshots, err := g.DBClient.ListIssueSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		err = g.scanIssue(ctx, report, snapshot)
+		if err != nil {
+			g.Logger.Warnf("Unable to scan %s %s/%s#%d for drift: %v", snapshot.Kind, snapshot.Org, snapshot.Repo, snapshot.IssueNumber, err)
+		}
+	}
+	err = g.scanOrphans(ctx, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (g *GitHub) scanIssue(ctx context.Context, report *drift.Report, snapshot *db.IssueSnapshot) error {
+	client, err := g.retrieveOrgInstallationClient(ctx, snapshot.Org)
+	if err != nil {
+		return err
+	}
+	report.Issues++
+	finding := func(kind, side string) drift.Finding {
+		return drift.Finding{
+			Kind:         kind,
+			Item:         snapshot.Kind,
+			Side:         side,
+			Org:          snapshot.Org,
+			Repo:         snapshot.Repo,
+			Number:       snapshot.IssueNumber,
+			SyncedNumber: snapshot.SyncedIssueNumber,
+		}
+	}
+
+	source, err := g.getIssue(ctx, client, snapshot.Org, snapshot.Repo, snapshot.IssueNumber)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		report.Add(finding(drift.SourceMissing, "emu"))
+	} else {
+		for _, field := range []struct{ kind, stored, live string }{
+			{drift.Title, snapshot.Title, source.GetTitle()},
+			{drift.Body, snapshot.Body, source.GetBody()},
+			{drift.State, snapshot.State, source.GetState()},
+		} {
+			if field.stored != field.live {
+				f := finding(field.kind, "emu")
+				f.Stored, f.Live = field.stored, field.live
+				report.Add(f)
+			}
+		}
+	}
+
+	mirror, err := g.getIssue(ctx, g.GitHubClient, g.Config.Repo.Org, g.Config.Repo.Name, snapshot.SyncedIssueNumber)
+	if err != nil {
+		return err
+	}
+	if mirror == nil {
+		report.Add(finding(drift.MirrorMissing, "github"))
+	} else {
+		if mirror.GetState() != snapshot.State {
+			f := finding(drift.State, "github")
+			f.Stored, f.Live = snapshot.State, mirror.GetState()
+			report.Add(f)
+		}
+		if m, _, ok := marker.Parse(mirror.GetBody()); !ok || m.ID != snapshot.ID {
+			report.Add(finding(drift.MarkerMismatch, "github"))
+		}
+	}
+
+	return g.scanComments(ctx, report, snapshot, client, source != nil, mirror != nil, finding)
+}
+
+// scanComments compares the comments of a mapped issue. Comments are only compared on the sides whose
+// issue still exists.
+func (g *GitHub) scanComments(ctx context.Context, report *drift.Report, snapshot *db.IssueSnapshot, client *github.Client, sourceExists, mirrorExists bool, finding func(kind, side string) drift.Finding) error {
+	comments, err := g.DBClient.ListCommentSnapshots(ctx, snapshot.ID)
+	if err != nil || len(comments) == 0 {
+		return err
+	}
+
+	var emuComments, githubComments map[int64]string
+	if sourceExists {
+		emuComments, err = g.commentBodies(ctx, client, snapshot.Org, snapshot.Repo, snapshot.IssueNumber, snapshot.Kind == "pull_request")
+		if err != nil {
+			return err
+		}
+	}
+	if mirrorExists {
+		githubComments, err = g.commentBodies(ctx, g.GitHubClient, g.Config.Repo.Org, g.Config.Repo.Name, snapshot.SyncedIssueNumber, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, comment := range comments {
+		report.Comments++
+		sources, mirrors := emuComments, githubComments
+		sourceSide, mirrorSide := "emu", "github"
+		if comment.Origin == "github" {
+			sources, mirrors = githubComments, emuComments
+			sourceSide, mirrorSide = "github", "emu"
+		}
+		commentFinding := func(kind, side string) drift.Finding {
+			f := finding(kind, side)
+			f.Item, f.CommentID = "comment", comment.ID
+			return f
+		}
+
+		if sources != nil {
+			body, ok := sources[comment.ID]
+			if !ok {
+				report.Add(commentFinding(drift.SourceMissing, sourceSide))
+			} else if body != comment.Body {
+				f := commentFinding(drift.Body, sourceSide)
+				f.Stored, f.Live = comment.Body, body
+				report.Add(f)
+			}
+		}
+		if mirrors != nil {
+			body, ok := mirrors[comment.SyncedCommentID]
+			if !ok {
+				report.Add(commentFinding(drift.MirrorMissing, mirrorSide))
+			} else if m, _, ok := marker.Parse(body); !ok || m.ID != comment.ID {
+				report.Add(commentFinding(drift.MarkerMismatch, mirrorSide))
+			}
+		}
+	}
+	return nil
+}
+
+// scanOrphans reports mirrored issues and pull requests in the GitHub repository that have no mapping.
+func (g *GitHub) scanOrphans(ctx context.Context, report *drift.Report) error {
+	opts := &github.IssueListByRepoOptions{State: "all", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		issues, resp, err := g.GitHubClient.Issues.ListByRepo(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, opts)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, issue := range issues {
+			m, _, ok := marker.Parse(issue.GetBody())
+			if !ok || m.Source != marker.SourceEMU || (m.Kind != marker.KindIssue && m.Kind != marker.KindPullRequest) {
+				continue
+			}
+			report.Mirrors++
+			exists, err := g.DBClient.IssueEntryExists(ctx, m.ID)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				report.Add(drift.Finding{
+					Kind:         drift.Orphan,
+					Item:         m.Kind,
+					Side:         "github",
+					Org:          m.Org,
+					Repo:         m.Repo,
+					Number:       m.Number,
+					SyncedNumber: issue.GetNumber(),
+				})
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// getIssue returns an issue, or nil when it has been deleted or can no longer be read.
+func (g *GitHub) getIssue(ctx context.Context, client *github.Client, org, repo string, number int) (*github.Issue, error) {
+	apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+	defer cancel()
+	issue, _, err := client.Issues.Get(apiCtx, org, repo, number)
+	if errResp, ok := err.(*github.ErrorResponse); ok && (errResp.Response.StatusCode == http.StatusNotFound || errResp.Response.StatusCode == http.StatusGone) {
+		return nil, nil
+	}
+	return issue, err
+}
+
+// commentBodies returns the bodies of an issue's comments keyed by id, including its review comments
+// when the issue is a pull request.
+func (g *GitHub) commentBodies(ctx context.Context, client *github.Client, org, repo string, number int, pullRequest bool) (map[int64]string, error) {
+	comments, err := g.listComments(ctx, client, org, repo, number)
+	if err != nil {
+		return nil, err
+	}
+	bodies := map[int64]string{}
+	for _, comment := range comments {
+		bodies[comment.GetID()] = comment.GetBody()
+	}
+	if !pullRequest {
+		return bodies, nil
+	}
+
+	opts := &github.PullRequestListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		page, resp, err := client.PullRequests.ListComments(apiCtx, org, repo, number, opts)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, comment := range page {
+			bodies[comment.GetID()] = comment.GetBody()
+		}
+		if resp.NextPage == 0 {
+			return bodies, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
@@ -3,9 +3,16 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"net/http"
 
+	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/attachments"
 	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/format"
+	"github.com/lindluni/github-issue-sync/pkg/ghclient"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/reactions"
 	"github.com/lindluni/github-issue-sync/pkg/types"
 	"github.com/shurcooL/githubv4"
 	"github.com/sirupsen/logrus"
@@ -17,75 +24,103 @@ type EMU struct {
 	GitHubClient  *github.Client
 	GraphQLClient *githubv4.Client
 
-	Config *types.Config
+	// Transport is the base transport of the clients created for client app installations.
+	Transport http.RoundTripper
+
+	Attachments *attachments.Mirror
+
+	Config    *types.Config
+	Formatter *format.Formatter
 
 	Logger *logrus.Logger
 }
 
-func (e *EMU) HandleIssue(webhook *types.WebHook) error {
+func (e *EMU) HandleIssue(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandleIssue", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "edited", "closed", "reopened":
+		stale, err := staleIssue(ctx, e.DBClient, e.Logger, webhook.Issue.GetID(), webhook.Issue.GetUpdatedAt(), webhook.DeliveryID)
+		if err != nil || stale {
+			return err
+		}
+	}
+
 	switch webhook.Action {
 	case "opened":
-		issue, err := e.openIssue(webhook)
-		if err != nil {
+		// A transferred issue may have been mapped from its transfer event already.
+		exists, err := e.DBClient.IssueEntryExists(ctx, webhook.Issue.GetID())
+		if err != nil || exists {
 			return err
 		}
-		err = e.DBClient.InsertIssueEntry(webhook, issue.GetNumber())
+		op := &db.Operation{Kind: db.OperationIssue, SourceID: webhook.Issue.GetID(), Webhook: webhook}
+		err = mirrorCreate(ctx, e.DBClient, op, func() (int64, error) {
+			issue, err := e.openIssue(ctx, webhook)
+			return int64(issue.GetNumber()), err
+		})
 		if err != nil {
 			return err
 		}
 	case "edited":
-		err := e.editIssue(webhook)
+		err := e.editIssue(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = e.DBClient.UpdateIssueEntry(webhook)
+		err = e.DBClient.UpdateIssueEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
 	case "deleted":
-		err := e.deleteIssue(webhook)
+		err := e.deleteIssue(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = e.DBClient.DeleteIssueEntry(webhook)
+		err = e.DBClient.DeleteIssueEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
 	case "closed":
-		err := e.updateIssueState(webhook)
+		err := e.updateIssueState(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = e.DBClient.UpdateIssueEntry(webhook)
+		err = e.DBClient.UpdateIssueEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
 	case "reopened":
-		err := e.updateIssueState(webhook)
+		err := e.updateIssueState(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = e.DBClient.UpdateIssueEntry(webhook)
+		err = e.DBClient.UpdateIssueEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	case "locked", "unlocked":
+		err := e.updateIssueLock(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	case "transferred":
+		err := e.transferIssue(ctx, webhook)
 		if err != nil {
 			return err
 		}
-
 	}
 	return nil
 }
 
-func (e *EMU) openIssue(webhook *types.WebHook) (*github.Issue, error) {
-	org := webhook.Repository.Owner.GetLogin()
-	repo := webhook.Repository.GetName()
-	issueNumber := webhook.Issue.GetNumber()
-	title := webhook.Issue.GetTitle()
-	author := webhook.Issue.User.GetLogin()
-	body := webhook.Issue.GetBody()
-
-	newTitle := fmt.Sprintf("%s/%s#%d: %s", org, repo, issueNumber, title)
-	newBody := fmt.Sprintf("@%s posted:\n\n%s", author, body)
+func (e *EMU) openIssue(ctx context.Context, webhook *types.WebHook) (*github.Issue, error) {
+	newTitle, newBody, err := e.formatIssue(ctx, webhook, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	issue, _, err := e.GitHubClient.Issues.Create(context.Background(), e.Config.Repo.Org, e.Config.Repo.Name, &github.IssueRequest{
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	issue, _, err := e.GitHubClient.Issues.Create(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, &github.IssueRequest{
 		Title: &newTitle,
 		Body:  &newBody,
 	})
@@ -93,23 +128,24 @@ func (e *EMU) openIssue(webhook *types.WebHook) (*github.Issue, error) {
 	return issue, err
 }
 
-func (e *EMU) editIssue(webhook *types.WebHook) error {
-	org := webhook.Repository.Owner.GetLogin()
-	repo := webhook.Repository.GetName()
-	issueNumber := webhook.Issue.GetNumber()
-	title := webhook.Issue.GetTitle()
-	author := webhook.Issue.User.GetLogin()
-	body := webhook.Issue.GetBody()
-
-	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(webhook)
+func (e *EMU) editIssue(ctx context.Context, webhook *types.WebHook) error {
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(ctx, webhook)
 	if err != nil {
 		return err
 	}
 
-	newTitle := fmt.Sprintf("%s/%s#%d: %s", org, repo, issueNumber, title)
-	newBody := fmt.Sprintf("@%s posted:\n\n%s", author, body)
+	counts, err := e.DBClient.GetIssueReactions(ctx, webhook.Issue.GetID())
+	if err != nil {
+		return err
+	}
+	newTitle, newBody, err := e.formatIssue(ctx, webhook, counts)
+	if err != nil {
+		return err
+	}
 
-	_, _, err = e.GitHubClient.Issues.Edit(context.Background(), e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueRequest{
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	_, _, err = e.GitHubClient.Issues.Edit(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueRequest{
 		Title: &newTitle,
 		Body:  &newBody,
 	})
@@ -117,8 +153,84 @@ func (e *EMU) editIssue(webhook *types.WebHook) error {
 	return err
 }
 
-func (e *EMU) deleteIssue(webhook *types.WebHook) error {
-	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(webhook)
+func (e *EMU) formatIssue(ctx context.Context, webhook *types.WebHook, counts reactions.Counts) (string, string, error) {
+	data := format.IssueData(webhook)
+	e.rewriteBody(ctx, webhook, data)
+	title, err := e.Formatter.IssueTitle(data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := e.Formatter.IssueBody(data)
+	if err != nil {
+		return "", "", err
+	}
+	body = reactions.Append(body, counts)
+	body = marker.Embed(title, body, marker.Marker{
+		Kind:   marker.KindIssue,
+		Source: marker.SourceEMU,
+		ID:     webhook.Issue.GetID(),
+		Org:    data.Org,
+		Repo:   data.Repo,
+		Number: data.Number,
+	})
+	return title, body, nil
+}
+
+func (e *EMU) formatComment(ctx context.Context, webhook *types.WebHook, counts reactions.Counts) (string, error) {
+	data := format.CommentData(webhook)
+	e.rewriteBody(ctx, webhook, data)
+	body, err := e.Formatter.CommentBody(data)
+	if err != nil {
+		return "", err
+	}
+	body = reactions.Append(body, counts)
+	return marker.Embed("", body, marker.Marker{
+		Kind:   marker.KindComment,
+		Source: marker.SourceEMU,
+		ID:     webhook.Comment.GetID(),
+		Org:    data.Org,
+		Repo:   data.Repo,
+		Number: data.Number,
+	}), nil
+}
+
+// rewriteBody prepares the body being mirrored for the GitHub side: references and mentions are
+// translated, and attachments, which cannot be opened from the GitHub side, are re-hosted.
+func (e *EMU) rewriteBody(ctx context.Context, webhook *types.WebHook, data *format.Data) {
+	e.rewriteReferences(ctx, data)
+	if e.Attachments == nil {
+		return
+	}
+	itr, err := e.retrieveInstallationTransport(ctx, webhook, data.Org)
+	if err != nil {
+		e.Logger.Warnf("Unable to authenticate attachment downloads for %s: %v", data.Org, err)
+		return
+	}
+	data.Body = e.Attachments.Rewrite(ctx, itr, data.Body)
+}
+
+// retrieveInstallationTransport authenticates as the client app's installation on the webhook's
+// organization. Webhooks synthesised by background jobs carry no installation, so it is looked up.
+func (e *EMU) retrieveInstallationTransport(ctx context.Context, webhook *types.WebHook, org string) (*ghinstallation.Transport, error) {
+	id := webhook.Installation.GetID()
+	if id == 0 {
+		apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+		defer cancel()
+		installation, _, err := e.Client.Apps.FindOrganizationInstallation(apiCtx, org)
+		if err != nil {
+			return nil, err
+		}
+		id = installation.GetID()
+	}
+	installation, err := retrieveInstallation(ctx, e.DBClient, e.Config, e.Transport, id)
+	if err != nil {
+		return nil, err
+	}
+	return installation.transport, nil
+}
+
+func (e *EMU) deleteIssue(ctx context.Context, webhook *types.WebHook) error {
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(ctx, webhook)
 	if err != nil {
 		return err
 	}
@@ -131,14 +243,18 @@ func (e *EMU) deleteIssue(webhook *types.WebHook) error {
 		} `graphql:"deleteIssue(input: $input)"`
 	}
 
-	issue, _, err := e.GitHubClient.Issues.Get(context.Background(), e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber)
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	issue, _, err := e.GitHubClient.Issues.Get(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber)
 	if err != nil {
 		return err
 	}
 	input := githubv4.DeleteIssueInput{
 		IssueID: issue.GetNodeID(),
 	}
-	err = e.GraphQLClient.Mutate(context.Background(), &mutation, input, nil)
+	gqlCtx, gqlCancel := withTimeout(ctx, e.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	err = e.GraphQLClient.Mutate(gqlCtx, &mutation, input, nil)
 	if err != nil {
 		return err
 	}
@@ -146,44 +262,81 @@ func (e *EMU) deleteIssue(webhook *types.WebHook) error {
 	return nil
 }
 
-func (e *EMU) updateIssueState(webhook *types.WebHook) error {
-	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(webhook)
+func (e *EMU) updateIssueState(ctx context.Context, webhook *types.WebHook) error {
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	changed, err := syncIssueState(ctx, e.GitHubClient, e.Config.Timeouts.GitHub, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, webhook.Issue.GetState(), webhook.StateReason)
 	if err != nil {
 		return err
 	}
-	_, _, err = e.GitHubClient.Issues.Edit(context.Background(), e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueRequest{
-		State: webhook.Issue.State,
-	})
 
-	return err
+	// A mirror already closed as a duplicate was cross-linked by whichever side closed it first.
+	if !changed || webhook.StateReason != stateReasonDuplicate {
+		return nil
+	}
+	return e.linkDuplicate(ctx, webhook, githubIssueNumber)
+}
+
+// linkDuplicate marks the mirror of an issue closed as a duplicate as a duplicate of the mirror of
+// the canonical issue, when the canonical issue is mirrored too.
+func (e *EMU) linkDuplicate(ctx context.Context, webhook *types.WebHook, githubIssueNumber int) error {
+	org, repo := webhook.Repository.Owner.GetLogin(), webhook.Repository.GetName()
+	itr, err := e.retrieveInstallationTransport(ctx, webhook, org)
+	if err != nil {
+		return err
+	}
+	canonicalOrg, canonicalRepo, canonicalNumber, ok, err := canonicalIssue(ctx, ghclient.NewGraphQL(e.Config.Apps.Client, itr), e.Config.Timeouts.GraphQL, org, repo, webhook.Issue.GetNumber())
+	if err != nil || !ok {
+		return err
+	}
+	syncedNumber, ok, err := e.DBClient.GetSyncedNumber(ctx, canonicalOrg, canonicalRepo, canonicalNumber)
+	if err != nil || !ok {
+		return err
+	}
+	return postDuplicateNotice(ctx, e.GitHubClient, e.Config.Timeouts.GitHub, marker.SourceEMU, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, fmt.Sprintf("#%d", syncedNumber))
 }
 
-func (e *EMU) HandleIssueComment(webhook *types.WebHook) error {
+func (e *EMU) HandleIssueComment(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandleIssueComment", webhook)
+	defer func() { endSpan(span, err) }()
+
 	switch webhook.Action {
-	case "created":
-		id, err := e.createComment(webhook)
-		if err != nil {
+	case "edited":
+		stale, err := staleComment(ctx, e.DBClient, e.Logger, webhook.Comment.GetID(), webhook.Comment.GetUpdatedAt(), webhook.DeliveryID)
+		if err != nil || stale {
 			return err
 		}
-		err = e.DBClient.InsertCommentEntry(webhook, id)
+	}
+
+	switch webhook.Action {
+	case "created":
+		if webhook.Issue.IsPullRequest() {
+			return e.createPullRequestComment(ctx, webhook)
+		}
+		op := &db.Operation{Kind: db.OperationComment, SourceID: webhook.Comment.GetID(), ParentID: webhook.Issue.GetID(), Webhook: webhook}
+		err := mirrorCreate(ctx, e.DBClient, op, func() (int64, error) {
+			return e.createComment(ctx, webhook)
+		})
 		if err != nil {
 			return err
 		}
 	case "edited":
-		err := e.editComment(webhook)
+		err := e.editComment(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = e.DBClient.UpdateCommentEntry(webhook)
+		err = e.DBClient.UpdateCommentEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
 	case "deleted":
-		err := e.deleteComment(webhook)
+		err := e.deleteComment(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = e.DBClient.DeleteCommentEntry(webhook)
+		err = e.DBClient.DeleteCommentEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
@@ -191,17 +344,19 @@ func (e *EMU) HandleIssueComment(webhook *types.WebHook) error {
 	return nil
 }
 
-func (e *EMU) createComment(webhook *types.WebHook) (int64, error) {
-	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(webhook)
+func (e *EMU) createComment(ctx context.Context, webhook *types.WebHook) (int64, error) {
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(ctx, webhook)
+	if err != nil {
+		return -1, err
+	}
+	newBody, err := e.formatComment(ctx, webhook, nil)
 	if err != nil {
 		return -1, err
 	}
-	author := webhook.Comment.User.GetLogin()
-	body := webhook.Comment.GetBody()
-
-	newBody := fmt.Sprintf("@%s posted:\n\n%s", author, body)
 
-	comment, _, err := e.GitHubClient.Issues.CreateComment(context.Background(), e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueComment{
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	comment, _, err := e.GitHubClient.Issues.CreateComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueComment{
 		Body: &newBody,
 	})
 	if err != nil {
@@ -210,16 +365,22 @@ func (e *EMU) createComment(webhook *types.WebHook) (int64, error) {
 	return comment.GetID(), nil
 }
 
-func (e *EMU) editComment(webhook *types.WebHook) error {
-	githubIssueNumber, err := e.DBClient.GetGitHubCommentIDEntry(webhook)
+func (e *EMU) editComment(ctx context.Context, webhook *types.WebHook) error {
+	githubIssueNumber, err := e.DBClient.GetGitHubCommentIDEntry(ctx, webhook)
 	if err != nil {
 		return err
 	}
-	author := webhook.Comment.User.GetLogin()
-	body := webhook.Comment.GetBody()
-
-	newBody := fmt.Sprintf("@%s posted:\n\n%s", author, body)
-	_, _, err = e.GitHubClient.Issues.EditComment(context.Background(), e.Config.Repo.Org, e.Config.Repo.Name, int64(githubIssueNumber), &github.IssueComment{
+	counts, err := e.DBClient.GetCommentReactions(ctx, webhook.Comment.GetID())
+	if err != nil {
+		return err
+	}
+	newBody, err := e.formatComment(ctx, webhook, counts)
+	if err != nil {
+		return err
+	}
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	_, _, err = e.GitHubClient.Issues.EditComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, int64(githubIssueNumber), &github.IssueComment{
 		Body: &newBody,
 	})
 	if err != nil {
@@ -228,13 +389,15 @@ func (e *EMU) editComment(webhook *types.WebHook) error {
 	return nil
 }
 
-func (e *EMU) deleteComment(webhook *types.WebHook) error {
-	githubIssueNumber, err := e.DBClient.GetGitHubCommentIDEntry(webhook)
+func (e *EMU) deleteComment(ctx context.Context, webhook *types.WebHook) error {
+	githubIssueNumber, err := e.DBClient.GetGitHubCommentIDEntry(ctx, webhook)
 	if err != nil {
 		return err
 	}
 
-	_, err = e.GitHubClient.Issues.DeleteComment(context.Background(), e.Config.Repo.Org, e.Config.Repo.Name, int64(githubIssueNumber))
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	_, err = e.GitHubClient.Issues.DeleteComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, int64(githubIssueNumber))
 	if err != nil {
 		return err
 	}
@@ -2,13 +2,15 @@ package handlers
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"net/http"
 
-	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v41/github"
 	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/format"
+	"github.com/lindluni/github-issue-sync/pkg/ghclient"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/reactions"
 	"github.com/lindluni/github-issue-sync/pkg/types"
 	"github.com/shurcooL/githubv4"
 	"github.com/sirupsen/logrus"
@@ -20,35 +22,49 @@ type GitHub struct {
 	GitHubClient  *github.Client
 	GraphQLClient *githubv4.Client
 
-	Config *types.Config
+	// Transport is the base transport of the clients created for client app installations.
+	Transport http.RoundTripper
+
+	Config    *types.Config
+	Formatter *format.Formatter
 
 	Logger *logrus.Logger
 }
 
-var installationClients = make(map[string]*github.Client)
+func (g *GitHub) HandleIssue(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "GitHub.HandleIssue", webhook)
+	defer func() { endSpan(span, err) }()
 
-func (g *GitHub) HandleIssue(webhook *types.WebHook) error {
+	// Mirrors have no mapping of their own, so events on them are ordered against the watermark of
+	// the EMU issue they mirror.
+	var sourceID int64
 	switch webhook.Action {
-	case "edited":
-		err := g.editIssue(webhook)
+	case "edited", "closed", "reopened":
+		sourceID, _, _, _, err = g.DBClient.GetEMUIssueIDFromGitHubCommentEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
-	case "closed":
-		err := g.updateIssueState(webhook)
-		if err != nil {
+		stale, err := staleIssue(ctx, g.DBClient, g.Logger, sourceID, webhook.Issue.GetUpdatedAt(), webhook.DeliveryID)
+		if err != nil || stale {
 			return err
 		}
-		err = g.DBClient.UpdateIssueEntry(webhook)
+	}
+
+	switch webhook.Action {
+	case "edited":
+		err := g.editIssue(ctx, webhook)
 		if err != nil {
 			return err
 		}
-	case "reopened":
-		err := g.updateIssueState(webhook)
+		return g.DBClient.AdvanceIssueWatermark(ctx, sourceID, webhook.Issue.GetUpdatedAt(), webhook.DeliveryID)
+	case "closed", "reopened":
+		err := g.updateIssueState(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = g.DBClient.UpdateIssueEntry(webhook)
+		return g.DBClient.AdvanceIssueWatermark(ctx, sourceID, webhook.Issue.GetUpdatedAt(), webhook.DeliveryID)
+	case "locked", "unlocked":
+		err := g.updateIssueLock(ctx, webhook)
 		if err != nil {
 			return err
 		}
@@ -56,22 +72,33 @@ func (g *GitHub) HandleIssue(webhook *types.WebHook) error {
 	return nil
 }
 
-func (g *GitHub) editIssue(webhook *types.WebHook) error {
+func (g *GitHub) editIssue(ctx context.Context, webhook *types.WebHook) error {
+	if webhook.Changes == nil {
+		// Edits seen by polling carry no changes, so there is nothing known to revert.
+		g.Logger.Debugf("Skipping edit of mirror %d without changes", webhook.Issue.GetNumber())
+		return nil
+	}
 	if webhook.Changes.Title != nil && webhook.Changes.Body != nil {
-		_, _, err := g.GitHubClient.Issues.Edit(context.Background(), g.Config.Repo.Org, g.Config.Repo.Name, webhook.Issue.GetNumber(), &github.IssueRequest{
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		defer cancel()
+		_, _, err := g.GitHubClient.Issues.Edit(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, webhook.Issue.GetNumber(), &github.IssueRequest{
 			Title: webhook.Changes.GetTitle().From,
 			Body:  webhook.Changes.GetBody().From,
 		})
 		return err
 	}
 	if webhook.Changes.Title != nil && webhook.Changes.Body == nil {
-		_, _, err := g.GitHubClient.Issues.Edit(context.Background(), g.Config.Repo.Org, g.Config.Repo.Name, webhook.Issue.GetNumber(), &github.IssueRequest{
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		defer cancel()
+		_, _, err := g.GitHubClient.Issues.Edit(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, webhook.Issue.GetNumber(), &github.IssueRequest{
 			Title: webhook.Changes.GetTitle().From,
 		})
 		return err
 	}
 	if webhook.Changes.Title == nil && webhook.Changes.Body != nil {
-		_, _, err := g.GitHubClient.Issues.Edit(context.Background(), g.Config.Repo.Org, g.Config.Repo.Name, webhook.Issue.GetNumber(), &github.IssueRequest{
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		defer cancel()
+		_, _, err := g.GitHubClient.Issues.Edit(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, webhook.Issue.GetNumber(), &github.IssueRequest{
 			Body: webhook.Changes.GetBody().From,
 		})
 		return err
@@ -79,47 +106,88 @@ func (g *GitHub) editIssue(webhook *types.WebHook) error {
 	return fmt.Errorf("unable to evaluate issue edit")
 }
 
-func (g *GitHub) updateIssueState(webhook *types.WebHook) error {
-	org, repo, issueNumber, err := g.DBClient.GetEMUIssue(webhook)
+func (g *GitHub) updateIssueState(ctx context.Context, webhook *types.WebHook) error {
+	org, repo, issueNumber, err := g.DBClient.GetEMUIssue(ctx, webhook)
 	if err != nil {
 		return err
 	}
-	client, err := g.retrieveInstallationClient(webhook.Installation.GetID())
+	client, err := g.retrieveInstallationClient(ctx, webhook.Installation.GetID())
 	if err != nil {
 		return err
 	}
-	_, _, err = client.Issues.Edit(context.Background(), org, repo, issueNumber, &github.IssueRequest{
-		State: webhook.Issue.State,
-	})
-	return err
+	changed, err := syncIssueState(ctx, client, g.Config.Timeouts.GitHub, org, repo, issueNumber, webhook.Issue.GetState(), webhook.StateReason)
+	if err != nil {
+		return err
+	}
+
+	// An EMU issue already closed as a duplicate was cross-linked by whichever side closed it first.
+	if !changed || webhook.StateReason != stateReasonDuplicate {
+		return nil
+	}
+	return g.linkDuplicate(ctx, client, org, repo, issueNumber, webhook.Issue.GetNumber())
 }
 
-func (g *GitHub) HandleIssueComment(webhook *types.WebHook) error {
+// linkDuplicate marks the EMU issue mirrored by an issue closed as a duplicate as a duplicate of the
+// EMU issue mirrored by the canonical issue, when the canonical issue is a mirror too.
+func (g *GitHub) linkDuplicate(ctx context.Context, client *github.Client, org, repo string, issueNumber, githubIssueNumber int) error {
+	canonicalOrg, canonicalRepo, canonicalNumber, ok, err := canonicalIssue(ctx, g.GraphQLClient, g.Config.Timeouts.GraphQL, g.Config.Repo.Org, g.Config.Repo.Name, githubIssueNumber)
+	if err != nil || !ok {
+		return err
+	}
+	if canonicalOrg != g.Config.Repo.Org || canonicalRepo != g.Config.Repo.Name {
+		return nil
+	}
+	sourceOrg, sourceRepo, sourceNumber, ok, err := g.DBClient.GetSourceNumber(ctx, canonicalNumber)
+	if err != nil || !ok {
+		return err
+	}
+	reference := fmt.Sprintf("%s/%s#%d", sourceOrg, sourceRepo, sourceNumber)
+	if sourceOrg == org && sourceRepo == repo {
+		reference = fmt.Sprintf("#%d", sourceNumber)
+	}
+	return postDuplicateNotice(ctx, client, g.Config.Timeouts.GitHub, marker.SourceGitHub, org, repo, issueNumber, reference)
+}
+
+func (g *GitHub) HandleIssueComment(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "GitHub.HandleIssueComment", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "edited":
+		stale, err := staleComment(ctx, g.DBClient, g.Logger, webhook.Comment.GetID(), webhook.Comment.GetUpdatedAt(), webhook.DeliveryID)
+		if err != nil || stale {
+			return err
+		}
+	}
+
 	switch webhook.Action {
 	case "created":
-		emuIssueID, emuCommentID, err := g.createComment(webhook)
+		emuIssueID, emuOrg, emuRepo, emuIssueNumber, err := g.DBClient.GetEMUIssueIDFromGitHubCommentEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = g.DBClient.InsertGitHubCommentEntry(webhook, emuIssueID, emuCommentID)
+		op := &db.Operation{Kind: db.OperationGitHubComment, SourceID: webhook.Comment.GetID(), ParentID: emuIssueID, Webhook: webhook}
+		err = mirrorCreate(ctx, g.DBClient, op, func() (int64, error) {
+			return g.createComment(ctx, webhook, emuOrg, emuRepo, emuIssueNumber)
+		})
 		if err != nil {
 			return err
 		}
 	case "edited":
-		err := g.editComment(webhook)
+		err := g.editComment(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = g.DBClient.UpdateCommentEntry(webhook)
+		err = g.DBClient.UpdateCommentEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
 	case "deleted":
-		err := g.deleteComment(webhook)
+		err := g.deleteComment(ctx, webhook)
 		if err != nil {
 			return err
 		}
-		err = g.DBClient.DeleteCommentEntry(webhook)
+		err = g.DBClient.DeleteCommentEntry(ctx, webhook)
 		if err != nil {
 			return err
 		}
@@ -127,42 +195,48 @@ func (g *GitHub) HandleIssueComment(webhook *types.WebHook) error {
 	return nil
 }
 
-func (g *GitHub) createComment(webhook *types.WebHook) (int64, int64, error) {
-	emuIssueID, emuOrg, emuRepo, emuIssueNumber, err := g.DBClient.GetEMUIssueIDFromGitHubCommentEntry(webhook)
+func (g *GitHub) createComment(ctx context.Context, webhook *types.WebHook, emuOrg, emuRepo string, emuIssueNumber int) (int64, error) {
+	newBody, err := g.formatComment(ctx, webhook, nil)
 	if err != nil {
-		return -1, -1, err
+		return -1, err
 	}
-	author := webhook.Comment.User.GetLogin()
-	body := webhook.Comment.GetBody()
 
-	newBody := fmt.Sprintf("@%s posted:\n\n%s", author, body)
-	client, err := g.retrieveInstallationClient(webhook.Installation.GetID())
+	client, err := g.retrieveInstallationClient(ctx, webhook.Installation.GetID())
 	if err != nil {
-		return -1, -1, err
+		return -1, err
 	}
-	comment, _, err := client.Issues.CreateComment(context.Background(), emuOrg, emuRepo, emuIssueNumber, &github.IssueComment{
+	apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+	defer cancel()
+	comment, _, err := client.Issues.CreateComment(apiCtx, emuOrg, emuRepo, emuIssueNumber, &github.IssueComment{
 		Body: &newBody,
 	})
 	if err != nil {
-		return -1, -1, err
+		return -1, err
 	}
-	return emuIssueID, comment.GetID(), nil
+	return comment.GetID(), nil
 }
 
-func (g *GitHub) editComment(webhook *types.WebHook) error {
-	emuOrg, emuRepo, emuIssueNumber, err := g.DBClient.GetEMUCommentIDEntry(webhook)
+func (g *GitHub) editComment(ctx context.Context, webhook *types.WebHook) error {
+	emuOrg, emuRepo, emuIssueNumber, err := g.DBClient.GetEMUCommentIDEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	counts, err := g.DBClient.GetCommentReactions(ctx, webhook.Comment.GetID())
+	if err != nil {
+		return err
+	}
+	newBody, err := g.formatComment(ctx, webhook, counts)
 	if err != nil {
 		return err
 	}
-	author := webhook.Comment.User.GetLogin()
-	body := webhook.Comment.GetBody()
-	newBody := fmt.Sprintf("@%s posted:\n\n%s", author, body)
 
-	client, err := g.retrieveInstallationClient(webhook.Installation.GetID())
+	client, err := g.retrieveInstallationClient(ctx, webhook.Installation.GetID())
 	if err != nil {
 		return err
 	}
-	_, _, err = client.Issues.EditComment(context.Background(), emuOrg, emuRepo, emuIssueNumber, &github.IssueComment{
+	apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+	defer cancel()
+	_, _, err = client.Issues.EditComment(apiCtx, emuOrg, emuRepo, emuIssueNumber, &github.IssueComment{
 		Body: &newBody,
 	})
 	if err != nil {
@@ -171,29 +245,85 @@ func (g *GitHub) editComment(webhook *types.WebHook) error {
 	return nil
 }
 
-func (g *GitHub) deleteComment(webhook *types.WebHook) error {
-	emuOrg, emuRepo, emuIssueNumber, err := g.DBClient.GetEMUCommentIDEntry(webhook)
+func (g *GitHub) deleteComment(ctx context.Context, webhook *types.WebHook) error {
+	emuOrg, emuRepo, emuIssueNumber, err := g.DBClient.GetEMUCommentIDEntry(ctx, webhook)
 	if err != nil {
 		return err
 	}
 
-	client, err := g.retrieveInstallationClient(webhook.Installation.GetID())
+	client, err := g.retrieveInstallationClient(ctx, webhook.Installation.GetID())
 	if err != nil {
 		return err
 	}
-	_, err = client.Issues.DeleteComment(context.Background(), emuOrg, emuRepo, emuIssueNumber)
+	apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+	defer cancel()
+	_, err = client.Issues.DeleteComment(apiCtx, emuOrg, emuRepo, emuIssueNumber)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (g *GitHub) retrieveInstallationClient(id int64) (*github.Client, error) {
-	privateKey, err := base64.StdEncoding.DecodeString(g.Config.Apps.Client.PrivateKey)
+func (g *GitHub) formatComment(ctx context.Context, webhook *types.WebHook, counts reactions.Counts) (string, error) {
+	data := format.CommentData(webhook)
+	g.rewriteReferences(ctx, data)
+	body, err := g.Formatter.ReverseCommentBody(data)
+	if err != nil {
+		return "", err
+	}
+	body = reactions.Append(body, counts)
+	return marker.Embed("", body, marker.Marker{
+		Kind:   marker.KindComment,
+		Source: marker.SourceGitHub,
+		ID:     webhook.Comment.GetID(),
+		Org:    g.Config.Repo.Org,
+		Repo:   g.Config.Repo.Name,
+		Number: webhook.Issue.GetNumber(),
+	}), nil
+}
+
+func (g *GitHub) retrieveOrgInstallationClient(ctx context.Context, org string) (*github.Client, error) {
+	id, err := g.findOrgInstallation(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+	return g.retrieveInstallationClient(ctx, id)
+}
+
+func (g *GitHub) retrieveOrgInstallationGraphQLClient(ctx context.Context, org string) (*githubv4.Client, error) {
+	id, err := g.findOrgInstallation(ctx, org)
+	if err != nil {
+		return nil, err
+	}
+	itr, err := g.retrieveInstallationTransport(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return ghclient.NewGraphQL(g.Config.Apps.Client, itr), nil
+}
+
+func (g *GitHub) findOrgInstallation(ctx context.Context, org string) (int64, error) {
+	apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+	defer cancel()
+	installation, _, err := g.Client.Apps.FindOrganizationInstallation(apiCtx, org)
+	if err != nil {
+		return -1, err
+	}
+	return installation.GetID(), nil
+}
+
+func (g *GitHub) retrieveInstallationClient(ctx context.Context, id int64) (*github.Client, error) {
+	installation, err := retrieveInstallation(ctx, g.DBClient, g.Config, g.Transport, id)
+	if err != nil {
+		return nil, err
+	}
+	return installation.client, nil
+}
+
+func (g *GitHub) retrieveInstallationTransport(ctx context.Context, id int64) (http.RoundTripper, error) {
+	installation, err := retrieveInstallation(ctx, g.DBClient, g.Config, g.Transport, id)
 	if err != nil {
 		return nil, err
 	}
-	itr, err := ghinstallation.New(http.DefaultTransport, g.Config.Apps.Client.AppID, id, privateKey)
-	client := github.NewClient(&http.Client{Transport: itr})
-	return client, nil
+	return installation.transport, nil
 }
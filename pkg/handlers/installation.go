@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/ghclient"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// ErrInstallationSuspended is returned when syncing would act through a suspended installation.
+var ErrInstallationSuspended = errors.New("installation is suspended")
+
+// SuspendedError names the suspended installation a delivery would have acted through. It matches
+// ErrInstallationSuspended.
+type SuspendedError struct {
+	InstallationID int64
+}
+
+func (e *SuspendedError) Error() string {
+	return fmt.Sprintf("installation %d: %v", e.InstallationID, ErrInstallationSuspended)
+}
+
+func (e *SuspendedError) Unwrap() error {
+	return ErrInstallationSuspended
+}
+
+// installationClients caches the clients of client app installations by installation id. Each
+// transport caches its own installation token, so reusing them avoids minting a token per request.
+// Suspension is checked before the cache is used, since another replica may have handled the
+// suspend event.
+var (
+	installationClientsMutex sync.Mutex
+	installationClients      = make(map[int64]*installation)
+)
+
+type installation struct {
+	transport *ghinstallation.Transport
+	client    *github.Client
+}
+
+func retrieveInstallation(ctx context.Context, dbClient *db.Manager, config *types.Config, transport http.RoundTripper, id int64) (*installation, error) {
+	suspended, err := dbClient.IsInstallationSuspended(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if suspended {
+		evictInstallation(id)
+		return nil, &SuspendedError{InstallationID: id}
+	}
+
+	installationClientsMutex.Lock()
+	cached, ok := installationClients[id]
+	installationClientsMutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	privateKey, err := base64.StdEncoding.DecodeString(config.Apps.Client.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	itr, err := ghclient.NewInstallationTransport(config.Apps.Client, transport, id, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ghclient.NewREST(config.Apps.Client, itr)
+	if err != nil {
+		return nil, err
+	}
+
+	installationClientsMutex.Lock()
+	defer installationClientsMutex.Unlock()
+	installationClients[id] = &installation{transport: itr, client: client}
+	return installationClients[id], nil
+}
+
+// InstallationClient returns the REST client of a client app installation.
+func (e *EMU) InstallationClient(ctx context.Context, id int64) (*github.Client, error) {
+	installation, err := retrieveInstallation(ctx, e.DBClient, e.Config, e.Transport, id)
+	if err != nil {
+		return nil, err
+	}
+	return installation.client, nil
+}
+
+func evictInstallation(id int64) {
+	installationClientsMutex.Lock()
+	defer installationClientsMutex.Unlock()
+	delete(installationClients, id)
+}
+
+// HandleInstallation records installations of the client app on EMU organizations. Clients for new
+// and unsuspended installations are created up front; suspended installations are paused until they
+// are unsuspended, when the deliveries parked in the meantime are retried.
+func (e *EMU) HandleInstallation(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandleInstallation", webhook)
+	defer func() { endSpan(span, err) }()
+
+	id := webhook.Installation.GetID()
+	switch webhook.Action {
+	case "created", "new_permissions_accepted":
+		err := e.DBClient.UpsertInstallationEntry(ctx, webhook.Installation, "client")
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.AddInstallationRepositories(ctx, id, webhook.Repositories)
+		if err != nil {
+			return err
+		}
+		_, err = retrieveInstallation(ctx, e.DBClient, e.Config, e.Transport, id)
+		if err != nil {
+			return err
+		}
+		e.Logger.Infof("Installation %d on %s is active", id, webhook.Installation.Account.GetLogin())
+	case "deleted":
+		evictInstallation(id)
+		err := e.DBClient.DeleteInstallationEntry(ctx, id)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.DeleteSuspendedParkedEvents(ctx, id)
+		if err != nil {
+			return err
+		}
+		e.Logger.Infof("Installation %d on %s was removed", id, webhook.Installation.Account.GetLogin())
+	case "suspend":
+		evictInstallation(id)
+		err := e.DBClient.UpsertInstallationEntry(ctx, webhook.Installation, "client")
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.SetInstallationSuspended(ctx, id, true)
+		if err != nil {
+			return err
+		}
+		e.Logger.Warnf("Installation %d on %s is suspended, pausing sync", id, webhook.Installation.Account.GetLogin())
+	case "unsuspend":
+		err := e.DBClient.UpsertInstallationEntry(ctx, webhook.Installation, "client")
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.SetInstallationSuspended(ctx, id, false)
+		if err != nil {
+			return err
+		}
+		_, err = retrieveInstallation(ctx, e.DBClient, e.Config, e.Transport, id)
+		if err != nil {
+			return err
+		}
+		resumed, err := e.DBClient.ResumeParkedEvents(ctx, id, time.Now())
+		if err != nil {
+			return err
+		}
+		e.Logger.Infof("Installation %d on %s is unsuspended, resuming sync and %d deliveries parked while it was suspended", id, webhook.Installation.Account.GetLogin(), resumed)
+	}
+	return nil
+}
+
+// HandleInstallationRepositories records the repositories a client app installation gains or loses.
+func (e *EMU) HandleInstallationRepositories(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandleInstallationRepositories", webhook)
+	defer func() { endSpan(span, err) }()
+
+	return recordInstallationRepositories(ctx, e.DBClient, webhook, "client")
+}
+
+// HandleInstallation records installations of the GitHub app. Its own installation is configured
+// statically, so events are only recorded.
+func (g *GitHub) HandleInstallation(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "GitHub.HandleInstallation", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "deleted":
+		return g.DBClient.DeleteInstallationEntry(ctx, webhook.Installation.GetID())
+	default:
+		err := g.DBClient.UpsertInstallationEntry(ctx, webhook.Installation, "github")
+		if err != nil {
+			return err
+		}
+		return g.DBClient.AddInstallationRepositories(ctx, webhook.Installation.GetID(), webhook.Repositories)
+	}
+}
+
+func (g *GitHub) HandleInstallationRepositories(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "GitHub.HandleInstallationRepositories", webhook)
+	defer func() { endSpan(span, err) }()
+
+	return recordInstallationRepositories(ctx, g.DBClient, webhook, "github")
+}
+
+func recordInstallationRepositories(ctx context.Context, dbClient *db.Manager, webhook *types.WebHook, app string) error {
+	id := webhook.Installation.GetID()
+	err := dbClient.UpsertInstallationEntry(ctx, webhook.Installation, app)
+	if err != nil {
+		return err
+	}
+	err = dbClient.AddInstallationRepositories(ctx, id, webhook.RepositoriesAdded)
+	if err != nil {
+		return err
+	}
+	return dbClient.RemoveInstallationRepositories(ctx, id, webhook.RepositoriesRemoved)
+}
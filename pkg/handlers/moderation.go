@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"github.com/shurcooL/githubv4"
+)
+
+// Moderation directions name the side moderation actions are copied to.
+const (
+	directionToEMU    = "to-emu"
+	directionToGitHub = "to-github"
+	directionBoth     = "both"
+)
+
+func honors(direction, to string) bool {
+	return direction == directionBoth || direction == to
+}
+
+// updateIssueLock copies a lock or unlock of an EMU issue to its mirror.
+func (e *EMU) updateIssueLock(ctx context.Context, webhook *types.WebHook) error {
+	if !honors(e.Config.Moderation.Lock, directionToGitHub) {
+		return nil
+	}
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	return lockIssue(ctx, e.GitHubClient, e.Config, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, webhook.Issue)
+}
+
+// updateIssueLock copies a lock or unlock of a mirrored issue back to the EMU issue.
+func (g *GitHub) updateIssueLock(ctx context.Context, webhook *types.WebHook) error {
+	if !honors(g.Config.Moderation.Lock, directionToEMU) {
+		return nil
+	}
+	org, repo, issueNumber, err := g.DBClient.GetEMUIssue(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	client, err := g.retrieveInstallationClient(ctx, webhook.Installation.GetID())
+	if err != nil {
+		return err
+	}
+	return lockIssue(ctx, client, g.Config, org, repo, issueNumber, webhook.Issue)
+}
+
+// lockIssue locks or unlocks an issue to match issue. An issue already locked the same way is left
+// alone, so locks made by the service do not echo back to the side they came from.
+func lockIssue(ctx context.Context, client *github.Client, config *types.Config, org, repo string, number int, issue *github.Issue) error {
+	apiCtx, cancel := withTimeout(ctx, config.Timeouts.GitHub)
+	current, _, err := client.Issues.Get(apiCtx, org, repo, number)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if current.GetLocked() == issue.GetLocked() && (!issue.GetLocked() || current.GetActiveLockReason() == issue.GetActiveLockReason()) {
+		return nil
+	}
+
+	apiCtx, cancel = withTimeout(ctx, config.Timeouts.GitHub)
+	defer cancel()
+	if !issue.GetLocked() {
+		_, err = client.Issues.Unlock(apiCtx, org, repo, number)
+		return err
+	}
+	_, err = client.Issues.Lock(apiCtx, org, repo, number, &github.LockIssueOptions{
+		LockReason: issue.GetActiveLockReason(),
+	})
+	return err
+}
+
+// minimizedComment is the minimization state of a comment as reported by GraphQL.
+type minimizedComment struct {
+	NodeID    string
+	Minimized bool
+	Reason    string
+}
+
+// SyncMinimized copies comment minimization between the comments of open issues and their mirrors.
+// GitHub delivers no webhooks when a comment is hidden, so the state is polled and compared with the
+// state recorded on the previous run to tell which side changed.
+func (g *GitHub) SyncMinimized(ctx context.Context) error {
+	entries, err := g.DBClient.ListOpenIssueEntries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = g.syncMinimizedIssue(ctx, entry)
+		if err != nil {
+			g.Logger.Warnf("Unable to sync hidden comments for issue %s/%s#%d: %v", entry.Org, entry.Repo, entry.IssueNumber, err)
+		}
+	}
+	return nil
+}
+
+func (g *GitHub) syncMinimizedIssue(ctx context.Context, entry *db.IssueEntry) error {
+	comments, err := g.DBClient.ListCommentEntries(ctx, entry.ID)
+	if err != nil || len(comments) == 0 {
+		return err
+	}
+	emuClient, err := g.retrieveOrgInstallationGraphQLClient(ctx, entry.Org)
+	if err != nil {
+		return err
+	}
+	emuComments, err := g.listMinimized(ctx, emuClient, entry.Org, entry.Repo, entry.IssueNumber)
+	if err != nil {
+		return err
+	}
+	githubComments, err := g.listMinimized(ctx, g.GraphQLClient, g.Config.Repo.Org, g.Config.Repo.Name, entry.SyncedIssueNumber)
+	if err != nil {
+		return err
+	}
+
+	for _, comment := range comments {
+		emuID, githubID := comment.ID, comment.SyncedCommentID
+		if comment.Origin == "github" {
+			emuID, githubID = comment.SyncedCommentID, comment.ID
+		}
+		emuComment, githubComment := emuComments[emuID], githubComments[githubID]
+		if emuComment == nil || githubComment == nil {
+			continue
+		}
+
+		source, mirror := emuComment, githubComment
+		sourceClient, mirrorClient := emuClient, g.GraphQLClient
+		toMirror, toSource := directionToGitHub, directionToEMU
+		if comment.Origin == "github" {
+			source, mirror = githubComment, emuComment
+			sourceClient, mirrorClient = g.GraphQLClient, emuClient
+			toMirror, toSource = directionToEMU, directionToGitHub
+		}
+
+		switch {
+		case source.Minimized != comment.Minimized && honors(g.Config.Moderation.Minimize, toMirror):
+			err = g.setMinimized(ctx, mirrorClient, mirror, source)
+		case mirror.Minimized != comment.SyncedMinimized && honors(g.Config.Moderation.Minimize, toSource):
+			err = g.setMinimized(ctx, sourceClient, source, mirror)
+		}
+		if err != nil {
+			g.Logger.Warnf("Unable to sync hidden state of comment %d: %v", comment.ID, err)
+			continue
+		}
+
+		if comment.Minimized == source.Minimized && comment.SyncedMinimized == mirror.Minimized {
+			continue
+		}
+		comment.Minimized, comment.SyncedMinimized = source.Minimized, mirror.Minimized
+		err = g.DBClient.UpdateCommentMinimized(ctx, comment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMinimized hides or reveals target to match from, updating target in place.
+func (g *GitHub) setMinimized(ctx context.Context, client *githubv4.Client, target, from *minimizedComment) error {
+	if target.Minimized == from.Minimized {
+		return nil
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	if from.Minimized {
+		var mutation struct {
+			MinimizeComment struct {
+				ClientMutationID string
+			} `graphql:"minimizeComment(input: $input)"`
+		}
+		err := client.Mutate(gqlCtx, &mutation, githubv4.MinimizeCommentInput{
+			SubjectID:  githubv4.ID(target.NodeID),
+			Classifier: classifier(from.Reason),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		var mutation struct {
+			UnminimizeComment struct {
+				ClientMutationID string
+			} `graphql:"unminimizeComment(input: $input)"`
+		}
+		err := client.Mutate(gqlCtx, &mutation, githubv4.UnminimizeCommentInput{
+			SubjectID: githubv4.ID(target.NodeID),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	target.Minimized, target.Reason = from.Minimized, from.Reason
+	return nil
+}
+
+// listMinimized returns the minimization state of an issue's comments keyed by database id.
+func (g *GitHub) listMinimized(ctx context.Context, client *githubv4.Client, org, repo string, number int) (map[int64]*minimizedComment, error) {
+	var query struct {
+		Repository struct {
+			Issue struct {
+				Comments struct {
+					Nodes []struct {
+						ID              string
+						DatabaseID      int64
+						IsMinimized     bool
+						MinimizedReason string
+					}
+					PageInfo struct {
+						EndCursor   githubv4.String
+						HasNextPage bool
+					}
+				} `graphql:"comments(first: 100, after: $cursor)"`
+			} `graphql:"issue(number: $number)"`
+		} `graphql:"repository(owner: $owner, name: $name)"`
+	}
+	variables := map[string]interface{}{
+		"owner":  githubv4.String(org),
+		"name":   githubv4.String(repo),
+		"number": githubv4.Int(number),
+		"cursor": (*githubv4.String)(nil),
+	}
+
+	comments := map[int64]*minimizedComment{}
+	for {
+		gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+		err := client.Query(gqlCtx, &query, variables)
+		gqlCancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range query.Repository.Issue.Comments.Nodes {
+			comments[node.DatabaseID] = &minimizedComment{
+				NodeID:    node.ID,
+				Minimized: node.IsMinimized,
+				Reason:    node.MinimizedReason,
+			}
+		}
+		if !query.Repository.Issue.Comments.PageInfo.HasNextPage {
+			return comments, nil
+		}
+		variables["cursor"] = githubv4.NewString(query.Repository.Issue.Comments.PageInfo.EndCursor)
+	}
+}
+
+// classifier converts a minimized reason such as "off-topic" to the classifier that produces it.
+func classifier(reason string) githubv4.ReportedContentClassifiers {
+	if reason == "" {
+		return githubv4.ReportedContentClassifiersOffTopic
+	}
+	return githubv4.ReportedContentClassifiers(strings.ToUpper(strings.ReplaceAll(reason, "-", "_")))
+}
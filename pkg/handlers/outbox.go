@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/shurcooL/githubv4"
+)
+
+const (
+	// operationSkew widens the search for the mirror of an operation to allow for clock skew between
+	// this service and GitHub.
+	operationSkew = time.Minute
+
+	// operationRetention is how long finished operations are kept before they are deleted.
+	operationRetention = 7 * 24 * time.Hour
+)
+
+// mirrorCreate creates a mirror with write, which returns the mirror's id, and stores its mapping.
+// The operation is recorded before the write so that RecoverOperations can finish it when the
+// mapping cannot be stored, rather than leaving a mirror that can never be edited or closed.
+func mirrorCreate(ctx context.Context, dbClient *db.Manager, op *db.Operation, write func() (int64, error)) error {
+	err := dbClient.BeginOperation(ctx, op)
+	if err != nil {
+		return err
+	}
+	// A failed write may still have created the mirror, so the operation is left pending for
+	// recovery to search for it.
+	syncedID, err := write()
+	if err != nil {
+		return err
+	}
+	err = dbClient.MarkOperationApplied(ctx, op, syncedID)
+	if err != nil {
+		return err
+	}
+	err = commitOperation(ctx, dbClient, op)
+	if err != nil {
+		return err
+	}
+	return dbClient.FinishOperation(ctx, op, db.OperationDone)
+}
+
+// commitOperation stores the mapping between an operation's source and the mirror it created.
+func commitOperation(ctx context.Context, dbClient *db.Manager, op *db.Operation) error {
+	switch op.Kind {
+	case db.OperationIssue:
+		return dbClient.InsertIssueEntry(ctx, op.Webhook, int(op.SyncedID))
+	case db.OperationPullRequest:
+		return dbClient.InsertPullRequestEntry(ctx, op.Webhook, int(op.SyncedID))
+	case db.OperationComment:
+		return dbClient.InsertCommentEntry(ctx, op.Webhook, op.SyncedID)
+	case db.OperationPullRequestComment:
+		return dbClient.InsertPullRequestCommentEntry(ctx, op.Webhook, op.ParentID, op.SyncedID)
+	case db.OperationGitHubComment:
+		return dbClient.InsertGitHubCommentEntry(ctx, op.Webhook, op.ParentID, op.SyncedID)
+	case db.OperationDiscussion:
+		return dbClient.InsertDiscussionEntry(ctx, op.Webhook, discussionKindDiscussion, op.SyncedNodeID, int(op.SyncedID))
+	case db.OperationDiscussionIssue:
+		return dbClient.InsertDiscussionEntry(ctx, op.Webhook, discussionKindIssue, op.SyncedNodeID, int(op.SyncedID))
+	case db.OperationDiscussionComment, db.OperationGitHubDiscussionComment:
+		return dbClient.InsertDiscussionCommentEntry(ctx, op.Webhook, op.ParentID, op.SyncedID, op.SyncedNodeID)
+	default:
+		return fmt.Errorf("unknown operation kind: %s", op.Kind)
+	}
+}
+
+// RecoverOperations finishes operations interrupted between creating a mirror and storing its
+// mapping. Operations younger than the webhook timeout may still be in flight and are left alone.
+// A mirror that was created without its mapping is adopted, a mirror duplicated by a redelivery of
+// the same event is deleted, and an operation whose write never reached GitHub is marked failed.
+func (g *GitHub) RecoverOperations(ctx context.Context) error {
+	ops, err := g.DBClient.ListUnfinishedOperations(ctx, time.Now().Add(-g.Config.Timeouts.Webhook))
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		err = g.recoverOperation(ctx, op)
+		if err != nil {
+			g.Logger.Warnf("Unable to recover %s operation %d for source %d: %v", op.Kind, op.ID, op.SourceID, err)
+		}
+	}
+	return g.DBClient.DeleteFinishedOperations(ctx, time.Now().Add(-operationRetention))
+}
+
+// mirror is a mirror found for an operation. Discussions and discussion comments are addressed by node
+// id, so it is carried along with the id the mapping stores.
+type mirror struct {
+	id     int64
+	nodeID string
+}
+
+func (g *GitHub) recoverOperation(ctx context.Context, op *db.Operation) error {
+	var mirrors []mirror
+	if op.State == db.OperationApplied {
+		mirrors = []mirror{{id: op.SyncedID, nodeID: op.SyncedNodeID}}
+	} else {
+		found, err := g.findMirrors(ctx, op)
+		if err != nil {
+			return err
+		}
+		mirrors = found
+	}
+
+	mapped, ok, err := g.DBClient.GetOperationMapping(ctx, op)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if len(mirrors) == 0 {
+			g.Logger.Infof("Operation %d never created a mirror, marking it failed", op.ID)
+			return g.DBClient.FinishOperation(ctx, op, db.OperationFailed)
+		}
+		op.SyncedID, op.SyncedNodeID = mirrors[0].id, mirrors[0].nodeID
+		err = commitOperation(ctx, g.DBClient, op)
+		if err != nil {
+			return err
+		}
+		mapped = op.SyncedID
+		g.Logger.Infof("Recovered mapping of %s %d to mirror %d", op.Kind, op.SourceID, mapped)
+	}
+
+	state := db.OperationDone
+	for _, m := range mirrors {
+		if m.id == mapped {
+			continue
+		}
+		err = g.deleteMirror(ctx, op, m)
+		if err != nil {
+			return err
+		}
+		g.Logger.Infof("Deleted duplicate mirror %d of %s %d", m.id, op.Kind, op.SourceID)
+		state = db.OperationCompensated
+	}
+	return g.DBClient.FinishOperation(ctx, op, state)
+}
+
+// findMirrors returns the mirrors whose markers name an operation's source, searching only items
+// created since the operation began.
+func (g *GitHub) findMirrors(ctx context.Context, op *db.Operation) ([]mirror, error) {
+	since := op.CreatedAt.Add(-operationSkew)
+	switch op.Kind {
+	case db.OperationIssue, db.OperationPullRequest:
+		kind := marker.KindIssue
+		if op.Kind == db.OperationPullRequest {
+			kind = marker.KindPullRequest
+		}
+		return g.findIssueMirrors(ctx, op.SourceID, kind, since)
+	case db.OperationDiscussionIssue:
+		return g.findIssueMirrors(ctx, op.SourceID, marker.KindDiscussion, since)
+	case db.OperationDiscussion:
+		return g.findDiscussionMirrors(ctx, op.SourceID, since)
+	case db.OperationComment, db.OperationPullRequestComment:
+		return g.findCommentMirrors(ctx, g.GitHubClient, g.Config.Repo.Org, g.Config.Repo.Name, 0, op.SourceID, marker.SourceEMU, since)
+	case db.OperationDiscussionComment:
+		kind, nodeID, number, err := g.DBClient.GetSyncedDiscussionEntry(ctx, op.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		if kind == discussionKindIssue {
+			return g.findCommentMirrors(ctx, g.GitHubClient, g.Config.Repo.Org, g.Config.Repo.Name, number, op.SourceID, marker.SourceEMU, since)
+		}
+		return g.findDiscussionCommentMirrors(ctx, g.GraphQLClient, nodeID, op.SourceID, marker.SourceEMU)
+	case db.OperationGitHubComment:
+		_, org, repo, number, err := g.DBClient.GetEMUIssueIDFromGitHubCommentEntry(ctx, op.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		client, err := g.retrieveOrgInstallationClient(ctx, org)
+		if err != nil {
+			return nil, err
+		}
+		return g.findCommentMirrors(ctx, client, org, repo, number, op.SourceID, marker.SourceGitHub, since)
+	case db.OperationGitHubDiscussionComment:
+		_, nodeID, org, err := g.DBClient.GetEMUDiscussionEntry(ctx, op.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		client, err := g.retrieveOrgInstallationGraphQLClient(ctx, org)
+		if err != nil {
+			return nil, err
+		}
+		return g.findDiscussionCommentMirrors(ctx, client, nodeID, op.SourceID, marker.SourceGitHub)
+	default:
+		return nil, fmt.Errorf("unknown operation kind: %s", op.Kind)
+	}
+}
+
+func (g *GitHub) findIssueMirrors(ctx context.Context, sourceID int64, kind string, since time.Time) ([]mirror, error) {
+	var mirrors []mirror
+	opts := &github.IssueListByRepoOptions{
+		State:       "all",
+		Sort:        "created",
+		Direction:   "desc",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		issues, resp, err := g.GitHubClient.Issues.ListByRepo(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, opts)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, issue := range issues {
+			if issue.GetCreatedAt().Before(since) {
+				return mirrors, nil
+			}
+			m, _, ok := marker.Parse(issue.GetBody())
+			if ok && m.Kind == kind && m.Source == marker.SourceEMU && m.ID == sourceID {
+				mirrors = append(mirrors, mirror{id: int64(issue.GetNumber()), nodeID: issue.GetNodeID()})
+			}
+		}
+		if resp.NextPage == 0 {
+			return mirrors, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// findCommentMirrors searches the comments on an issue, or on every issue in the repository when
+// number is zero.
+func (g *GitHub) findCommentMirrors(ctx context.Context, client *github.Client, org, repo string, number int, sourceID int64, source string, since time.Time) ([]mirror, error) {
+	var mirrors []mirror
+	opts := &github.IssueListCommentsOptions{Since: &since, ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		comments, resp, err := client.Issues.ListComments(apiCtx, org, repo, number, opts)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, comment := range comments {
+			m, _, ok := marker.Parse(comment.GetBody())
+			if !ok || m.Source != source || m.ID != sourceID {
+				continue
+			}
+			switch m.Kind {
+			case marker.KindComment, marker.KindReviewComment, marker.KindDiscussionComment:
+				mirrors = append(mirrors, mirror{id: comment.GetID(), nodeID: comment.GetNodeID()})
+			}
+		}
+		if resp.NextPage == 0 {
+			return mirrors, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (g *GitHub) findDiscussionMirrors(ctx context.Context, sourceID int64, since time.Time) ([]mirror, error) {
+	var query struct {
+		Repository struct {
+			Discussions struct {
+				Nodes []struct {
+					ID        string
+					Number    int
+					Body      string
+					CreatedAt githubv4.DateTime
+				}
+				PageInfo struct {
+					EndCursor   githubv4.String
+					HasNextPage bool
+				}
+			} `graphql:"discussions(first: 100, after: $cursor, orderBy: {field: CREATED_AT, direction: DESC})"`
+		} `graphql:"repository(owner: $owner, name: $name)"`
+	}
+	variables := map[string]interface{}{
+		"owner":  githubv4.String(g.Config.Repo.Org),
+		"name":   githubv4.String(g.Config.Repo.Name),
+		"cursor": (*githubv4.String)(nil),
+	}
+
+	var mirrors []mirror
+	for {
+		gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+		err := g.GraphQLClient.Query(gqlCtx, &query, variables)
+		gqlCancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, discussion := range query.Repository.Discussions.Nodes {
+			if discussion.CreatedAt.Before(since) {
+				return mirrors, nil
+			}
+			m, _, ok := marker.Parse(discussion.Body)
+			if ok && m.Kind == marker.KindDiscussion && m.Source == marker.SourceEMU && m.ID == sourceID {
+				mirrors = append(mirrors, mirror{id: int64(discussion.Number), nodeID: discussion.ID})
+			}
+		}
+		if !query.Repository.Discussions.PageInfo.HasNextPage {
+			return mirrors, nil
+		}
+		variables["cursor"] = githubv4.NewString(query.Repository.Discussions.PageInfo.EndCursor)
+	}
+}
+
+// findDiscussionCommentMirrors searches the comments and replies on a discussion. Discussion comments
+// cannot be filtered by creation time, so the whole discussion is searched.
+func (g *GitHub) findDiscussionCommentMirrors(ctx context.Context, client *githubv4.Client, discussionNodeID string, sourceID int64, source string) ([]mirror, error) {
+	type comment struct {
+		ID         string
+		DatabaseID int64
+		Body       string
+	}
+	var query struct {
+		Node struct {
+			Discussion struct {
+				Comments struct {
+					Nodes []struct {
+						ID         string
+						DatabaseID int64
+						Body       string
+						Replies    struct {
+							Nodes []comment
+						} `graphql:"replies(first: 100)"`
+					}
+					PageInfo struct {
+						EndCursor   githubv4.String
+						HasNextPage bool
+					}
+				} `graphql:"comments(first: 100, after: $cursor)"`
+			} `graphql:"... on Discussion"`
+		} `graphql:"node(id: $id)"`
+	}
+	variables := map[string]interface{}{
+		"id":     githubv4.ID(discussionNodeID),
+		"cursor": (*githubv4.String)(nil),
+	}
+
+	var mirrors []mirror
+	match := func(c comment) {
+		m, _, ok := marker.Parse(c.Body)
+		if ok && m.Kind == marker.KindDiscussionComment && m.Source == source && m.ID == sourceID {
+			mirrors = append(mirrors, mirror{id: c.DatabaseID, nodeID: c.ID})
+		}
+	}
+	for {
+		gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+		err := client.Query(gqlCtx, &query, variables)
+		gqlCancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range query.Node.Discussion.Comments.Nodes {
+			match(comment{ID: node.ID, DatabaseID: node.DatabaseID, Body: node.Body})
+			for _, reply := range node.Replies.Nodes {
+				match(reply)
+			}
+		}
+		if !query.Node.Discussion.Comments.PageInfo.HasNextPage {
+			return mirrors, nil
+		}
+		variables["cursor"] = githubv4.NewString(query.Node.Discussion.Comments.PageInfo.EndCursor)
+	}
+}
+
+// deleteMirror deletes a mirror created by an operation that another mirror of the same source has
+// superseded.
+func (g *GitHub) deleteMirror(ctx context.Context, op *db.Operation, m mirror) error {
+	switch op.Kind {
+	case db.OperationIssue, db.OperationPullRequest, db.OperationDiscussionIssue:
+		nodeID := m.nodeID
+		if nodeID == "" {
+			apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+			defer cancel()
+			issue, _, err := g.GitHubClient.Issues.Get(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, int(m.id))
+			if err != nil {
+				return err
+			}
+			nodeID = issue.GetNodeID()
+		}
+		var mutation struct {
+			DeleteIssue struct {
+				Repository struct {
+					ID string
+				}
+			} `graphql:"deleteIssue(input: $input)"`
+		}
+		gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+		defer gqlCancel()
+		return g.GraphQLClient.Mutate(gqlCtx, &mutation, githubv4.DeleteIssueInput{
+			IssueID: githubv4.ID(nodeID),
+		}, nil)
+	case db.OperationDiscussion:
+		var mutation struct {
+			DeleteDiscussion struct {
+				Discussion struct {
+					ID string
+				}
+			} `graphql:"deleteDiscussion(input: $input)"`
+		}
+		gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+		defer gqlCancel()
+		return g.GraphQLClient.Mutate(gqlCtx, &mutation, githubv4.DeleteDiscussionInput{ID: githubv4.ID(m.nodeID)}, nil)
+	case db.OperationComment, db.OperationPullRequestComment:
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		defer cancel()
+		_, err := g.GitHubClient.Issues.DeleteComment(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, m.id)
+		return err
+	case db.OperationDiscussionComment:
+		kind, _, _, err := g.DBClient.GetSyncedDiscussionEntry(ctx, op.Webhook)
+		if err != nil {
+			return err
+		}
+		if kind == discussionKindIssue {
+			apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+			defer cancel()
+			_, err = g.GitHubClient.Issues.DeleteComment(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, m.id)
+			return err
+		}
+		return g.deleteDiscussionCommentMirror(ctx, g.GraphQLClient, m.nodeID)
+	case db.OperationGitHubDiscussionComment:
+		_, _, org, err := g.DBClient.GetEMUDiscussionEntry(ctx, op.Webhook)
+		if err != nil {
+			return err
+		}
+		client, err := g.retrieveOrgInstallationGraphQLClient(ctx, org)
+		if err != nil {
+			return err
+		}
+		return g.deleteDiscussionCommentMirror(ctx, client, m.nodeID)
+	case db.OperationGitHubComment:
+		_, org, repo, _, err := g.DBClient.GetEMUIssueIDFromGitHubCommentEntry(ctx, op.Webhook)
+		if err != nil {
+			return err
+		}
+		client, err := g.retrieveOrgInstallationClient(ctx, org)
+		if err != nil {
+			return err
+		}
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		defer cancel()
+		_, err = client.Issues.DeleteComment(apiCtx, org, repo, m.id)
+		return err
+	default:
+		return fmt.Errorf("unknown operation kind: %s", op.Kind)
+	}
+}
+
+func (g *GitHub) deleteDiscussionCommentMirror(ctx context.Context, client *githubv4.Client, nodeID string) error {
+	var mutation struct {
+		DeleteDiscussionComment struct {
+			Comment struct {
+				ID string
+			}
+		} `graphql:"deleteDiscussionComment(input: $input)"`
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, g.Config.Timeouts.GraphQL)
+	defer gqlCancel()
+	return client.Mutate(gqlCtx, &mutation, githubv4.DeleteDiscussionCommentInput{ID: githubv4.ID(nodeID)}, nil)
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/format"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// HandlePullRequest mirrors an EMU pull request as a tracking issue in the GitHub repository.
+func (e *EMU) HandlePullRequest(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandlePullRequest", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "edited", "synchronize", "closed", "reopened":
+		stale, err := staleIssue(ctx, e.DBClient, e.Logger, webhook.PullRequest.GetID(), webhook.PullRequest.GetUpdatedAt(), webhook.DeliveryID)
+		if err != nil || stale {
+			return err
+		}
+	}
+
+	switch webhook.Action {
+	case "opened":
+		op := &db.Operation{Kind: db.OperationPullRequest, SourceID: webhook.PullRequest.GetID(), Webhook: webhook}
+		err := mirrorCreate(ctx, e.DBClient, op, func() (int64, error) {
+			issue, err := e.openPullRequest(ctx, webhook)
+			return int64(issue.GetNumber()), err
+		})
+		if err != nil {
+			return err
+		}
+	case "edited", "synchronize":
+		err := e.editPullRequest(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.UpdatePullRequestEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	case "closed", "reopened":
+		err := e.updatePullRequestState(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.UpdatePullRequestEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandlePullRequestReviewComment mirrors review comments as comments on the tracking issue.
+func (e *EMU) HandlePullRequestReviewComment(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandlePullRequestReviewComment", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "edited":
+		stale, err := staleComment(ctx, e.DBClient, e.Logger, webhook.Comment.GetID(), webhook.Comment.GetUpdatedAt(), webhook.DeliveryID)
+		if err != nil || stale {
+			return err
+		}
+	}
+
+	switch webhook.Action {
+	case "created":
+		op := &db.Operation{Kind: db.OperationPullRequestComment, SourceID: webhook.Comment.GetID(), ParentID: webhook.PullRequest.GetID(), Webhook: webhook}
+		err := mirrorCreate(ctx, e.DBClient, op, func() (int64, error) {
+			return e.createReviewComment(ctx, webhook)
+		})
+		if err != nil {
+			return err
+		}
+	case "edited":
+		err := e.editReviewComment(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.UpdateCommentEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	case "deleted":
+		err := e.deleteComment(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		err = e.DBClient.DeleteCommentEntry(ctx, webhook)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *EMU) openPullRequest(ctx context.Context, webhook *types.WebHook) (*github.Issue, error) {
+	newTitle, newBody, err := e.formatPullRequest(ctx, webhook)
+	if err != nil {
+		return nil, err
+	}
+
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	issue, _, err := e.GitHubClient.Issues.Create(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, &github.IssueRequest{
+		Title: &newTitle,
+		Body:  &newBody,
+	})
+
+	return issue, err
+}
+
+func (e *EMU) editPullRequest(ctx context.Context, webhook *types.WebHook) error {
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDForPullRequestEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	newTitle, newBody, err := e.formatPullRequest(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	_, _, err = e.GitHubClient.Issues.Edit(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueRequest{
+		Title: &newTitle,
+		Body:  &newBody,
+	})
+
+	return err
+}
+
+// updatePullRequestState closes or reopens the tracking issue, re-rendering the body so a merge is
+// reflected in it.
+func (e *EMU) updatePullRequestState(ctx context.Context, webhook *types.WebHook) error {
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDForPullRequestEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	_, newBody, err := e.formatPullRequest(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	_, _, err = e.GitHubClient.Issues.Edit(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueRequest{
+		Body:  &newBody,
+		State: webhook.PullRequest.State,
+	})
+
+	return err
+}
+
+func (e *EMU) formatPullRequest(ctx context.Context, webhook *types.WebHook) (string, string, error) {
+	data := format.PullRequestData(webhook)
+	e.rewriteBody(ctx, webhook, data)
+	title, err := e.Formatter.IssueTitle(data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := e.Formatter.PullRequestBody(data)
+	if err != nil {
+		return "", "", err
+	}
+	body = marker.Embed(title, body, marker.Marker{
+		Kind:   marker.KindPullRequest,
+		Source: marker.SourceEMU,
+		ID:     webhook.PullRequest.GetID(),
+		Org:    data.Org,
+		Repo:   data.Repo,
+		Number: data.Number,
+	})
+	return title, body, nil
+}
+
+func (e *EMU) createReviewComment(ctx context.Context, webhook *types.WebHook) (int64, error) {
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDForPullRequestEntry(ctx, webhook)
+	if err != nil {
+		return -1, err
+	}
+	newBody, err := e.formatReviewComment(ctx, webhook)
+	if err != nil {
+		return -1, err
+	}
+
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	comment, _, err := e.GitHubClient.Issues.CreateComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueComment{
+		Body: &newBody,
+	})
+	if err != nil {
+		return -1, err
+	}
+	return comment.GetID(), nil
+}
+
+func (e *EMU) editReviewComment(ctx context.Context, webhook *types.WebHook) error {
+	githubCommentID, err := e.DBClient.GetGitHubCommentIDEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	newBody, err := e.formatReviewComment(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	_, _, err = e.GitHubClient.Issues.EditComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, int64(githubCommentID), &github.IssueComment{
+		Body: &newBody,
+	})
+	return err
+}
+
+// formatReviewComment renders a review comment. Replies link to the mirrored parent comment, which
+// lives on the same tracking issue, so the thread can be followed on the GitHub side.
+func (e *EMU) formatReviewComment(ctx context.Context, webhook *types.WebHook) (string, error) {
+	inReplyToURL := ""
+	if parentID := webhook.ReviewComment.GetInReplyTo(); parentID != 0 {
+		syncedParentID, err := e.DBClient.GetSyncedCommentID(ctx, parentID)
+		if err != nil {
+			e.Logger.Warnf("Unable to locate mirrored parent of review comment %d: %v", webhook.Comment.GetID(), err)
+		} else {
+			inReplyToURL = fmt.Sprintf("#issuecomment-%d", syncedParentID)
+		}
+	}
+
+	data := format.ReviewCommentData(webhook, inReplyToURL)
+	e.rewriteBody(ctx, webhook, data)
+	body, err := e.Formatter.ReviewCommentBody(data)
+	if err != nil {
+		return "", err
+	}
+	return marker.Embed("", body, marker.Marker{
+		Kind:   marker.KindReviewComment,
+		Source: marker.SourceEMU,
+		ID:     webhook.Comment.GetID(),
+		Org:    data.Org,
+		Repo:   data.Repo,
+		Number: data.Number,
+	}), nil
+}
+
+// createPullRequestComment mirrors a comment on a pull request's conversation. The issue_comment
+// payload only carries the pull request's issue representation, so the tracking issue is found by
+// the pull request's coordinates.
+func (e *EMU) createPullRequestComment(ctx context.Context, webhook *types.WebHook) error {
+	pullRequestID, githubIssueNumber, err := e.DBClient.GetPullRequestEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	op := &db.Operation{Kind: db.OperationPullRequestComment, SourceID: webhook.Comment.GetID(), ParentID: pullRequestID, Webhook: webhook}
+	return mirrorCreate(ctx, e.DBClient, op, func() (int64, error) {
+		newBody, err := e.formatComment(ctx, webhook, nil)
+		if err != nil {
+			return -1, err
+		}
+
+		apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+		defer cancel()
+		comment, _, err := e.GitHubClient.Issues.CreateComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueComment{
+			Body: &newBody,
+		})
+		return comment.GetID(), err
+	})
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/reactions"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// ReactionSync mirrors reactions between open issues and their comments. GitHub delivers no webhooks
+// for reactions, so they are polled. Reactions on a source item are rendered as a summary line in the
+// mirrored body the service owns; reactions on a mirror are added to the source item by the app.
+type ReactionSync struct {
+	EMU    *EMU
+	GitHub *GitHub
+}
+
+// reactionTarget lists and manages the reactions on a single issue or comment.
+type reactionTarget struct {
+	list   func(ctx context.Context, opts *github.ListOptions) ([]*github.Reaction, *github.Response, error)
+	create func(ctx context.Context, content string) (*github.Reaction, *github.Response, error)
+	remove func(ctx context.Context, id int64) (*github.Response, error)
+}
+
+func issueTarget(client *github.Client, owner, repo string, number int) *reactionTarget {
+	return &reactionTarget{
+		list: func(ctx context.Context, opts *github.ListOptions) ([]*github.Reaction, *github.Response, error) {
+			return client.Reactions.ListIssueReactions(ctx, owner, repo, number, opts)
+		},
+		create: func(ctx context.Context, content string) (*github.Reaction, *github.Response, error) {
+			return client.Reactions.CreateIssueReaction(ctx, owner, repo, number, content)
+		},
+		remove: func(ctx context.Context, id int64) (*github.Response, error) {
+			return client.Reactions.DeleteIssueReaction(ctx, owner, repo, number, id)
+		},
+	}
+}
+
+func commentTarget(client *github.Client, owner, repo string, id int64) *reactionTarget {
+	return &reactionTarget{
+		list: func(ctx context.Context, opts *github.ListOptions) ([]*github.Reaction, *github.Response, error) {
+			return client.Reactions.ListIssueCommentReactions(ctx, owner, repo, id, opts)
+		},
+		create: func(ctx context.Context, content string) (*github.Reaction, *github.Response, error) {
+			return client.Reactions.CreateIssueCommentReaction(ctx, owner, repo, id, content)
+		},
+		remove: func(ctx context.Context, reactionID int64) (*github.Response, error) {
+			return client.Reactions.DeleteIssueCommentReaction(ctx, owner, repo, id, reactionID)
+		},
+	}
+}
+
+// Sync reconciles the reactions of every open issue mapping and its comments. Items that fail are
+// logged and retried on the next run.
+func (r *ReactionSync) Sync(ctx context.Context) error {
+	entries, err := r.GitHub.DBClient.ListOpenIssueEntries(ctx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = r.syncIssue(ctx, entry)
+		if err != nil {
+			r.GitHub.Logger.Warnf("Unable to sync reactions for issue %s/%s#%d: %v", entry.Org, entry.Repo, entry.IssueNumber, err)
+		}
+	}
+	return nil
+}
+
+func (r *ReactionSync) syncIssue(ctx context.Context, entry *db.IssueEntry) error {
+	client, err := r.GitHub.retrieveOrgInstallationClient(ctx, entry.Org)
+	if err != nil {
+		return err
+	}
+	source := issueTarget(client, entry.Org, entry.Repo, entry.IssueNumber)
+	mirror := issueTarget(r.GitHub.GitHubClient, r.GitHub.Config.Repo.Org, r.GitHub.Config.Repo.Name, entry.SyncedIssueNumber)
+
+	counts, err := r.count(ctx, source)
+	if err != nil {
+		return err
+	}
+	if !counts.Equal(entry.Reactions) {
+		previous := entry.Reactions
+		entry.Reactions = counts
+		err = r.GitHub.DBClient.UpdateIssueReactions(ctx, entry)
+		if err != nil {
+			return err
+		}
+		err = r.rerenderIssue(ctx, client, entry)
+		if err != nil {
+			entry.Reactions = previous
+			return r.revert(err, r.GitHub.DBClient.UpdateIssueReactions(ctx, entry))
+		}
+	}
+
+	syncedCounts, err := r.count(ctx, mirror)
+	if err != nil {
+		return err
+	}
+	if !syncedCounts.Equal(entry.SyncedReactions) {
+		// Reactions added before a failure are tracked so the next run does not add them twice.
+		err = r.mirror(ctx, source, syncedCounts, entry.MirroredReactions)
+		if err == nil {
+			entry.SyncedReactions = syncedCounts
+		}
+		updateErr := r.GitHub.DBClient.UpdateIssueReactions(ctx, entry)
+		if err != nil {
+			return err
+		}
+		if updateErr != nil {
+			return updateErr
+		}
+	}
+
+	comments, err := r.GitHub.DBClient.ListCommentEntries(ctx, entry.ID)
+	if err != nil {
+		return err
+	}
+	for _, comment := range comments {
+		err = r.syncComment(ctx, client, entry, comment)
+		if err != nil {
+			r.GitHub.Logger.Warnf("Unable to sync reactions for comment %d: %v", comment.ID, err)
+		}
+	}
+	return nil
+}
+
+func (r *ReactionSync) syncComment(ctx context.Context, client *github.Client, issue *db.IssueEntry, entry *db.CommentEntry) error {
+	emuComment := commentTarget(client, issue.Org, issue.Repo, entry.ID)
+	githubComment := commentTarget(r.GitHub.GitHubClient, r.GitHub.Config.Repo.Org, r.GitHub.Config.Repo.Name, entry.SyncedCommentID)
+	source, mirror := emuComment, githubComment
+	if entry.Origin == "github" {
+		emuComment = commentTarget(client, issue.Org, issue.Repo, entry.SyncedCommentID)
+		githubComment = commentTarget(r.GitHub.GitHubClient, r.GitHub.Config.Repo.Org, r.GitHub.Config.Repo.Name, entry.ID)
+		source, mirror = githubComment, emuComment
+	}
+
+	counts, err := r.count(ctx, source)
+	if err != nil {
+		return err
+	}
+	if !counts.Equal(entry.Reactions) {
+		previous := entry.Reactions
+		entry.Reactions = counts
+		err = r.GitHub.DBClient.UpdateCommentReactions(ctx, entry)
+		if err != nil {
+			return err
+		}
+		err = r.rerenderComment(ctx, client, issue, entry)
+		if err != nil {
+			entry.Reactions = previous
+			return r.revert(err, r.GitHub.DBClient.UpdateCommentReactions(ctx, entry))
+		}
+	}
+
+	syncedCounts, err := r.count(ctx, mirror)
+	if err != nil {
+		return err
+	}
+	if !syncedCounts.Equal(entry.SyncedReactions) {
+		// Reactions added before a failure are tracked so the next run does not add them twice.
+		err = r.mirror(ctx, source, syncedCounts, entry.MirroredReactions)
+		if err == nil {
+			entry.SyncedReactions = syncedCounts
+		}
+		updateErr := r.GitHub.DBClient.UpdateCommentReactions(ctx, entry)
+		if err != nil {
+			return err
+		}
+		if updateErr != nil {
+			return updateErr
+		}
+	}
+	return nil
+}
+
+// rerenderIssue edits the mirrored issue so its summary line reflects the stored source counts.
+func (r *ReactionSync) rerenderIssue(ctx context.Context, client *github.Client, entry *db.IssueEntry) error {
+	apiCtx, cancel := withTimeout(ctx, r.GitHub.Config.Timeouts.GitHub)
+	defer cancel()
+	issue, _, err := client.Issues.Get(apiCtx, entry.Org, entry.Repo, entry.IssueNumber)
+	if err != nil {
+		return err
+	}
+	repo, _, err := client.Repositories.Get(apiCtx, entry.Org, entry.Repo)
+	if err != nil {
+		return err
+	}
+	return r.EMU.editIssue(ctx, &types.WebHook{Issue: issue, Repository: repo})
+}
+
+// rerenderComment edits the mirrored comment so its summary line reflects the stored source counts.
+func (r *ReactionSync) rerenderComment(ctx context.Context, client *github.Client, issue *db.IssueEntry, entry *db.CommentEntry) error {
+	apiCtx, cancel := withTimeout(ctx, r.GitHub.Config.Timeouts.GitHub)
+	defer cancel()
+	if entry.Origin == "github" {
+		comment, _, err := r.GitHub.GitHubClient.Issues.GetComment(apiCtx, r.GitHub.Config.Repo.Org, r.GitHub.Config.Repo.Name, entry.ID)
+		if err != nil {
+			return err
+		}
+		mirroredIssue, _, err := r.GitHub.GitHubClient.Issues.Get(apiCtx, r.GitHub.Config.Repo.Org, r.GitHub.Config.Repo.Name, issue.SyncedIssueNumber)
+		if err != nil {
+			return err
+		}
+		installationID, err := r.GitHub.findOrgInstallation(ctx, issue.Org)
+		if err != nil {
+			return err
+		}
+		return r.GitHub.editComment(ctx, &types.WebHook{
+			Comment:      comment,
+			Issue:        mirroredIssue,
+			Installation: &github.Installation{ID: &installationID},
+		})
+	}
+
+	comment, _, err := client.Issues.GetComment(apiCtx, issue.Org, issue.Repo, entry.ID)
+	if err != nil {
+		return err
+	}
+	sourceIssue, _, err := client.Issues.Get(apiCtx, issue.Org, issue.Repo, issue.IssueNumber)
+	if err != nil {
+		return err
+	}
+	repo, _, err := client.Repositories.Get(apiCtx, issue.Org, issue.Repo)
+	if err != nil {
+		return err
+	}
+	return r.EMU.editComment(ctx, &types.WebHook{Comment: comment, Issue: sourceIssue, Repository: repo})
+}
+
+// mirror adds a reaction to target for each content the mirror has and removes the ones it no longer
+// has. ids tracks the reactions the app added and is updated in place.
+func (r *ReactionSync) mirror(ctx context.Context, target *reactionTarget, counts reactions.Counts, ids reactions.IDs) error {
+	apiCtx, cancel := withTimeout(ctx, r.GitHub.Config.Timeouts.GitHub)
+	defer cancel()
+	for _, content := range reactions.Contents {
+		id, mirrored := ids[content]
+		switch {
+		case counts[content] > 0 && !mirrored:
+			reaction, _, err := target.create(apiCtx, content)
+			if err != nil {
+				return err
+			}
+			ids[content] = reaction.GetID()
+		case counts[content] == 0 && mirrored:
+			_, err := target.remove(apiCtx, id)
+			if err != nil {
+				return err
+			}
+			delete(ids, content)
+		}
+	}
+	return nil
+}
+
+func (r *ReactionSync) count(ctx context.Context, target *reactionTarget) (reactions.Counts, error) {
+	var all []*github.Reaction
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		apiCtx, cancel := withTimeout(ctx, r.GitHub.Config.Timeouts.GitHub)
+		page, resp, err := target.list(apiCtx, opts)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if resp.NextPage == 0 {
+			return reactions.Count(all), nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (r *ReactionSync) revert(err, revertErr error) error {
+	if revertErr != nil {
+		r.GitHub.Logger.Errorf("Unable to restore stored reactions: %v", revertErr)
+	}
+	return err
+}
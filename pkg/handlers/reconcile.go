@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// RecoverMappings rebuilds missing rows in issue_sync.issues and issue_sync.comments from the markers
+// embedded in mirrored issues and comments, and returns the number of rows recovered. Items whose
+// source can no longer be read are logged and skipped.
+func (g *GitHub) RecoverMappings(ctx context.Context) (int, error) {
+	recovered := 0
+	opts := &github.IssueListByRepoOptions{State: "all", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		issues, resp, err := g.GitHubClient.Issues.ListByRepo(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, opts)
+		cancel()
+		if err != nil {
+			return recovered, err
+		}
+		for _, issue := range issues {
+			count, err := g.recoverIssue(ctx, issue)
+			if err != nil {
+				g.Logger.Warnf("Unable to recover mappings for issue #%d: %v", issue.GetNumber(), err)
+			}
+			recovered += count
+		}
+		if resp.NextPage == 0 {
+			return recovered, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (g *GitHub) recoverIssue(ctx context.Context, mirror *github.Issue) (int, error) {
+	m, _, ok := marker.Parse(mirror.GetBody())
+	if !ok || m.Kind != marker.KindIssue || m.Source != marker.SourceEMU {
+		return 0, nil
+	}
+
+	client, err := g.retrieveOrgInstallationClient(ctx, m.Org)
+	if err != nil {
+		return 0, err
+	}
+	apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+	source, _, err := client.Issues.Get(apiCtx, m.Org, m.Repo, m.Number)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	apiCtx, cancel = withTimeout(ctx, g.Config.Timeouts.GitHub)
+	repo, _, err := client.Repositories.Get(apiCtx, m.Org, m.Repo)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	recovered := 0
+	exists, err := g.DBClient.IssueEntryExists(ctx, source.GetID())
+	if err != nil {
+		return recovered, err
+	}
+	if !exists {
+		err = g.DBClient.InsertIssueEntry(ctx, &types.WebHook{Issue: source, Repository: repo}, mirror.GetNumber())
+		if err != nil {
+			return recovered, err
+		}
+		recovered++
+	}
+
+	// Comments mirrored from EMU carry their markers on the GitHub side.
+	mirroredComments, err := g.listComments(ctx, g.GitHubClient, g.Config.Repo.Org, g.Config.Repo.Name, mirror.GetNumber())
+	if err != nil {
+		return recovered, err
+	}
+	for _, comment := range mirroredComments {
+		cm, _, ok := marker.Parse(comment.GetBody())
+		if !ok || cm.Kind != marker.KindComment || cm.Source != marker.SourceEMU {
+			continue
+		}
+		exists, err := g.DBClient.CommentEntryExists(ctx, cm.ID)
+		if err != nil {
+			return recovered, err
+		}
+		if exists {
+			continue
+		}
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		sourceComment, _, err := client.Issues.GetComment(apiCtx, m.Org, m.Repo, cm.ID)
+		cancel()
+		if err != nil {
+			return recovered, err
+		}
+		err = g.DBClient.InsertCommentEntry(ctx, &types.WebHook{Issue: source, Comment: sourceComment}, comment.GetID())
+		if err != nil {
+			return recovered, err
+		}
+		recovered++
+	}
+
+	// Comments mirrored from GitHub carry their markers on the EMU side.
+	reverseComments, err := g.listComments(ctx, client, m.Org, m.Repo, m.Number)
+	if err != nil {
+		return recovered, err
+	}
+	for _, comment := range reverseComments {
+		cm, _, ok := marker.Parse(comment.GetBody())
+		if !ok || cm.Kind != marker.KindComment || cm.Source != marker.SourceGitHub {
+			continue
+		}
+		exists, err := g.DBClient.CommentEntryExists(ctx, cm.ID)
+		if err != nil {
+			return recovered, err
+		}
+		if exists {
+			continue
+		}
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		sourceComment, _, err := g.GitHubClient.Issues.GetComment(apiCtx, g.Config.Repo.Org, g.Config.Repo.Name, cm.ID)
+		cancel()
+		if err != nil {
+			return recovered, err
+		}
+		err = g.DBClient.InsertGitHubCommentEntry(ctx, &types.WebHook{Comment: sourceComment}, source.GetID(), comment.GetID())
+		if err != nil {
+			return recovered, err
+		}
+		recovered++
+	}
+	return recovered, nil
+}
+
+func (g *GitHub) listComments(ctx context.Context, client *github.Client, org, repo string, number int) ([]*github.IssueComment, error) {
+	var comments []*github.IssueComment
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		page, resp, err := client.Issues.ListComments(apiCtx, org, repo, number, opts)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, page...)
+		if resp.NextPage == 0 {
+			return comments, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/lindluni/github-issue-sync/pkg/format"
+	"github.com/lindluni/github-issue-sync/pkg/markdown"
+)
+
+// rewriteReferences points the issue references in a body written on the EMU side at their mirrors,
+// and translates mentions, including the mention of its author, to the users' GitHub logins.
+// References to items that are not mirrored become links back to the EMU, and mentions of unmapped
+// users are neutralized so they notify no one.
+func (e *EMU) rewriteReferences(ctx context.Context, data *format.Data) {
+	rewriter := &markdown.Rewriter{
+		Reference: func(ref markdown.Reference) string {
+			org, repo := ref.Owner, ref.Repo
+			if org == "" {
+				org, repo = data.Org, data.Repo
+			}
+			syncedNumber, ok, err := e.DBClient.GetSyncedNumber(ctx, org, repo, ref.Number)
+			if err != nil {
+				e.Logger.Warnf("Unable to resolve reference %s/%s#%d: %v", org, repo, ref.Number, err)
+			}
+			if ok {
+				return fmt.Sprintf("#%d", syncedNumber)
+			}
+			return issueURL(data.URL, org, repo, ref.Number)
+		},
+		Mention: func(login string) string {
+			return mention(e.Config.Mentions.Users, login)
+		},
+	}
+	data.Body = rewriter.Rewrite(data.Body)
+	data.Mention = mention(e.Config.Mentions.Users, data.Author)
+}
+
+// rewriteReferences is the reverse of EMU.rewriteReferences for bodies written on the GitHub side.
+func (g *GitHub) rewriteReferences(ctx context.Context, data *format.Data) {
+	users := make(map[string]string, len(g.Config.Mentions.Users))
+	for emuLogin, githubLogin := range g.Config.Mentions.Users {
+		users[githubLogin] = emuLogin
+	}
+	rewriter := &markdown.Rewriter{
+		Reference: func(ref markdown.Reference) string {
+			org, repo := ref.Owner, ref.Repo
+			if org == "" {
+				org, repo = g.Config.Repo.Org, g.Config.Repo.Name
+			}
+			if org == g.Config.Repo.Org && repo == g.Config.Repo.Name {
+				sourceOrg, sourceRepo, number, ok, err := g.DBClient.GetSourceNumber(ctx, ref.Number)
+				if err != nil {
+					g.Logger.Warnf("Unable to resolve reference #%d: %v", ref.Number, err)
+				}
+				if ok {
+					return fmt.Sprintf("%s/%s#%d", sourceOrg, sourceRepo, number)
+				}
+			}
+			return issueURL(data.URL, org, repo, ref.Number)
+		},
+		Mention: func(login string) string {
+			return mention(users, login)
+		},
+	}
+	data.Body = rewriter.Rewrite(data.Body)
+	data.Mention = mention(users, data.Author)
+}
+
+func mention(users map[string]string, login string) string {
+	mapped, ok := users[login]
+	if !ok {
+		return markdown.Neutralize("@" + login)
+	}
+	return "@" + mapped
+}
+
+// issueURL links an issue on the same host as pageURL. GitHub redirects issue URLs to pull requests
+// and discussions with the same number.
+func issueURL(pageURL, org, repo string, number int) string {
+	base := "https://github.com"
+	if parsed, err := url.Parse(pageURL); err == nil && parsed.Host != "" {
+		base = parsed.Scheme + "://" + parsed.Host
+	}
+	return fmt.Sprintf("%s/%s/%s/issues/%d", base, org, repo, number)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// HandleRepository keeps mappings pointed at EMU repositories that are renamed or transferred, so
+// changes mirrored back from GitHub reach the repository at its new location.
+func (e *EMU) HandleRepository(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandleRepository", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "renamed", "transferred":
+		err := e.DBClient.RenameRepository(ctx, webhook.Repository, webhook.Previous.Org, webhook.Previous.Repo)
+		if err != nil {
+			return err
+		}
+		e.Logger.Infof("Moved mappings from %s/%s to %s", webhook.Previous.Org, webhook.Previous.Repo, webhook.Repository.GetFullName())
+	}
+	return nil
+}
+
+// HandleOrganization keeps mappings pointed at the repositories of renamed EMU organizations.
+func (e *EMU) HandleOrganization(ctx context.Context, webhook *types.WebHook) (err error) {
+	ctx, span := startSpan(ctx, "EMU.HandleOrganization", webhook)
+	defer func() { endSpan(span, err) }()
+
+	switch webhook.Action {
+	case "renamed":
+		err := e.DBClient.RenameOrganization(ctx, webhook.Previous.Org, webhook.Organization.GetLogin())
+		if err != nil {
+			return err
+		}
+		e.Logger.Infof("Moved mappings from organization %s to %s", webhook.Previous.Org, webhook.Organization.GetLogin())
+	}
+	return nil
+}
+
+// BackfillRepositories records the node ID of the EMU repositories of mappings created before node
+// IDs were recorded, so they are looked up by node ID like the rest. Repositories that can no longer be
+// read are logged and retried on the next run.
+func (g *GitHub) BackfillRepositories(ctx context.Context) error {
+	repositories, err := g.DBClient.ListUnresolvedRepositories(ctx)
+	if err != nil {
+		return err
+	}
+	for _, repository := range repositories {
+		org, repo := repository[0], repository[1]
+		client, err := g.retrieveOrgInstallationClient(ctx, org)
+		if err != nil {
+			g.Logger.Warnf("Unable to resolve the node ID of %s/%s: %v", org, repo, err)
+			continue
+		}
+		apiCtx, cancel := withTimeout(ctx, g.Config.Timeouts.GitHub)
+		resolved, _, err := client.Repositories.Get(apiCtx, org, repo)
+		cancel()
+		if err != nil {
+			g.Logger.Warnf("Unable to resolve the node ID of %s/%s: %v", org, repo, err)
+			continue
+		}
+		err = g.DBClient.BackfillRepository(ctx, resolved, org, repo)
+		if err != nil {
+			return err
+		}
+		g.Logger.Infof("Recorded node ID %s for the mappings of %s/%s", resolved.GetNodeID(), org, repo)
+	}
+	return nil
+}
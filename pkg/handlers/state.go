@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/shurcooL/githubv4"
+)
+
+const stateReasonDuplicate = "duplicate"
+
+// issueStateRequest is an issue edit carrying state_reason, which go-github does not model.
+type issueStateRequest struct {
+	State       string `json:"state"`
+	StateReason string `json:"state_reason,omitempty"`
+}
+
+// editIssueState sets the state of an issue along with the reason it was closed or reopened.
+func editIssueState(ctx context.Context, client *github.Client, org, repo string, number int, state, reason string) error {
+	req, err := client.NewRequest("PATCH", fmt.Sprintf("repos/%s/%s/issues/%d", org, repo, number), &issueStateRequest{
+		State:       state,
+		StateReason: reason,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Do(ctx, req, nil)
+	return err
+}
+
+// issueState returns the state of an issue along with the reason it was closed or reopened.
+func issueState(ctx context.Context, client *github.Client, org, repo string, number int) (string, string, error) {
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%s/%s/issues/%d", org, repo, number), nil)
+	if err != nil {
+		return "", "", err
+	}
+	var state issueStateRequest
+	_, err = client.Do(ctx, req, &state)
+	if err != nil {
+		return "", "", err
+	}
+	return state.State, state.StateReason, nil
+}
+
+// syncIssueState copies a state change to the counterpart of an issue, and reports whether the
+// counterpart changed. A counterpart already in the same state is left alone: the change is either an
+// echo of one made by the service, or was already copied.
+func syncIssueState(ctx context.Context, client *github.Client, timeout time.Duration, org, repo string, number int, state, reason string) (bool, error) {
+	apiCtx, cancel := withTimeout(ctx, timeout)
+	currentState, currentReason, err := issueState(apiCtx, client, org, repo, number)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	if currentState == state && currentReason == reason {
+		return false, nil
+	}
+	apiCtx, cancel = withTimeout(ctx, timeout)
+	defer cancel()
+	return true, editIssueState(apiCtx, client, org, repo, number, state, reason)
+}
+
+// canonicalIssue returns the issue an issue was most recently marked as a duplicate of, and whether
+// it has been marked as one.
+func canonicalIssue(ctx context.Context, client *githubv4.Client, timeout time.Duration, org, repo string, number int) (string, string, int, bool, error) {
+	var query struct {
+		Repository struct {
+			Issue struct {
+				TimelineItems struct {
+					Nodes []struct {
+						MarkedAsDuplicateEvent struct {
+							Canonical struct {
+								Issue struct {
+									Number     int
+									Repository struct {
+										Name  string
+										Owner struct {
+											Login string
+										}
+									}
+								} `graphql:"... on Issue"`
+							}
+						} `graphql:"... on MarkedAsDuplicateEvent"`
+					}
+				} `graphql:"timelineItems(itemTypes: $itemTypes, last: 1)"`
+			} `graphql:"issue(number: $number)"`
+		} `graphql:"repository(owner: $owner, name: $name)"`
+	}
+	variables := map[string]interface{}{
+		"owner":     githubv4.String(org),
+		"name":      githubv4.String(repo),
+		"number":    githubv4.Int(number),
+		"itemTypes": []githubv4.IssueTimelineItemsItemType{githubv4.IssueTimelineItemsItemTypeMarkedAsDuplicateEvent},
+	}
+	gqlCtx, gqlCancel := withTimeout(ctx, timeout)
+	defer gqlCancel()
+	err := client.Query(gqlCtx, &query, variables)
+	if err != nil {
+		return "", "", -1, false, err
+	}
+
+	nodes := query.Repository.Issue.TimelineItems.Nodes
+	if len(nodes) == 0 || nodes[0].MarkedAsDuplicateEvent.Canonical.Issue.Number == 0 {
+		return "", "", -1, false, nil
+	}
+	canonical := nodes[0].MarkedAsDuplicateEvent.Canonical.Issue
+	return canonical.Repository.Owner.Login, canonical.Repository.Name, canonical.Number, true, nil
+}
+
+// postDuplicateNotice comments on an issue to mark it as a duplicate of reference, on behalf of a
+// duplicate closure on the source side. GitHub recognises the "Duplicate of" prefix and links the two
+// issues.
+func postDuplicateNotice(ctx context.Context, client *github.Client, timeout time.Duration, source, org, repo string, number int, reference string) error {
+	body := marker.Embed("", fmt.Sprintf("Duplicate of %s", reference), marker.Marker{
+		Kind:   marker.KindNotice,
+		Source: source,
+		Org:    org,
+		Repo:   repo,
+		Number: number,
+	})
+	apiCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	_, _, err := client.Issues.CreateComment(apiCtx, org, repo, number, &github.IssueComment{
+		Body: &body,
+	})
+	return err
+}
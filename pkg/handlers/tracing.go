@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/lindluni/github-issue-sync/pkg/handlers")
+
+func startSpan(ctx context.Context, name string, webhook *types.WebHook) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("webhook.action", webhook.Action),
+		attribute.String("github.repository", webhook.Repository.GetFullName()),
+		attribute.Int("github.issue.number", webhook.Issue.GetNumber()),
+		attribute.Int64("github.comment.id", webhook.Comment.GetID()),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
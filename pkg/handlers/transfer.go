@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// transferIssue follows an issue transferred to another repository. When the client app is installed
+// on the destination, the mapping moves to the new issue and the mirror is re-rendered to point at it.
+// Otherwise the service will not hear about the issue again, so the mirror is closed with a note and
+// the mapping is dropped.
+func (e *EMU) transferIssue(ctx context.Context, webhook *types.WebHook) error {
+	if webhook.Transfer == nil || webhook.Transfer.Issue == nil || webhook.Transfer.Repository == nil {
+		return fmt.Errorf("transfer event is missing its destination")
+	}
+	githubIssueNumber, err := e.DBClient.GetGitHubIssueIDEntry(ctx, webhook)
+	if err != nil {
+		return err
+	}
+
+	destination := webhook.Transfer.Repository
+	registered, err := e.isRegistered(ctx, destination.Owner.GetLogin(), destination.GetName())
+	if err != nil {
+		return err
+	}
+	// The destination may have delivered its opened event first, in which case the issue is already
+	// mirrored again and the old mirror is redundant.
+	exists, err := e.DBClient.IssueEntryExists(ctx, webhook.Transfer.Issue.GetID())
+	if err != nil {
+		return err
+	}
+	if !registered || exists {
+		err = e.closeTransferred(ctx, githubIssueNumber, fmt.Sprintf("%s#%d", destination.GetFullName(), webhook.Transfer.Issue.GetNumber()), exists)
+		if err != nil {
+			return err
+		}
+		return e.DBClient.DeleteIssueEntry(ctx, webhook)
+	}
+
+	err = e.DBClient.TransferIssueEntry(ctx, webhook.Issue.GetID(), webhook.Transfer.Issue, destination)
+	if err != nil {
+		return err
+	}
+	return e.editIssue(ctx, &types.WebHook{
+		Action:       webhook.Action,
+		Issue:        webhook.Transfer.Issue,
+		Repository:   destination,
+		Installation: webhook.Installation,
+	})
+}
+
+// isRegistered reports whether the client app is installed on a repository, and so receives its
+// webhooks.
+func (e *EMU) isRegistered(ctx context.Context, org, repo string) (bool, error) {
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	_, _, err := e.Client.Apps.FindRepositoryInstallation(apiCtx, org, repo)
+	if err == nil {
+		return true, nil
+	}
+	if errResp, ok := err.(*github.ErrorResponse); ok && errResp.Response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
+}
+
+func (e *EMU) closeTransferred(ctx context.Context, githubIssueNumber int, destination string, mirrored bool) error {
+	note := fmt.Sprintf("This issue was transferred to %s, which is not synchronized, so it is no longer mirrored here.", destination)
+	if mirrored {
+		note = fmt.Sprintf("This issue was transferred to %s, which is mirrored separately.", destination)
+	}
+	body := marker.Embed("", note, marker.Marker{
+		Kind:   marker.KindNotice,
+		Source: marker.SourceEMU,
+		Org:    e.Config.Repo.Org,
+		Repo:   e.Config.Repo.Name,
+		Number: githubIssueNumber,
+	})
+	apiCtx, cancel := withTimeout(ctx, e.Config.Timeouts.GitHub)
+	defer cancel()
+	_, _, err := e.GitHubClient.Issues.CreateComment(apiCtx, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, &github.IssueComment{
+		Body: &body,
+	})
+	if err != nil {
+		return err
+	}
+	return editIssueState(apiCtx, e.GitHubClient, e.Config.Repo.Org, e.Config.Repo.Name, githubIssueNumber, "closed", "not_planned")
+}
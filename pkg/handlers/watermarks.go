@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/sirupsen/logrus"
+)
+
+// staleIssue reports whether an event for an issue or pull request is older than the latest one
+// applied to it, or a redelivery of it. Applying a stale event would revert a newer change, so it is
+// logged and ignored.
+func staleIssue(ctx context.Context, dbClient *db.Manager, logger *logrus.Logger, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	stale, err := dbClient.IsStaleIssueEvent(ctx, id, updatedAt, deliveryID)
+	if stale {
+		logger.Infof("Ignoring stale event for issue %d updated at %s", id, updatedAt)
+	}
+	return stale, err
+}
+
+// staleComment reports whether an event for a comment is older than the latest one applied to it.
+func staleComment(ctx context.Context, dbClient *db.Manager, logger *logrus.Logger, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	stale, err := dbClient.IsStaleCommentEvent(ctx, id, updatedAt, deliveryID)
+	if stale {
+		logger.Infof("Ignoring stale event for comment %d updated at %s", id, updatedAt)
+	}
+	return stale, err
+}
+
+// staleDiscussion reports whether an event for a discussion is older than the latest one applied to it.
+func staleDiscussion(ctx context.Context, dbClient *db.Manager, logger *logrus.Logger, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	stale, err := dbClient.IsStaleDiscussionEvent(ctx, id, updatedAt, deliveryID)
+	if stale {
+		logger.Infof("Ignoring stale event for discussion %d updated at %s", id, updatedAt)
+	}
+	return stale, err
+}
+
+// staleDiscussionComment reports whether an event for a discussion comment is older than the latest
+// one applied to it.
+func staleDiscussionComment(ctx context.Context, dbClient *db.Manager, logger *logrus.Logger, id int64, updatedAt time.Time, deliveryID string) (bool, error) {
+	stale, err := dbClient.IsStaleDiscussionCommentEvent(ctx, id, updatedAt, deliveryID)
+	if stale {
+		logger.Infof("Ignoring stale event for discussion comment %d updated at %s", id, updatedAt)
+	}
+	return stale, err
+}
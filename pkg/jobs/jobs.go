@@ -0,0 +1,51 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Job is a background task run on a fixed interval.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// Runner runs background jobs until its context is cancelled.
+type Runner struct {
+	Jobs   []Job
+	Logger *logrus.Logger
+}
+
+// Add registers a job. Jobs must be added before Start is called.
+func (r *Runner) Add(job Job) {
+	r.Jobs = append(r.Jobs, job)
+}
+
+// Start launches every registered job in its own goroutine. Each job runs once immediately and then
+// on its interval; a run that overlaps the next tick delays it rather than running concurrently.
+func (r *Runner) Start(ctx context.Context) {
+	for _, job := range r.Jobs {
+		go r.run(ctx, job)
+	}
+}
+
+func (r *Runner) run(ctx context.Context, job Job) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		r.Logger.Debugf("Running job: %s", job.Name)
+		err := job.Run(ctx)
+		if err != nil {
+			r.Logger.Errorf("Job %s failed: %v", job.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
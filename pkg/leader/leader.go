@@ -0,0 +1,105 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/sirupsen/logrus"
+)
+
+// Elector campaigns for a lease in the database and runs work only while it holds it, so that work
+// meant to run once runs on a single replica. The lease is renewed every RenewInterval and lasts
+// LeaseDuration, so a replica that stops renewing it is replaced within LeaseDuration.
+type Elector struct {
+	DBClient *db.Manager
+	Logger   *logrus.Logger
+
+	// Name is the lease campaigned for and Identity names this replica as its holder.
+	Name     string
+	Identity string
+
+	LeaseDuration time.Duration
+	RenewInterval time.Duration
+
+	mutex  sync.Mutex
+	leader bool
+}
+
+// IsLeader reports whether this replica currently holds the lease.
+func (e *Elector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.leader
+}
+
+// Run campaigns for the lease until ctx is cancelled. Each time the lease is won, lead is started
+// with a context that is cancelled when the lease is lost. The lease is released on return.
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	ticker := time.NewTicker(e.RenewInterval)
+	defer ticker.Stop()
+
+	var cancel context.CancelFunc
+	var expires time.Time
+	demote := func() {
+		if cancel != nil {
+			cancel()
+			cancel = nil
+		}
+		e.setLeader(false)
+	}
+	defer func() {
+		if e.IsLeader() {
+			demote()
+			err := e.DBClient.ReleaseLease(context.Background(), e.Name, e.Identity)
+			if err != nil {
+				e.Logger.Warnf("Unable to release %s lease: %v", e.Name, err)
+			}
+		}
+	}()
+
+	for {
+		attempted := time.Now()
+		acquired, err := e.DBClient.AcquireLease(ctx, e.Name, e.Identity, e.LeaseDuration)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err != nil && e.IsLeader() && time.Now().Add(e.RenewInterval).Before(expires):
+			// The lease outlives the next attempt, so leadership is kept through a transient failure.
+			e.Logger.Warnf("Unable to renew %s lease: %v", e.Name, err)
+		case err != nil:
+			if e.IsLeader() {
+				e.Logger.Errorf("Stepping down as %s leader: unable to renew lease: %v", e.Name, err)
+				demote()
+			} else {
+				e.Logger.Warnf("Unable to campaign for %s lease: %v", e.Name, err)
+			}
+		case acquired:
+			expires = attempted.Add(e.LeaseDuration)
+			if !e.IsLeader() {
+				e.Logger.Infof("Elected %s leader as %s", e.Name, e.Identity)
+				e.setLeader(true)
+				leadCtx, leadCancel := context.WithCancel(ctx)
+				cancel = leadCancel
+				go lead(leadCtx)
+			}
+		case e.IsLeader():
+			e.Logger.Warnf("Lost %s lease to another replica", e.Name)
+			demote()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.leader = leader
+}
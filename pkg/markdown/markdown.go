@@ -0,0 +1,160 @@
+package markdown
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	fencePattern     = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	referencePattern = regexp.MustCompile(`(^|[\s(\[,;])(?:([A-Za-z0-9][A-Za-z0-9-]*)/([A-Za-z0-9._-]+))?#([0-9]+)\b`)
+	mentionPattern   = regexp.MustCompile(`(^|[^A-Za-z0-9_@/\x60])@([A-Za-z0-9](?:[A-Za-z0-9_-]*[A-Za-z0-9])?(?:/[A-Za-z0-9_.-]+)?)`)
+)
+
+// Reference is an issue reference such as #12 or octo-org/octo-repo#12. Owner and Repo are empty for
+// references to the repository the document belongs to.
+type Reference struct {
+	Owner  string
+	Repo   string
+	Number int
+}
+
+// Rewriter rewrites issue references and @mentions in the prose of a markdown document. Code spans
+// and fenced or indented code blocks are left untouched.
+type Rewriter struct {
+	// Reference returns the text that replaces a reference.
+	Reference func(ref Reference) string
+	// Mention returns the text that replaces a mention of login, which may be an org/team.
+	Mention func(login string) string
+}
+
+// Neutralize renders text as a code span so GitHub neither links nor notifies it.
+func Neutralize(text string) string {
+	return "`" + text + "`"
+}
+
+// Rewrite returns the document with its references and mentions replaced.
+func (r *Rewriter) Rewrite(body string) string {
+	lines := strings.SplitAfter(body, "\n")
+	fence := ""
+	previousBlank := true
+	inIndentedCode := false
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		blank := strings.TrimSpace(trimmed) == ""
+
+		if fence != "" {
+			if strings.HasPrefix(strings.TrimLeft(trimmed, " "), fence) && strings.Trim(strings.TrimSpace(trimmed), fence[:1]) == "" {
+				fence = ""
+			}
+			continue
+		}
+		if match := fencePattern.FindStringSubmatch(trimmed); match != nil {
+			fence = match[1]
+			continue
+		}
+
+		indented := strings.HasPrefix(trimmed, "    ") || strings.HasPrefix(trimmed, "\t")
+		if indented && !blank && (previousBlank || inIndentedCode) {
+			inIndentedCode = true
+			previousBlank = false
+			continue
+		}
+		if !blank {
+			inIndentedCode = false
+		}
+		previousBlank = blank
+
+		lines[i] = r.rewriteLine(line)
+	}
+	return strings.Join(lines, "")
+}
+
+// rewriteLine rewrites the parts of a line that fall outside code spans.
+func (r *Rewriter) rewriteLine(line string) string {
+	var builder strings.Builder
+	for len(line) > 0 {
+		start := strings.Index(line, "`")
+		if start < 0 {
+			builder.WriteString(r.rewriteProse(line))
+			break
+		}
+		run := backtickRun(line[start:])
+		end := closingRun(line[start+len(run):], len(run))
+		if end < 0 {
+			// An unmatched run of backticks is literal text.
+			builder.WriteString(r.rewriteProse(line[:start+len(run)]))
+			line = line[start+len(run):]
+			continue
+		}
+		end += start + len(run) + len(run)
+		builder.WriteString(r.rewriteProse(line[:start]))
+		builder.WriteString(line[start:end])
+		line = line[end:]
+	}
+	return builder.String()
+}
+
+func (r *Rewriter) rewriteProse(text string) string {
+	if r.Reference != nil {
+		text = replace(referencePattern, text, func(groups []string) string {
+			number, err := strconv.Atoi(groups[4])
+			if err != nil {
+				return groups[0]
+			}
+			return groups[1] + r.Reference(Reference{Owner: groups[2], Repo: groups[3], Number: number})
+		})
+	}
+	if r.Mention != nil {
+		text = replace(mentionPattern, text, func(groups []string) string {
+			return groups[1] + r.Mention(groups[2])
+		})
+	}
+	return text
+}
+
+// replace substitutes every match of pattern in text with the result of fn, which receives the
+// match followed by its submatches.
+func replace(pattern *regexp.Regexp, text string, fn func(groups []string) string) string {
+	var builder strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringSubmatchIndex(text, -1) {
+		groups := make([]string, len(match)/2)
+		for i := range groups {
+			if match[2*i] >= 0 {
+				groups[i] = text[match[2*i]:match[2*i+1]]
+			}
+		}
+		builder.WriteString(text[last:match[0]])
+		builder.WriteString(fn(groups))
+		last = match[1]
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
+
+func backtickRun(text string) string {
+	n := 0
+	for n < len(text) && text[n] == '`' {
+		n++
+	}
+	return text[:n]
+}
+
+// closingRun returns the offset of the next run of exactly n backticks in text, or -1.
+func closingRun(text string, n int) int {
+	for offset := 0; offset < len(text); {
+		start := strings.Index(text[offset:], "`")
+		if start < 0 {
+			return -1
+		}
+		start += offset
+		run := backtickRun(text[start:])
+		if len(run) == n {
+			return start
+		}
+		offset = start + len(run)
+	}
+	return -1
+}
@@ -0,0 +1,84 @@
+package marker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+const (
+	KindIssue         = "issue"
+	KindComment       = "comment"
+	KindPullRequest   = "pull_request"
+	KindReviewComment = "review_comment"
+
+	KindDiscussion        = "discussion"
+	KindDiscussionComment = "discussion_comment"
+
+	// KindNotice marks comments the service writes on its own behalf, which mirror nothing.
+	KindNotice = "notice"
+
+	SourceEMU    = "emu"
+	SourceGitHub = "github"
+)
+
+var pattern = regexp.MustCompile(`\n*<!-- github-issue-sync (\{[^\n]*?\}) -->\s*$`)
+
+// Marker is the hidden metadata appended to every body the service writes. It identifies the item the
+// body was mirrored from and carries a hash of the content as written, so the service can recognise its
+// own writes when they are echoed back as webhooks and rebuild mappings from the mirrored items alone.
+type Marker struct {
+	Kind   string `json:"kind"`
+	Source string `json:"source"`
+	ID     int64  `json:"id"`
+	Org    string `json:"org,omitempty"`
+	Repo   string `json:"repo,omitempty"`
+	Number int    `json:"number,omitempty"`
+	Hash   string `json:"hash"`
+}
+
+// Embed appends the marker to body, hashing the title and body exactly as they will be written.
+func Embed(title, body string, m Marker) string {
+	m.Hash = Hash(title, body)
+	bytes, _ := json.Marshal(m)
+	return body + "\n\n<!-- github-issue-sync " + string(bytes) + " -->"
+}
+
+// Parse extracts the marker from body, returning it alongside the body with the marker removed. The
+// boolean is false when the body carries no marker.
+func Parse(body string) (*Marker, string, bool) {
+	match := pattern.FindStringSubmatchIndex(body)
+	if match == nil {
+		return nil, body, false
+	}
+	m := &Marker{}
+	err := json.Unmarshal([]byte(body[match[2]:match[3]]), m)
+	if err != nil {
+		return nil, body, false
+	}
+	return m, body[:match[0]], true
+}
+
+// Strip returns body with any marker removed.
+func Strip(body string) string {
+	_, content, _ := Parse(body)
+	return content
+}
+
+// Hash returns the content hash stored in markers. Comments pass an empty title.
+func Hash(title, body string) string {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	sum := sha256.Sum256([]byte(strings.TrimSpace(title) + "\x00" + strings.TrimSpace(body)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Matches reports whether the title and marked body are unchanged since the marker was written.
+func Matches(title, body string) bool {
+	m, content, ok := Parse(body)
+	if !ok {
+		return false
+	}
+	return m.Hash == Hash(title, content)
+}
@@ -0,0 +1,93 @@
+package marker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	m := Marker{Kind: KindIssue, Source: SourceEMU, ID: 101, Org: "octo", Repo: "repo", Number: 7}
+	tests := []struct {
+		name    string
+		body    string
+		want    *Marker
+		content string
+	}{
+		{
+			name:    "no marker",
+			body:    "Just a body",
+			content: "Just a body",
+		},
+		{
+			name:    "embedded",
+			body:    Embed("Title", "Body", m),
+			want:    &Marker{Kind: KindIssue, Source: SourceEMU, ID: 101, Org: "octo", Repo: "repo", Number: 7, Hash: Hash("Title", "Body")},
+			content: "Body",
+		},
+		{
+			name:    "empty body",
+			body:    Embed("", "", Marker{Kind: KindComment, Source: SourceGitHub}),
+			want:    &Marker{Kind: KindComment, Source: SourceGitHub, Hash: Hash("", "")},
+			content: "",
+		},
+		{
+			name:    "trailing whitespace",
+			body:    Embed("Title", "Body", m) + "\r\n  ",
+			want:    &Marker{Kind: KindIssue, Source: SourceEMU, ID: 101, Org: "octo", Repo: "repo", Number: 7, Hash: Hash("Title", "Body")},
+			content: "Body",
+		},
+		{
+			name:    "not at the end",
+			body:    Embed("Title", "Body", m) + "\n\nA reply quoting the mirror",
+			content: Embed("Title", "Body", m) + "\n\nA reply quoting the mirror",
+		},
+		{
+			name:    "malformed metadata",
+			body:    "Body\n\n<!-- github-issue-sync {\"id\": \"not a number\"} -->",
+			content: "Body\n\n<!-- github-issue-sync {\"id\": \"not a number\"} -->",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, content, ok := Parse(test.body)
+			if ok != (test.want != nil) {
+				t.Fatalf("Parse(%q) found marker %t, want %t", test.body, ok, test.want != nil)
+			}
+			if test.want != nil && *got != *test.want {
+				t.Fatalf("Parse(%q) = %+v, want %+v", test.body, *got, *test.want)
+			}
+			if content != test.content {
+				t.Fatalf("Parse(%q) content = %q, want %q", test.body, content, test.content)
+			}
+			if Strip(test.body) != test.content {
+				t.Fatalf("Strip(%q) = %q, want %q", test.body, Strip(test.body), test.content)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	body := Embed("Title", "Line one\nLine two", Marker{Kind: KindIssue, Source: SourceEMU, ID: 101})
+	tests := []struct {
+		name  string
+		title string
+		body  string
+		want  bool
+	}{
+		{name: "unchanged", title: "Title", body: body, want: true},
+		{name: "surrounding whitespace", title: "  Title ", body: body + "\n", want: true},
+		{name: "line endings", title: "Title", body: strings.ReplaceAll(body, "\n", "\r\n"), want: true},
+		{name: "title edited", title: "Edited title", body: body, want: false},
+		{name: "body edited", title: "Title", body: strings.Replace(body, "Line one", "Line 1", 1), want: false},
+		{name: "marker removed", title: "Title", body: Strip(body), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Matches(test.title, test.body); got != test.want {
+				t.Fatalf("Matches(%q, %q) = %t, want %t", test.title, test.body, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// messageSuffix marks a message waiting to be claimed, and claimedSuffix one being handled.
+	messageSuffix = ".msg"
+	claimedSuffix = ".claimed"
+)
+
+// File queues messages as files in a directory, for receivers and workers sharing a host or volume.
+// Each message is a file named after the time it becomes available, so listing the directory returns
+// messages in order. A worker claims a message by renaming it, which succeeds for only one worker.
+type File struct {
+	Directory string
+	Config    types.Queue
+	Logger    *logrus.Logger
+}
+
+// NewFile returns a file queue, creating its directory if needed.
+func NewFile(config types.Queue, logger *logrus.Logger) (*File, error) {
+	err := os.MkdirAll(config.File.Directory, 0o750)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Directory: config.File.Directory, Config: config, Logger: logger}, nil
+}
+
+func (q *File) Publish(_ context.Context, message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return q.write(data, time.Now())
+}
+
+// write stores a message available at the given time. It is written under a temporary name and
+// renamed into place, so workers never see a partial message.
+func (q *File) write(data []byte, available time.Time) error {
+	id := uuid.NewString()
+	temporary := filepath.Join(q.Directory, "."+id+".tmp")
+	file, err := os.OpenFile(temporary, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, filepath.Join(q.Directory, fmt.Sprintf("%020d-%s%s", available.UnixNano(), id, messageSuffix)))
+}
+
+func (q *File) Consume(ctx context.Context, limit int, handle Handler) error {
+	inFlight := newInFlight(limit)
+	defer inFlight.drain()
+	for inFlight.acquire(ctx) {
+		claimed, err := q.claimNext()
+		if err != nil {
+			q.Logger.Warnf("Unable to consume queued messages: %v", err)
+		}
+		if claimed != "" {
+			q.handle(ctx, inFlight, claimed, handle)
+			continue
+		}
+		inFlight.release()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(q.Config.PollInterval):
+		}
+	}
+	return nil
+}
+
+// claimNext claims the oldest available message, returning the path of the claim or an empty path if
+// there was none.
+func (q *File) claimNext() (string, error) {
+	entries, err := os.ReadDir(q.Directory)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	for _, name := range names {
+		if strings.HasSuffix(name, claimedSuffix) {
+			q.reclaim(name, now)
+			continue
+		}
+		if !strings.HasSuffix(name, messageSuffix) {
+			continue
+		}
+		available, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+		if err != nil || available > now.UnixNano() {
+			continue
+		}
+
+		path := filepath.Join(q.Directory, name)
+		claimed := path + claimedSuffix
+		err = os.Rename(path, claimed)
+		if err != nil {
+			// Another worker claimed it first.
+			continue
+		}
+		// The claim's modification time starts its visibility timeout.
+		err = os.Chtimes(claimed, now, now)
+		if err != nil {
+			return "", err
+		}
+		return claimed, nil
+	}
+	return "", nil
+}
+
+// handle starts handling a claimed message, and settles it once handled: the claim is removed, after
+// queueing the message again for a retry if handling failed.
+func (q *File) handle(ctx context.Context, inFlight *inFlight, claimed string, handle Handler) {
+	data, err := os.ReadFile(claimed)
+	var message *Message
+	if err == nil {
+		err = json.Unmarshal(data, &message)
+		if err != nil {
+			q.Logger.Errorf("Dropping unreadable queued message %s: %v", filepath.Base(claimed), err)
+			err = os.Remove(claimed)
+		}
+	}
+	if message == nil {
+		inFlight.release()
+		if err != nil {
+			// The claim expires after the visibility timeout, so the message is handled again.
+			q.Logger.Warnf("Unable to consume queued messages: %v", err)
+		}
+		return
+	}
+
+	inFlight.settle(handle(ctx, message), func(err error) {
+		if err != nil {
+			q.Logger.Warnf("Retrying queued %s event %s in %s: %v", message.Event, message.DeliveryID, q.Config.RetryDelay, err)
+			err = q.write(data, time.Now().Add(q.Config.RetryDelay))
+		}
+		if err == nil {
+			err = os.Remove(claimed)
+		}
+		if err != nil {
+			// The claim expires after the visibility timeout, so the message is handled again.
+			q.Logger.Warnf("Unable to settle queued message %s: %v", filepath.Base(claimed), err)
+		}
+	})
+}
+
+// reclaim returns a message claimed longer than the visibility timeout ago to the queue, as the worker
+// that claimed it has stopped.
+func (q *File) reclaim(name string, now time.Time) {
+	path := filepath.Join(q.Directory, name)
+	info, err := os.Stat(path)
+	if err != nil || now.Sub(info.ModTime()) < q.Config.VisibilityTimeout {
+		return
+	}
+	err = os.Rename(path, strings.TrimSuffix(path, claimedSuffix))
+	if err == nil {
+		q.Logger.Warnf("Reclaimed queued message %s after its visibility timeout", strings.TrimSuffix(name, claimedSuffix))
+	}
+}
+
+func (q *File) Close() error {
+	return nil
+}
@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// timeout bounds how long a test waits for something that should happen.
+const timeout = 5 * time.Second
+
+func newTestFile(t *testing.T) *File {
+	q, err := NewFile(types.Queue{
+		PollInterval:      5 * time.Millisecond,
+		RetryDelay:        10 * time.Millisecond,
+		VisibilityTimeout: time.Minute,
+		File:              types.QueueFile{Directory: t.TempDir()},
+	}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// consume runs a consumer of q until the returned function is called, which waits for it to stop.
+func consume(t *testing.T, q *File, limit int, handle Handler) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		err := q.Consume(ctx, limit, handle)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// eventually waits for condition to hold.
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// files returns the names of the messages and claims in the queue's directory.
+func files(t *testing.T, q *File) []string {
+	entries, err := os.ReadDir(q.Directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".tmp" {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// recorder is a handler recording the delivery ids it handled, failing with the given outcomes in turn.
+type recorder struct {
+	outcomes []error
+
+	mutex   sync.Mutex
+	handled []string
+}
+
+func (r *recorder) handle(_ context.Context, message *Message) func() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var err error
+	if len(r.handled) < len(r.outcomes) {
+		err = r.outcomes[len(r.handled)]
+	}
+	r.handled = append(r.handled, message.DeliveryID)
+	return func() error { return err }
+}
+
+func (r *recorder) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.handled)
+}
+
+func TestFileSettle(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	tests := []struct {
+		name        string
+		message     []byte
+		outcomes    []error
+		wantHandled int
+	}{
+		{name: "acknowledged", outcomes: []error{nil}, wantHandled: 1},
+		{name: "retried after a failure", outcomes: []error{errHandler, nil}, wantHandled: 2},
+		{name: "retried after repeated failures", outcomes: []error{errHandler, errHandler, nil}, wantHandled: 3},
+		{name: "unreadable message dropped", message: []byte("not json"), wantHandled: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestFile(t)
+			var err error
+			if test.message != nil {
+				err = q.write(test.message, time.Now())
+			} else {
+				err = q.Publish(context.Background(), &Message{Endpoint: "emu", Event: "issues", DeliveryID: "d1", Payload: []byte(`{}`)})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := &recorder{outcomes: test.outcomes}
+			stop := consume(t, q, 1, r.handle)
+			eventually(t, func() bool { return r.count() >= test.wantHandled && len(files(t, q)) == 0 })
+			stop()
+
+			if got := r.count(); got != test.wantHandled {
+				t.Fatalf("message handled %d times, want %d", got, test.wantHandled)
+			}
+		})
+	}
+}
+
+func TestFileReclaim(t *testing.T) {
+	tests := []struct {
+		name        string
+		claimedAgo  time.Duration
+		wantHandled bool
+	}{
+		{name: "claim of a stopped worker", claimedAgo: 2 * time.Minute, wantHandled: true},
+		{name: "claim being handled", claimedAgo: 0, wantHandled: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestFile(t)
+			err := q.Publish(context.Background(), &Message{DeliveryID: "d1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Claim the message as a worker would, and leave it as if the worker stopped.
+			name := files(t, q)[0]
+			claimed := filepath.Join(q.Directory, name+claimedSuffix)
+			err = os.Rename(filepath.Join(q.Directory, name), claimed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claimedAt := time.Now().Add(-test.claimedAgo)
+			err = os.Chtimes(claimed, claimedAt, claimedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := &recorder{}
+			stop := consume(t, q, 1, r.handle)
+			if test.wantHandled {
+				eventually(t, func() bool { return r.count() == 1 && len(files(t, q)) == 0 })
+			} else {
+				time.Sleep(50 * time.Millisecond)
+			}
+			stop()
+
+			if handled := r.count() == 1; handled != test.wantHandled {
+				t.Fatalf("claimed message handled %t, want %t", handled, test.wantHandled)
+			}
+		})
+	}
+}
+
+func TestFileOrder(t *testing.T) {
+	q := newTestFile(t)
+	var want []string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("d%d", i)
+		want = append(want, id)
+		err := q.Publish(context.Background(), &Message{DeliveryID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &recorder{}
+	stop := consume(t, q, 4, r.handle)
+	eventually(t, func() bool { return r.count() == len(want) })
+	stop()
+
+	for i := range want {
+		if r.handled[i] != want[i] {
+			t.Fatalf("messages started in order %v, want %v", r.handled, want)
+		}
+	}
+}
+
+func TestFileLimit(t *testing.T) {
+	const limit = 2
+	q := newTestFile(t)
+	for i := 0; i < 5; i++ {
+		err := q.Publish(context.Background(), &Message{DeliveryID: fmt.Sprintf("d%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	started := 0
+	stop := consume(t, q, limit, func(context.Context, *Message) func() error {
+		mutex.Lock()
+		started++
+		mutex.Unlock()
+		return func() error {
+			<-release
+			return nil
+		}
+	})
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	got := started
+	mutex.Unlock()
+	if got != limit {
+		t.Fatalf("%d messages handled at once, want %d", got, limit)
+	}
+
+	close(release)
+	eventually(t, func() bool { return len(files(t, q)) == 0 })
+	stop()
+}
@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// NATS queues messages on a NATS JetStream stream. Messages are published to the configured subject
+// suffixed with their endpoint, deduplicated by delivery id, and consumed by a durable pull consumer
+// shared by all workers.
+type NATS struct {
+	Config types.Queue
+	Logger *logrus.Logger
+
+	conn *nats.Conn
+	js   nats.JetStreamContext
+}
+
+// NewNATS connects to the broker and creates the stream if it does not exist.
+func NewNATS(config types.Queue, logger *logrus.Logger) (*NATS, error) {
+	conn, err := nats.Connect(config.NATS.URL, nats.Name("github-issue-sync"))
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_, err = js.StreamInfo(config.NATS.Stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:      config.NATS.Stream,
+			Subjects:  []string{config.NATS.Subject + ".>"},
+			Retention: nats.WorkQueuePolicy,
+			Storage:   nats.FileStorage,
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NATS{Config: config, Logger: logger, conn: conn, js: js}, nil
+}
+
+func (q *NATS) Publish(ctx context.Context, message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	opts := []nats.PubOpt{nats.Context(ctx)}
+	if message.DeliveryID != "" {
+		opts = append(opts, nats.MsgId(message.DeliveryID))
+	}
+	_, err = q.js.Publish(q.Config.NATS.Subject+"."+message.Endpoint, data, opts...)
+	return err
+}
+
+func (q *NATS) Consume(ctx context.Context, limit int, handle Handler) error {
+	subscription, err := q.js.PullSubscribe(q.Config.NATS.Subject+".>", q.Config.NATS.Consumer, nats.BindStream(q.Config.NATS.Stream), nats.ManualAck(), nats.AckWait(q.Config.VisibilityTimeout))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The durable consumer outlives the subscription, so other workers keep consuming.
+		err := subscription.Unsubscribe()
+		if err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			q.Logger.Warnf("Unable to unsubscribe from %s: %v", q.Config.NATS.Stream, err)
+		}
+	}()
+
+	inFlight := newInFlight(limit)
+	defer inFlight.drain()
+	for inFlight.acquire(ctx) {
+		messages, err := subscription.Fetch(1, nats.MaxWait(q.Config.PollInterval))
+		if len(messages) == 0 {
+			inFlight.release()
+		}
+		if errors.Is(err, nats.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			q.Logger.Warnf("Unable to fetch queued messages: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(q.Config.PollInterval):
+			}
+			continue
+		}
+		for _, received := range messages {
+			q.handle(ctx, inFlight, received, handle)
+		}
+	}
+	return nil
+}
+
+func (q *NATS) handle(ctx context.Context, inFlight *inFlight, received *nats.Msg, handle Handler) {
+	var message *Message
+	err := json.Unmarshal(received.Data, &message)
+	if err != nil {
+		inFlight.release()
+		q.Logger.Errorf("Dropping unreadable queued message on %s: %v", received.Subject, err)
+		q.settled(received, received.Term())
+		return
+	}
+
+	inFlight.settle(handle(ctx, message), func(err error) {
+		if err != nil {
+			q.Logger.Warnf("Retrying queued %s event %s in %s: %v", message.Event, message.DeliveryID, q.Config.RetryDelay, err)
+			err = received.NakWithDelay(q.Config.RetryDelay)
+		} else {
+			err = received.Ack()
+		}
+		q.settled(received, err)
+	})
+}
+
+func (q *NATS) settled(received *nats.Msg, err error) {
+	if err != nil {
+		// Unacknowledged messages are redelivered after the ack wait, so the message is handled again.
+		q.Logger.Errorf("Unable to settle queued message on %s: %v", received.Subject, err)
+	}
+}
+
+func (q *NATS) Close() error {
+	return q.conn.Drain()
+}
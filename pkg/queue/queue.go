@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Message is a webhook delivery passed from the receivers to the workers.
+type Message struct {
+	Endpoint   string `json:"endpoint"`
+	Event      string `json:"event"`
+	DeliveryID string `json:"delivery_id"`
+	Payload    []byte `json:"payload"`
+}
+
+// Handler starts handling a consumed message and returns a function that waits for the outcome.
+// Consumers start handlers one at a time, in the order messages are claimed, so a handler that takes
+// the message's place in line before returning keeps messages in order while several are handled at
+// once. A message whose handling fails is redelivered after the configured retry delay.
+type Handler func(ctx context.Context, message *Message) (wait func() error)
+
+// Queue carries webhook deliveries from the replicas receiving them to the replicas handling them.
+// Messages are delivered at least once.
+type Queue interface {
+	Publish(ctx context.Context, message *Message) error
+	// Consume claims messages one at a time and handles up to limit of them at once until ctx is
+	// cancelled, then returns once those being handled are settled.
+	Consume(ctx context.Context, limit int, handle Handler) error
+	Close() error
+}
+
+// New returns the queue selected by the configured backend.
+func New(config types.Queue, dbClient *db.Manager, logger *logrus.Logger) (Queue, error) {
+	switch config.Backend {
+	case "sql":
+		return &SQL{DBClient: dbClient, Config: config, Logger: logger}, nil
+	case "file":
+		return NewFile(config, logger)
+	case "nats":
+		return NewNATS(config, logger)
+	default:
+		return nil, fmt.Errorf("unsupported queue backend: %s", config.Backend)
+	}
+}
+
+// inFlight bounds the messages a consumer handles at once, and settles each when its handling ends.
+type inFlight struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newInFlight(limit int) *inFlight {
+	if limit < 1 {
+		limit = 1
+	}
+	return &inFlight{slots: make(chan struct{}, limit)}
+}
+
+// acquire waits for a message to be handled to finish if limit are already being handled, and reports
+// false if ctx ends first.
+func (f *inFlight) acquire(ctx context.Context) bool {
+	select {
+	case f.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot taken by acquire without handling a message.
+func (f *inFlight) release() {
+	<-f.slots
+}
+
+// settle waits for the outcome of a handled message in the background, passes it to fn, and frees the
+// message's slot.
+func (f *inFlight) settle(wait func() error, fn func(err error)) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		defer f.release()
+		fn(wait())
+	}()
+}
+
+// drain waits for the messages being handled to be settled.
+func (f *inFlight) drain() {
+	f.wg.Wait()
+}
@@ -0,0 +1,85 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+	"github.com/sirupsen/logrus"
+)
+
+// SQL queues messages in a table of the service's database, so no broker is needed. Workers poll the
+// table for messages and claim them for the visibility timeout while handling them.
+type SQL struct {
+	DBClient *db.Manager
+	Config   types.Queue
+	Logger   *logrus.Logger
+}
+
+func (q *SQL) Publish(ctx context.Context, message *Message) error {
+	return q.DBClient.EnqueueMessage(ctx, &db.QueuedMessage{
+		Endpoint:   message.Endpoint,
+		Event:      message.Event,
+		DeliveryID: message.DeliveryID,
+		Payload:    message.Payload,
+	})
+}
+
+func (q *SQL) Consume(ctx context.Context, limit int, handle Handler) error {
+	inFlight := newInFlight(limit)
+	defer inFlight.drain()
+	for inFlight.acquire(ctx) {
+		messages, err := q.DBClient.ClaimMessages(ctx, uuid.NewString(), q.Config.VisibilityTimeout, 1)
+		if ctx.Err() != nil {
+			inFlight.release()
+			return nil
+		}
+		if err != nil {
+			q.Logger.Warnf("Unable to claim queued messages: %v", err)
+		}
+		if len(messages) == 0 {
+			inFlight.release()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(q.Config.PollInterval):
+			}
+			continue
+		}
+
+		queued := messages[0]
+		wait := handle(ctx, &Message{
+			Endpoint:   queued.Endpoint,
+			Event:      queued.Event,
+			DeliveryID: queued.DeliveryID,
+			Payload:    queued.Payload,
+		})
+		inFlight.settle(wait, func(err error) {
+			q.settle(queued, err)
+		})
+	}
+	return nil
+}
+
+// settle releases a message for retry or deletes it once handled. Messages in flight are still settled
+// after the consumer's context is cancelled on shutdown, so it runs without it, with each statement
+// bounded by the database timeout.
+func (q *SQL) settle(queued *db.QueuedMessage, err error) {
+	ctx := context.Background()
+	if err != nil {
+		q.Logger.Warnf("Retrying queued %s event %s in %s: %v", queued.Event, queued.DeliveryID, q.Config.RetryDelay, err)
+		err = q.DBClient.ReleaseMessage(ctx, queued, q.Config.RetryDelay)
+	} else {
+		err = q.DBClient.DeleteMessage(ctx, queued)
+	}
+	if err != nil {
+		// The claim expires after the visibility timeout, so the message is handled again.
+		q.Logger.Errorf("Unable to settle queued %s event %s: %v", queued.Event, queued.DeliveryID, err)
+	}
+}
+
+func (q *SQL) Close() error {
+	return nil
+}
@@ -0,0 +1,74 @@
+package reactions
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v41/github"
+)
+
+// Contents lists the reaction contents GitHub supports, in the order they are summarised.
+var Contents = []string{"+1", "-1", "laugh", "hooray", "confused", "heart", "rocket", "eyes"}
+
+var emoji = map[string]string{
+	"+1":       "👍",
+	"-1":       "👎",
+	"laugh":    "😄",
+	"hooray":   "🎉",
+	"confused": "😕",
+	"heart":    "❤️",
+	"rocket":   "🚀",
+	"eyes":     "👀",
+}
+
+// Counts maps reaction content to the number of users who reacted with it.
+type Counts map[string]int
+
+// IDs maps reaction content to the id of the reaction the service added on a user's behalf.
+type IDs map[string]int64
+
+// Count tallies reactions left by users. Reactions left by bots, including the ones this service adds
+// to mirror reactions from the other side, are ignored so they are never mirrored back.
+func Count(reactions []*github.Reaction) Counts {
+	counts := Counts{}
+	for _, reaction := range reactions {
+		if reaction.User.GetType() == "Bot" {
+			continue
+		}
+		counts[reaction.GetContent()]++
+	}
+	return counts
+}
+
+// Equal reports whether two sets of counts are the same, treating missing contents as zero.
+func (c Counts) Equal(other Counts) bool {
+	for _, content := range Contents {
+		if c[content] != other[content] {
+			return false
+		}
+	}
+	return true
+}
+
+// Summary renders the counts as a single markdown line, or an empty string when there are none.
+func (c Counts) Summary() string {
+	var parts []string
+	for _, content := range Contents {
+		if c[content] > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", emoji[content], c[content]))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "**Reactions:** " + strings.Join(parts, " · ")
+}
+
+// Append adds the summary line for the counts to body, if there is one.
+func Append(body string, counts Counts) string {
+	summary := counts.Summary()
+	if summary == "" {
+		return body
+	}
+	return body + "\n\n" + summary
+}
@@ -0,0 +1,135 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted replaces the value of headers that carry secrets.
+const Redacted = "REDACTED"
+
+// queuedKey is the context key MarkQueued sets.
+const queuedKey = "recording.queued"
+
+// redactedHeaders are the headers that carry credentials or values derived from the webhook secret.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"X-Hub-Signature":     true,
+	"X-Hub-Signature-256": true,
+}
+
+// Delivery is a recorded webhook delivery: the request as it was received, with secrets redacted, and
+// the status it was answered with. Queued is set when the delivery was queued for a worker rather than
+// handled, in which case the status only tells whether it was accepted.
+type Delivery struct {
+	RecordedAt time.Time         `json:"recorded_at"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	Status     int               `json:"status"`
+	Queued     bool              `json:"queued,omitempty"`
+}
+
+// Event returns the GitHub event the delivery carries.
+func (d *Delivery) Event() string {
+	return d.Headers["X-Github-Event"]
+}
+
+// ID returns the GitHub delivery id of the delivery.
+func (d *Delivery) ID() string {
+	return d.Headers["X-Github-Delivery"]
+}
+
+// Recorder appends every delivery it sees to a JSONL file, one delivery per line.
+type Recorder struct {
+	Logger *logrus.Logger
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// NewRecorder returns a recorder appending to the file at path, which is created if needed.
+func NewRecorder(path string, logger *logrus.Logger) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Logger: logger, file: file}, nil
+}
+
+// Middleware records each request once it has been handled. The body is read ahead of the handlers
+// and restored for them.
+func (r *Recorder) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		delivery := &Delivery{
+			RecordedAt: time.Now().UTC(),
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.RequestURI(),
+			Headers:    redact(c.Request.Header),
+			Body:       string(body),
+		}
+
+		c.Next()
+
+		delivery.Status = c.Writer.Status()
+		delivery.Queued = c.GetBool(queuedKey)
+		err = r.write(delivery)
+		if err != nil {
+			r.Logger.Errorf("Failed recording delivery %s: %v", delivery.ID(), err)
+		}
+	}
+}
+
+// MarkQueued records that the delivery being handled was queued for a worker.
+func MarkQueued(c *gin.Context) {
+	c.Set(queuedKey, true)
+}
+
+func (r *Recorder) write(delivery *Delivery) error {
+	line, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Close()
+}
+
+// redact flattens the headers, replacing the values of those that carry secrets.
+func redact(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		lower := strings.ToLower(name)
+		if redactedHeaders[name] || strings.Contains(lower, "token") || strings.Contains(lower, "secret") {
+			value = Redacted
+		}
+		headers[name] = value
+	}
+	return headers
+}
@@ -0,0 +1,111 @@
+package recording
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// Replayer feeds recorded deliveries back through a handler, reporting each delivery whose status
+// differs from the recorded one. Deliveries that were queued when recorded were only accepted, not
+// handled, so they are compared on whether they are accepted again.
+type Replayer struct {
+	Handler http.Handler
+	// Speed scales the time between deliveries: 1 replays them as they were recorded, 2 twice as fast.
+	// Zero replays them back to back.
+	Speed float64
+	// DryRun lists the deliveries without handling them.
+	DryRun bool
+	Out    io.Writer
+}
+
+// Summary counts the deliveries replayed, and those answered with a different status than recorded.
+type Summary struct {
+	Replayed   int
+	Mismatched int
+}
+
+// Replay replays the deliveries read from a JSONL recording, in the order they were recorded.
+func (r *Replayer) Replay(ctx context.Context, recording io.Reader) (*Summary, error) {
+	summary := &Summary{}
+	decoder := json.NewDecoder(recording)
+	var previous time.Time
+	for {
+		var delivery *Delivery
+		err := decoder.Decode(&delivery)
+		if errors.Is(err, io.EOF) {
+			return summary, nil
+		}
+		if err != nil {
+			return summary, fmt.Errorf("unable to read delivery %d: %w", summary.Replayed+1, err)
+		}
+
+		if r.Speed > 0 && !previous.IsZero() && delivery.RecordedAt.After(previous) {
+			select {
+			case <-ctx.Done():
+				return summary, ctx.Err()
+			case <-time.After(time.Duration(float64(delivery.RecordedAt.Sub(previous)) / r.Speed)):
+			}
+		}
+		previous = delivery.RecordedAt
+
+		summary.Replayed++
+		recorded := fmt.Sprintf("recorded %d", delivery.Status)
+		if delivery.Queued {
+			recorded += ", queued"
+		}
+		if r.DryRun {
+			fmt.Fprintf(r.Out, "%s %s %s %s %s (%s)\n", delivery.RecordedAt.Format(time.RFC3339), delivery.Path, delivery.Event(), action(delivery), delivery.ID(), recorded)
+			continue
+		}
+		status := r.replay(ctx, delivery)
+		result := "ok"
+		if !matches(delivery, status) {
+			summary.Mismatched++
+			result = "MISMATCH"
+		}
+		fmt.Fprintf(r.Out, "%s %s %s %s %d (%s) %s\n", delivery.Path, delivery.Event(), action(delivery), delivery.ID(), status, recorded, result)
+	}
+}
+
+func (r *Replayer) replay(ctx context.Context, delivery *Delivery) int {
+	req := httptest.NewRequest(delivery.Method, delivery.Path, strings.NewReader(delivery.Body)).WithContext(ctx)
+	for name, value := range delivery.Headers {
+		if value != Redacted {
+			req.Header.Set(name, value)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	r.Handler.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+// matches reports whether a delivery was answered with the same outcome as recorded.
+func matches(delivery *Delivery, status int) bool {
+	if delivery.Queued {
+		return accepted(status) == accepted(delivery.Status)
+	}
+	return status == delivery.Status
+}
+
+func accepted(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// action returns the action of the delivery's payload, if it has one.
+func action(delivery *Delivery) string {
+	var payload struct {
+		Action string `json:"action"`
+	}
+	_ = json.Unmarshal([]byte(delivery.Body), &payload)
+	if payload.Action == "" {
+		return "-"
+	}
+	return payload.Action
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lindluni/github-issue-sync/pkg/drift"
+)
+
+// requireAdminToken rejects requests that do not present the configured admin token as a bearer
+// token.
+func (m *Manager) requireAdminToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(m.Config.Admin.Token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// DoDriftReport scans for drift and responds with the report, as JSON or, with ?format=markdown, as
+// Markdown.
+func (m *Manager) DoDriftReport(c *gin.Context) {
+	format := c.DefaultQuery("format", drift.FormatJSON)
+	if format != drift.FormatJSON && format != drift.FormatMarkdown {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format"})
+		return
+	}
+	report, err := m.GitHubHandler.ScanDrift(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	data, err := report.Render(format)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, drift.ContentType(format), data)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/handlers"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// debounce holds back edits of mirrored EMU issues for the debounce window, so that a burst of edits
+// is mirrored as a single edit carrying the final content. Edits of issues that are not mirrored yet
+// are handled straight away, so they are parked like any other early delivery. Any other event for
+// the issue, such as a close or delete, flushes the held edit first so it is never overtaken. It
+// reports whether the event was held.
+func (m *Manager) debounce(ctx context.Context, key, event string, webhook *types.WebHook, payload []byte) (bool, error) {
+	if m.Config.Debounce.Window <= 0 || event != "issues" || webhook.Issue == nil || isMirror(webhook.Issue.GetBody()) {
+		return false, nil
+	}
+	id := webhook.Issue.GetID()
+	if webhook.Action != "edited" {
+		return false, m.flushEdit(ctx, id)
+	}
+	mirrored, err := m.DBClient.IssueEntryExists(ctx, id)
+	if err != nil || !mirrored {
+		return false, err
+	}
+
+	edit := &db.DebouncedEdit{IssueID: id, Key: key, Payload: payload}
+	err = m.DBClient.DebounceEdit(ctx, edit, webhook.Issue.GetUpdatedAt(), time.Now().Add(m.Config.Debounce.Window))
+	if err != nil {
+		return false, err
+	}
+	m.scheduleFlush(id, key)
+	return true, nil
+}
+
+// scheduleFlush flushes an issue's held edit once the debounce window passes without another edit.
+func (m *Manager) scheduleFlush(id int64, key string) {
+	m.debounceMutex.Lock()
+	defer m.debounceMutex.Unlock()
+	if m.debounceTimers == nil {
+		m.debounceTimers = map[int64]*time.Timer{}
+	}
+	if timer, ok := m.debounceTimers[id]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(m.Config.Debounce.Window, func() {
+		m.debounceMutex.Lock()
+		if m.debounceTimers[id] == timer {
+			delete(m.debounceTimers, id)
+		}
+		m.debounceMutex.Unlock()
+
+		err := m.flushKeyed(context.Background(), id, key)
+		if err != nil {
+			m.Logger.Errorf("Failed flushing debounced edit of issue %d: %v", id, err)
+		}
+	})
+	m.debounceTimers[id] = timer
+}
+
+// flushKeyed flushes an issue's held edit in turn with the other events for the issue.
+func (m *Manager) flushKeyed(ctx context.Context, id int64, key string) error {
+	if m.Config.Timeouts.Webhook > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Config.Timeouts.Webhook)
+		defer cancel()
+	}
+	return m.Executor.Do(ctx, key, func(ctx context.Context) error {
+		return m.flushEdit(ctx, id)
+	})
+}
+
+// flushEdit mirrors the edit held for an issue, if any. An edit that can never be applied, because
+// its payload is unreadable or the issue is no longer mirrored, is dropped, and one acting through a
+// suspended installation is parked until it is unsuspended. The edit stays held if mirroring it fails
+// otherwise, and is retried by the next flush.
+func (m *Manager) flushEdit(ctx context.Context, id int64) error {
+	edit, err := m.DBClient.GetDebouncedEdit(ctx, id)
+	if err != nil || edit == nil {
+		return err
+	}
+	var webhook *types.WebHook
+	err = json.Unmarshal(edit.Payload, &webhook)
+	if err != nil {
+		m.Logger.Errorf("Dropping unreadable debounced edit of issue %d: %v", id, err)
+		return m.DBClient.DeleteDebouncedEdit(ctx, edit)
+	}
+	err = m.EMUHandler.HandleIssue(ctx, webhook)
+	switch {
+	case errors.Is(err, handlers.ErrInstallationSuspended):
+		err = m.parkSuspended(ctx, EndpointEMU, "issues", "", edit.Payload, err)
+	case errors.Is(err, db.ErrNotFound):
+		m.Logger.Infof("Dropping debounced edit of issue %d, which is no longer mirrored: %v", id, err)
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return m.DBClient.DeleteDebouncedEdit(ctx, edit)
+}
+
+// FlushDebounced flushes held edits whose window closed more than a window ago, which are those whose
+// replica stopped before its timer fired.
+func (m *Manager) FlushDebounced(ctx context.Context) error {
+	edits, err := m.DBClient.ListDueDebouncedEdits(ctx, time.Now().Add(-m.Config.Debounce.Window))
+	if err != nil {
+		return err
+	}
+	for _, edit := range edits {
+		err = m.flushKeyed(ctx, edit.IssueID, edit.Key)
+		if err != nil {
+			m.Logger.Warnf("Unable to flush debounced edit of issue %d: %v", edit.IssueID, err)
+		}
+	}
+	return nil
+}
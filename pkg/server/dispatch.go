@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// Endpoints name the webhook endpoint an event is delivered to.
+const (
+	EndpointEMU    = "emu"
+	EndpointGitHub = "github"
+)
+
+var errUnsupportedEvent = errors.New("unsupported event")
+
+// Dispatch parses a webhook payload and passes it to the handler for the endpoint and event it was
+// delivered with. Events caused by this service's own writes are skipped. Events for the same issue
+// are handled one at a time, in the order they are dispatched. deliveryID is the GitHub delivery id of
+// the payload, or empty when it is not known.
+func (m *Manager) Dispatch(ctx context.Context, endpoint, event, deliveryID string, payload []byte) error {
+	key, handle, err := m.route(ctx, endpoint, event, deliveryID, payload)
+	if err != nil {
+		return err
+	}
+	return m.Executor.Do(ctx, key, handle)
+}
+
+// dispatch is Dispatch in the background. The delivery takes its place behind those dispatched
+// earlier for the same issue before dispatch returns, and the outcome is sent on the returned channel.
+func (m *Manager) dispatch(ctx context.Context, endpoint, event, deliveryID string, payload []byte) <-chan error {
+	key, handle, err := m.route(ctx, endpoint, event, deliveryID, payload)
+	if err != nil {
+		done := make(chan error, 1)
+		done <- err
+		return done
+	}
+	return m.Executor.Go(ctx, key, handle)
+}
+
+// route parses a delivery and returns the key it is serialized on along with the function handling it.
+func (m *Manager) route(ctx context.Context, endpoint, event, deliveryID string, payload []byte) (string, func(ctx context.Context) error, error) {
+	var webhook *types.WebHook
+	err := json.Unmarshal(payload, &webhook)
+	if err != nil {
+		return "", nil, err
+	}
+	webhook.DeliveryID = deliveryID
+	key, err := m.eventKey(ctx, endpoint, webhook)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, func(ctx context.Context) error {
+		switch endpoint {
+		case EndpointEMU:
+			held, err := m.debounce(ctx, key, event, webhook, payload)
+			if err != nil || held {
+				return err
+			}
+			return m.dispatchEMU(ctx, event, webhook)
+		case EndpointGitHub:
+			return m.dispatchGitHub(ctx, event, webhook)
+		default:
+			return fmt.Errorf("unknown endpoint: %s", endpoint)
+		}
+	}, nil
+}
+
+// eventKey returns the key an event is serialized on: the EMU issue, pull request or discussion it
+// concerns, written as org/repo#number. Events on mirrors are keyed by their source so that both
+// sides of a mirrored issue share a key. Events that concern no issue have an empty key.
+func (m *Manager) eventKey(ctx context.Context, endpoint string, webhook *types.WebHook) (string, error) {
+	var number int
+	switch {
+	case webhook.Issue != nil:
+		number = webhook.Issue.GetNumber()
+	case webhook.PullRequest != nil:
+		number = webhook.PullRequest.GetNumber()
+	case webhook.Discussion != nil:
+		number = webhook.Discussion.Number
+	default:
+		return "", nil
+	}
+	org, repo := webhook.Repository.Owner.GetLogin(), webhook.Repository.GetName()
+
+	if endpoint == EndpointGitHub && strings.EqualFold(org, m.Config.Repo.Org) && strings.EqualFold(repo, m.Config.Repo.Name) {
+		sourceOrg, sourceRepo, sourceNumber, ok, err := m.DBClient.GetSourceNumber(ctx, number)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			org, repo, number = sourceOrg, sourceRepo, sourceNumber
+		}
+	}
+	return strings.ToLower(fmt.Sprintf("%s/%s#%d", org, repo, number)), nil
+}
+
+func (m *Manager) dispatchEMU(ctx context.Context, event string, webhook *types.WebHook) error {
+	switch event {
+	case "issues":
+		if isMirror(webhook.Issue.GetBody()) {
+			return nil
+		}
+		return m.EMUHandler.HandleIssue(ctx, webhook)
+	case "issue_comment":
+		if isMirror(webhook.Comment.GetBody()) {
+			return nil
+		}
+		return m.EMUHandler.HandleIssueComment(ctx, webhook)
+	case "pull_request":
+		return m.EMUHandler.HandlePullRequest(ctx, webhook)
+	case "pull_request_review_comment":
+		if isMirror(webhook.Comment.GetBody()) {
+			return nil
+		}
+		return m.EMUHandler.HandlePullRequestReviewComment(ctx, webhook)
+	case "discussion":
+		return m.EMUHandler.HandleDiscussion(ctx, webhook)
+	case "discussion_comment":
+		if isMirror(webhook.DiscussionComment.Body) {
+			return nil
+		}
+		return m.EMUHandler.HandleDiscussionComment(ctx, webhook)
+	case "repository":
+		return m.EMUHandler.HandleRepository(ctx, webhook)
+	case "organization":
+		return m.EMUHandler.HandleOrganization(ctx, webhook)
+	case "installation":
+		return m.EMUHandler.HandleInstallation(ctx, webhook)
+	case "installation_repositories":
+		return m.EMUHandler.HandleInstallationRepositories(ctx, webhook)
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedEvent, event)
+	}
+}
+
+func (m *Manager) dispatchGitHub(ctx context.Context, event string, webhook *types.WebHook) error {
+	switch event {
+	case "issues":
+		if !isMirroredIssue(webhook) || isEcho(webhook) {
+			return nil
+		}
+		return m.GitHubHandler.HandleIssue(ctx, webhook)
+	case "issue_comment":
+		// Comments on discussions converted to issues are not mirrored back.
+		if isMirror(webhook.Comment.GetBody()) || mirrorKind(webhook.Issue.GetBody()) == marker.KindDiscussion {
+			return nil
+		}
+		return m.GitHubHandler.HandleIssueComment(ctx, webhook)
+	case "discussion_comment":
+		if isMirror(webhook.DiscussionComment.Body) {
+			return nil
+		}
+		return m.GitHubHandler.HandleDiscussionComment(ctx, webhook)
+	case "installation":
+		return m.GitHubHandler.HandleInstallation(ctx, webhook)
+	case "installation_repositories":
+		return m.GitHubHandler.HandleInstallationRepositories(ctx, webhook)
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedEvent, event)
+	}
+}
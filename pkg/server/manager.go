@@ -6,16 +6,27 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/breaker"
 	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/executor"
 	"github.com/lindluni/github-issue-sync/pkg/handlers"
+	"github.com/lindluni/github-issue-sync/pkg/jobs"
+	"github.com/lindluni/github-issue-sync/pkg/leader"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/queue"
+	"github.com/lindluni/github-issue-sync/pkg/recording"
 	"github.com/lindluni/github-issue-sync/pkg/types"
 	"github.com/shurcooL/githubv4"
 	"github.com/sirupsen/logrus"
@@ -28,20 +39,68 @@ type Manager struct {
 	GitHubClient  *github.Client
 	GraphQLClient *githubv4.Client
 
+	Breaker       *breaker.Breaker
 	EMUHandler    *handlers.EMU
+	Executor      *executor.Executor
+	Elector       *leader.Elector
 	GitHubHandler *handlers.GitHub
 
+	// Mode is the part this replica plays when deliveries are queued on Queue. Without a queue,
+	// deliveries are handled as they are received.
+	Mode  string
+	Queue queue.Queue
+
+	// Recorder records the deliveries received, if set.
+	Recorder *recording.Recorder
+
 	Router *gin.Engine
 	Server *http.Server
 
 	Config *types.Config
 	Logger *logrus.Logger
+
+	debounceMutex  sync.Mutex
+	debounceTimers map[int64]*time.Timer
 }
 
 func (m *Manager) Serve() {
 	m.Logger.Info("Initializing API endpoints")
 	m.SetRoutes()
 
+	// Background work runs only on the replica holding the leader lease, among those handling events.
+	ctx, cancel := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	if m.handles() {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			m.Elector.Run(ctx, m.lead)
+		}()
+	}
+	if m.Queue != nil && m.handles() {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			m.consume(ctx)
+		}()
+	}
+	defer func() {
+		cancel()
+		background.Wait()
+		if m.Queue != nil {
+			err := m.Queue.Close()
+			if err != nil {
+				m.Logger.Errorf("Failed to close queue: %v", err)
+			}
+		}
+		if m.Recorder != nil {
+			err := m.Recorder.Close()
+			if err != nil {
+				m.Logger.Errorf("Failed to close recording: %v", err)
+			}
+		}
+	}()
+
 	m.Logger.Info("Configuring OS signal handling")
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc,
@@ -52,7 +111,9 @@ func (m *Manager) Serve() {
 	go func() {
 		<-sigc
 		err := m.Server.Shutdown(context.Background())
-		m.Logger.Errorf("Failed to shutdown server: %v", err)
+		if err != nil {
+			m.Logger.Errorf("Failed to shutdown server: %v", err)
+		}
 	}()
 	m.Logger.Debug("Configured OS signal handling")
 
@@ -61,113 +122,241 @@ func (m *Manager) Serve() {
 	m.Logger.Infof("Starting API server on address: %s", address)
 	if m.Config.Server.TLS.Enabled {
 		err := m.Server.ListenAndServeTLS(m.Config.Server.TLS.CertFile, m.Config.Server.TLS.KeyFile)
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			m.Logger.Fatalf("API server failed: %v", err)
 		}
 	} else {
 		err := m.Server.ListenAndServe()
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			m.Logger.Fatalf("API server failed: %v", err)
 		}
 	}
 }
 
+// lead runs the work that must only run on one replica, until ctx is cancelled when leadership is
+// lost.
+func (m *Manager) lead(ctx context.Context) {
+	if m.Config.Reconcile.RecoverMappings {
+		go m.recoverMappings(ctx)
+	}
+	m.startJobs(ctx)
+}
+
+func (m *Manager) recoverMappings(ctx context.Context) {
+	m.Logger.Info("Recovering mappings from mirrored items")
+	recovered, err := m.GitHubHandler.RecoverMappings(ctx)
+	if err != nil {
+		m.Logger.Errorf("Failed recovering mappings after recovering %d: %v", recovered, err)
+		return
+	}
+	m.Logger.Infof("Recovered %d mappings", recovered)
+}
+
+func (m *Manager) startJobs(ctx context.Context) {
+	runner := &jobs.Runner{Logger: m.Logger}
+	runner.Add(jobs.Job{Name: "operations", Interval: m.Config.Reconcile.OperationsInterval, Run: m.GitHubHandler.RecoverOperations})
+	runner.Add(jobs.Job{Name: "parked-events", Interval: m.Config.Parking.Interval, Run: m.RetryParked})
+	runner.Add(jobs.Job{Name: "repositories", Interval: m.Config.Reconcile.RepositoriesInterval, Run: m.GitHubHandler.BackfillRepositories})
+	if m.Config.Poll.Enabled {
+		runner.Add(jobs.Job{Name: "poll", Interval: m.Config.Poll.Interval, Run: m.Poll})
+	}
+	if m.Config.Debounce.Window > 0 {
+		runner.Add(jobs.Job{Name: "debounced-edits", Interval: m.Config.Debounce.Window, Run: m.FlushDebounced})
+	}
+	if m.Config.Reactions.Enabled {
+		sync := &handlers.ReactionSync{EMU: m.EMUHandler, GitHub: m.GitHubHandler}
+		runner.Add(jobs.Job{Name: "reactions", Interval: m.Config.Reactions.Interval, Run: sync.Sync})
+	}
+	if m.Config.Moderation.Minimize != "none" {
+		runner.Add(jobs.Job{Name: "minimized-comments", Interval: m.Config.Moderation.Interval, Run: m.GitHubHandler.SyncMinimized})
+	}
+	runner.Start(ctx)
+}
+
 func (m *Manager) SetRoutes() {
-	v1 := m.Router.Group("/webhooks")
-	{
-		// Events triggered by GitHub Professional Services
-		v1.POST("/github", m.DoWebHookGitHub)
+	// Workers consume deliveries from the queue, so only receivers accept them.
+	if m.receives() {
+		v1 := m.Router.Group("/webhooks")
+		if m.Recorder != nil {
+			v1.Use(m.Recorder.Middleware())
+		}
+		v1.Use(m.requestTimeout())
+		{
+			// Events triggered by GitHub Professional Services
+			v1.POST("/github", m.DoWebHookGitHub)
 
-		// Events triggered by EMU
-		v1.POST("/emu", m.DoWebHookEMU)
+			// Events triggered by EMU
+			v1.POST("/emu", m.DoWebHookEMU)
+		}
+	}
+
+	m.Router.GET("/status", m.DoStatus)
+
+	// Administrative endpoints are only served when a token is configured to protect them.
+	if m.Config.Admin.Token != "" {
+		admin := m.Router.Group("/admin")
+		admin.Use(m.requireAdminToken())
+		{
+			admin.GET("/drift", m.DoDriftReport)
+		}
+	}
+
+	// Attachments re-hosted on the filesystem are served by the API server itself.
+	if m.Config.Attachments.Enabled && m.Config.Attachments.Backend == "filesystem" {
+		m.Router.Static("/attachments", m.Config.Attachments.Filesystem.Directory)
 	}
 	m.Logger.Debug("Initialized routes")
 }
 
 func (m *Manager) DoWebHookEMU(c *gin.Context) {
+	m.doWebHook(c, EndpointEMU)
+}
+
+func (m *Manager) DoWebHookGitHub(c *gin.Context) {
+	m.doWebHook(c, EndpointGitHub)
+}
+
+func (m *Manager) doWebHook(c *gin.Context, endpoint string) {
 	event := c.GetHeader("X-GitHub-Event")
-	switch event {
-	case "issues":
-		webhook, err := parseWebHook(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		if !m.isBotIssue(webhook) {
-			err = m.EMUHandler.HandleIssue(webhook)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-		}
-	case "issue_comment":
-		webhook, err := parseWebHook(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		if !m.isBotComment(webhook) {
-			err = m.EMUHandler.HandleIssueComment(webhook)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
+	if event == "ping" {
+		m.pong(c)
+		return
+	}
+	payload, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if m.Queue != nil {
+		m.publish(c, endpoint, event, payload)
+		return
+	}
+	err = m.Dispatch(c.Request.Context(), endpoint, event, c.GetHeader("X-GitHub-Delivery"), payload)
+	if errors.Is(err, errUnsupportedEvent) {
+		m.Logger.Debugf("Unsupported event: %s", event)
+		if endpoint == EndpointEMU {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported event"})
+		} else {
+			c.JSON(http.StatusOK, gin.H{"Error": "Unsupported event"})
 		}
-	default:
-		fmt.Printf("Unsupported event: %s\n", event)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported event"})
 		return
 	}
+	if err != nil {
+		m.respondError(c, endpoint, event, payload, err)
+		return
+	}
+	m.forgetDelivery(c.Request.Context(), c.GetHeader("X-GitHub-Delivery"))
 }
 
-func (m *Manager) DoWebHookGitHub(c *gin.Context) {
-	event := c.GetHeader("X-GitHub-Event")
-	switch event {
-	case "issues":
-		webhook, err := parseWebHook(c)
-		if !m.isBotIssue(webhook) || (webhook.Action == "edited" && !m.isBotSender(webhook)) {
-			err = m.GitHubHandler.HandleIssue(webhook)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
+// publish queues a delivery for the workers, acknowledging it once it is queued.
+func (m *Manager) publish(c *gin.Context, endpoint, event string, payload []byte) {
+	err := m.Queue.Publish(c.Request.Context(), &queue.Message{
+		Endpoint:   endpoint,
+		Event:      event,
+		DeliveryID: c.GetHeader("X-GitHub-Delivery"),
+		Payload:    payload,
+	})
+	if err != nil {
+		m.Logger.Errorf("Failed queueing %s event: %v", event, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recording.MarkQueued(c)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Queued"})
+}
+
+// pong acknowledges the ping GitHub sends when a webhook is created, so a new installation can be
+// verified from its delivery log.
+func (m *Manager) pong(c *gin.Context) {
+	m.Logger.Infof("Received ping for hook %s", c.GetHeader("X-GitHub-Hook-ID"))
+	c.JSON(http.StatusOK, gin.H{"message": "pong"})
+}
+
+// respondError reports a failed delivery. Deliveries that would act through a suspended installation
+// are parked until it is unsuspended, since retrying them cannot succeed before then, deliveries for
+// items that are not mirrored are acknowledged, and deliveries that arrived before the mapping they
+// depend on are parked to be retried later. Deliveries rejected by the open circuit breaker are
+// answered with 503 and parked to be retried once it closes.
+func (m *Manager) respondError(c *gin.Context, endpoint, event string, payload []byte, err error) {
+	if breaker.IsOpen(err) {
+		parkErr := m.park(c.Request.Context(), endpoint, event, c.GetHeader("X-GitHub-Delivery"), payload, err)
+		if parkErr != nil {
+			m.Logger.Errorf("Failed recording %s event rejected by the circuit breaker: %v", event, parkErr)
 		}
-	case "issue_comment":
-		webhook, err := parseWebHook(c)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if retryAfter := m.Breaker.RetryAfter(); retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, handlers.ErrInstallationSuspended) {
+		parkErr := m.parkSuspended(c.Request.Context(), endpoint, event, c.GetHeader("X-GitHub-Delivery"), payload, err)
+		if parkErr == nil {
+			c.JSON(http.StatusAccepted, gin.H{"message": "Parked until the installation is unsuspended"})
 			return
 		}
-		if !m.isBotComment(webhook) {
-			err = m.GitHubHandler.HandleIssueComment(webhook)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
+		m.Logger.Errorf("Failed parking %s event for a suspended installation: %v", event, parkErr)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, db.ErrNotFound) && !m.parkable(c.Request.Context(), endpoint, payload) {
+		m.Logger.Debugf("Skipping %s event for an item that is not mirrored: %v", event, err)
+		c.JSON(http.StatusOK, gin.H{"message": "Not mirrored"})
+		return
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		parkErr := m.park(c.Request.Context(), endpoint, event, c.GetHeader("X-GitHub-Delivery"), payload, err)
+		if parkErr == nil {
+			c.JSON(http.StatusAccepted, gin.H{"message": "Parked until the mapping it depends on exists"})
+			return
 		}
-	default:
-		fmt.Printf("Unsupported event: %s\n", event)
-		c.JSON(http.StatusOK, gin.H{"Error": "Unsupported event"})
+		m.Logger.Errorf("Failed parking %s event: %v", event, parkErr)
 	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 }
 
-func parseWebHook(c *gin.Context) (*types.WebHook, error) {
-	var webhook *types.WebHook
-	err := c.BindJSON(&webhook)
-	if err != nil {
-		return nil, err
+// requestTimeout bounds the total time spent processing a single webhook delivery, so a hung
+// upstream cannot hold a request open indefinitely.
+func (m *Manager) requestTimeout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.Config.Timeouts.Webhook <= 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), m.Config.Timeouts.Webhook)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
 	}
-	return webhook, nil
 }
 
-func (m *Manager) isBotComment(webhook *types.WebHook) bool {
-	return webhook.Comment.User.GetLogin() == m.Config.Apps.EMUBotName || webhook.Comment.User.GetLogin() == m.Config.Apps.ClientBotName
+// isMirror reports whether the body was written by this service on behalf of the other side.
+func isMirror(body string) bool {
+	_, _, ok := marker.Parse(body)
+	return ok
 }
 
-func (m *Manager) isBotIssue(webhook *types.WebHook) bool {
-	return webhook.Issue.User.GetLogin() == m.Config.Apps.EMUBotName || webhook.Issue.User.GetLogin() == m.Config.Apps.ClientBotName
+// mirrorKind returns the kind of item a body's marker says it mirrors, or an empty string for bodies
+// without a marker.
+func mirrorKind(body string) string {
+	m, _, ok := marker.Parse(body)
+	if !ok {
+		return ""
+	}
+	return m.Kind
+}
+
+// isMirroredIssue reports whether a GitHub issue event concerns an issue mirrored from EMU. The
+// previous body is checked as well so an edit that strips the marker is still recognised.
+func isMirroredIssue(webhook *types.WebHook) bool {
+	if isMirror(webhook.Issue.GetBody()) {
+		return true
+	}
+	return webhook.Changes != nil && isMirror(webhook.Changes.GetBody().GetFrom())
 }
 
-func (m *Manager) isBotSender(webhook *types.WebHook) bool {
-	return webhook.Sender.GetLogin() == m.Config.Apps.EMUBotName || webhook.Sender.GetLogin() == m.Config.Apps.ClientBotName
+// isEcho reports whether an edit event was caused by this service's own write, in which case the
+// content still matches the hash recorded in its marker.
+func isEcho(webhook *types.WebHook) bool {
+	return webhook.Action == "edited" && marker.Matches(webhook.Issue.GetTitle(), webhook.Issue.GetBody())
 }
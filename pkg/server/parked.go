@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lindluni/github-issue-sync/pkg/breaker"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/handlers"
+	"github.com/lindluni/github-issue-sync/pkg/marker"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+const (
+	// parkedBatch bounds the number of parked events retried per run.
+	parkedBatch = 100
+
+	// maxParkedBackoff bounds the delay between retries of a parked event.
+	maxParkedBackoff = time.Hour
+)
+
+// park holds a delivery that arrived before the mapping it depends on, such as a comment delivered
+// before its issue's opened event was handled, so it can be retried instead of failing.
+func (m *Manager) park(ctx context.Context, endpoint, event, deliveryID string, payload []byte, reason error) error {
+	m.Logger.Infof("Parking %s event %s: %v", event, deliveryID, reason)
+	return m.DBClient.ParkEvent(ctx, endpoint, event, deliveryID, payload, reason.Error(), time.Now().Add(m.Config.Parking.Interval))
+}
+
+// parkable reports whether a delivery that failed on a missing mapping can still be mapped later, so
+// parking it is worthwhile. On GitHub that is the case when the item it concerns is the mirror of an
+// issue, pull request or discussion; on EMU when the item it concerns has a mirror being created, or is
+// recent enough for the event that mirrors it to still be on its way. Other deliveries concern items
+// that are not mirrored, and never will be.
+func (m *Manager) parkable(ctx context.Context, endpoint string, payload []byte) bool {
+	var webhook *types.WebHook
+	err := json.Unmarshal(payload, &webhook)
+	if err != nil {
+		return false
+	}
+
+	if endpoint == EndpointGitHub {
+		switch {
+		case webhook.Issue != nil:
+			kind := mirrorKind(webhook.Issue.GetBody())
+			return kind == marker.KindIssue || kind == marker.KindPullRequest
+		case webhook.Discussion != nil:
+			return mirrorKind(webhook.Discussion.Body) == marker.KindDiscussion
+		}
+		return true
+	}
+
+	var id int64
+	var createdAt time.Time
+	switch {
+	case webhook.PullRequest != nil:
+		id, createdAt = webhook.PullRequest.GetID(), webhook.PullRequest.GetCreatedAt()
+	case webhook.Issue != nil:
+		id, createdAt = webhook.Issue.GetID(), webhook.Issue.GetCreatedAt()
+	case webhook.Discussion != nil:
+		id, createdAt = webhook.Discussion.ID, webhook.Discussion.CreatedAt
+	default:
+		return true
+	}
+	if time.Since(createdAt) < maxParkedBackoff {
+		return true
+	}
+	pending, err := m.DBClient.HasUnfinishedOperation(ctx, id)
+	if err != nil {
+		m.Logger.Warnf("Unable to tell whether %d is being mirrored, parking the delivery: %v", id, err)
+		return true
+	}
+	return pending
+}
+
+// parkSuspended holds a delivery that would have acted through a suspended installation until the
+// installation is unsuspended. A delivery whose installation was unsuspended while it was being parked
+// is made due straight away, so it is not held forever.
+func (m *Manager) parkSuspended(ctx context.Context, endpoint, event, deliveryID string, payload []byte, reason error) error {
+	var suspended *handlers.SuspendedError
+	if !errors.As(reason, &suspended) {
+		return m.park(ctx, endpoint, event, deliveryID, payload, reason)
+	}
+	m.Logger.Infof("Parking %s event %s until installation %d is unsuspended", event, deliveryID, suspended.InstallationID)
+	err := m.DBClient.ParkSuspendedEvent(ctx, endpoint, event, deliveryID, payload, reason.Error(), suspended.InstallationID)
+	if err != nil {
+		return err
+	}
+	return m.resumeIfUnsuspended(ctx, suspended.InstallationID)
+}
+
+func (m *Manager) resumeIfUnsuspended(ctx context.Context, installationID int64) error {
+	stillSuspended, err := m.DBClient.IsInstallationSuspended(ctx, installationID)
+	if err != nil || stillSuspended {
+		return err
+	}
+	_, err = m.DBClient.ResumeParkedEvents(ctx, installationID, time.Now())
+	return err
+}
+
+// settle disposes of a delivery that failed outside a webhook request, where there is no response to
+// report the failure with. Deliveries for suspended installations are parked until they are
+// unsuspended, deliveries for items that are not mirrored are dropped, and other failures are parked
+// to be retried. An error is returned only if the delivery must be retried by its source: when the
+// circuit breaker is open, or it could not be parked.
+func (m *Manager) settle(ctx context.Context, endpoint, event, deliveryID string, payload []byte, err error) error {
+	switch {
+	case breaker.IsOpen(err):
+		return err
+	case errors.Is(err, handlers.ErrInstallationSuspended):
+		return m.parkSuspended(ctx, endpoint, event, deliveryID, payload, err)
+	case errors.Is(err, db.ErrNotFound) && !m.parkable(ctx, endpoint, payload):
+		m.Logger.Debugf("Skipping %s event %s for an item that is not mirrored: %v", event, deliveryID, err)
+		return nil
+	default:
+		return m.park(ctx, endpoint, event, deliveryID, payload, err)
+	}
+}
+
+// forgetDelivery drops any parked copy of a delivery once it has been handled, such as when a
+// delivery rejected by the circuit breaker is redelivered by GitHub before its retry is due.
+func (m *Manager) forgetDelivery(ctx context.Context, deliveryID string) {
+	if deliveryID == "" {
+		return
+	}
+	err := m.DBClient.DeleteParkedDelivery(ctx, deliveryID)
+	if err != nil {
+		m.Logger.Warnf("Unable to drop parked copies of delivery %s: %v", deliveryID, err)
+	}
+}
+
+// RetryParked dispatches the parked events that are due. Events that still fail are retried with
+// exponential backoff until MaxAttempts is reached, after which they are dropped, except for those
+// failing on a suspended installation, which are held until it is unsuspended. Nothing is retried
+// while the circuit breaker is open, and attempts rejected by it are not counted.
+func (m *Manager) RetryParked(ctx context.Context) error {
+	if m.Breaker.RetryAfter() > 0 {
+		return nil
+	}
+	events, err := m.DBClient.ListDueParkedEvents(ctx, time.Now(), parkedBatch)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		err = m.retryParkedEvent(ctx, event)
+		if breaker.IsOpen(err) {
+			m.Logger.Infof("Pausing retries of parked events while the circuit breaker is open")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) retryParkedEvent(ctx context.Context, event *db.ParkedEvent) error {
+	dispatchCtx, cancel := ctx, func() {}
+	if m.Config.Timeouts.Webhook > 0 {
+		dispatchCtx, cancel = context.WithTimeout(ctx, m.Config.Timeouts.Webhook)
+	}
+	err := m.Dispatch(dispatchCtx, event.Endpoint, event.Event, event.DeliveryID, event.Payload)
+	cancel()
+
+	switch {
+	case breaker.IsOpen(err):
+		return err
+	case err == nil:
+		m.Logger.Infof("Handled parked %s event %s", event.Event, event.DeliveryID)
+	case errors.Is(err, handlers.ErrInstallationSuspended):
+		var suspended *handlers.SuspendedError
+		if errors.As(err, &suspended) {
+			m.Logger.Infof("Holding parked %s event %s until installation %d is unsuspended", event.Event, event.DeliveryID, suspended.InstallationID)
+			err = m.DBClient.SuspendParkedEvent(ctx, event, err.Error(), suspended.InstallationID)
+			if err != nil {
+				return err
+			}
+			return m.resumeIfUnsuspended(ctx, suspended.InstallationID)
+		}
+		m.Logger.Infof("Dropping parked %s event %s while paused: %v", event.Event, event.DeliveryID, err)
+	case errors.Is(err, db.ErrNotFound) && !m.parkable(ctx, event.Endpoint, event.Payload):
+		m.Logger.Infof("Dropping parked %s event %s for an item that was never mirrored: %v", event.Event, event.DeliveryID, err)
+	case event.Attempts+1 >= m.Config.Parking.MaxAttempts:
+		m.Logger.Errorf("Dropping parked %s event %s after %d attempts: %v", event.Event, event.DeliveryID, event.Attempts+1, err)
+	default:
+		backoff := m.Config.Parking.Interval << uint(event.Attempts+1)
+		if backoff <= 0 || backoff > maxParkedBackoff {
+			backoff = maxParkedBackoff
+		}
+		m.Logger.Debugf("Parked %s event %s failed again: %v", event.Event, event.DeliveryID, err)
+		return m.DBClient.RescheduleParkedEvent(ctx, event, err.Error(), time.Now().Add(backoff))
+	}
+	return m.DBClient.DeleteParkedEvent(ctx, event)
+}
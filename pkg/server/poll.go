@@ -0,0 +1,387 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v41/github"
+	"github.com/lindluni/github-issue-sync/pkg/breaker"
+	"github.com/lindluni/github-issue-sync/pkg/db"
+	"github.com/lindluni/github-issue-sync/pkg/handlers"
+	"github.com/lindluni/github-issue-sync/pkg/types"
+)
+
+// pollPageSize is the number of items requested per page of a listing.
+const pollPageSize = 100
+
+// pollEventActions are the issue events polled for, which are also the issues actions they become.
+var pollEventActions = map[string]bool{"closed": true, "reopened": true, "locked": true, "unlocked": true}
+
+// pollTarget is a repository polled for the events of one endpoint.
+type pollTarget struct {
+	endpoint     string
+	client       *github.Client
+	repository   *github.Repository
+	installation *github.Installation
+}
+
+// Poll ingests the changes made since the last poll to the repositories of every client app
+// installation and to the GitHub repository, for deployments GitHub cannot deliver webhooks to. Issues,
+// issue events and comments are listed with since cursors or event ids and ETags, translated into the
+// webhooks GitHub would have delivered, and dispatched like them. Polling starts from the first poll;
+// earlier items are left to mapping recovery. Deletions cannot be seen by polling.
+func (m *Manager) Poll(ctx context.Context) error {
+	targets, err := m.pollTargets(ctx)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		err = m.pollRepository(ctx, target)
+		if breaker.IsOpen(err) {
+			m.Logger.Infof("Pausing polling while the circuit breaker is open")
+			return nil
+		}
+		if err != nil {
+			m.Logger.Warnf("Unable to poll %s: %v", target.repository.GetFullName(), err)
+		}
+	}
+	return nil
+}
+
+// pollTargets returns the GitHub repository and the repositories of every active client app
+// installation.
+func (m *Manager) pollTargets(ctx context.Context) ([]*pollTarget, error) {
+	apiCtx, cancel := context.WithTimeout(ctx, m.Config.Timeouts.GitHub)
+	repository, _, err := m.GitHubClient.Repositories.Get(apiCtx, m.Config.Repo.Org, m.Config.Repo.Name)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	targets := []*pollTarget{{
+		endpoint:     EndpointGitHub,
+		client:       m.GitHubClient,
+		repository:   repository,
+		installation: &github.Installation{ID: github.Int64(m.Config.Apps.GitHub.InstallationID)},
+	}}
+
+	opts := &github.ListOptions{PerPage: pollPageSize}
+	for {
+		apiCtx, cancel := context.WithTimeout(ctx, m.Config.Timeouts.GitHub)
+		installations, resp, err := m.Client.Apps.ListInstallations(apiCtx, opts)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, installation := range installations {
+			if installation.SuspendedAt != nil {
+				continue
+			}
+			installationTargets, err := m.installationTargets(ctx, installation)
+			if errors.Is(err, handlers.ErrInstallationSuspended) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, installationTargets...)
+		}
+		if resp.NextPage == 0 {
+			return targets, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (m *Manager) installationTargets(ctx context.Context, installation *github.Installation) ([]*pollTarget, error) {
+	client, err := m.EMUHandler.InstallationClient(ctx, installation.GetID())
+	if err != nil {
+		return nil, err
+	}
+	var targets []*pollTarget
+	opts := &github.ListOptions{PerPage: pollPageSize}
+	for {
+		apiCtx, cancel := context.WithTimeout(ctx, m.Config.Timeouts.GitHub)
+		repositories, resp, err := client.Apps.ListRepos(apiCtx, opts)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, repository := range repositories.Repositories {
+			targets = append(targets, &pollTarget{
+				endpoint:     EndpointEMU,
+				client:       client,
+				repository:   repository,
+				installation: installation,
+			})
+		}
+		if resp.NextPage == 0 {
+			return targets, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// pollRepository ingests a repository's changed issues, then its issue events, then its changed
+// comments, so comments are mirrored after the issues they belong to.
+func (m *Manager) pollRepository(ctx context.Context, target *pollTarget) error {
+	name := fmt.Sprintf("%s:%s", target.endpoint, target.repository.GetFullName())
+	issues := map[int]*github.Issue{}
+
+	err := m.pollSince(ctx, target, name+":issues", "issues?state=all&sort=updated&direction=asc", func(raw json.RawMessage) error {
+		var issue *github.Issue
+		err := json.Unmarshal(raw, &issue)
+		if err != nil {
+			return err
+		}
+		issues[issue.GetNumber()] = issue
+		// Edits of mirrors are reverted from the changes GitHub reports with them, which a listing does
+		// not include, and their state changes are ingested from issue events.
+		if issue.IsPullRequest() || target.endpoint == EndpointGitHub {
+			return nil
+		}
+		exists, err := m.DBClient.IssueEntryExists(ctx, issue.GetID())
+		if err != nil {
+			return err
+		}
+		action := "edited"
+		if !exists {
+			action = "opened"
+		}
+		deliveryID := fmt.Sprintf("poll-issue-%d-%d", issue.GetID(), issue.GetUpdatedAt().Unix())
+		return m.ingest(ctx, target, "issues", deliveryID, &types.WebHook{Action: action, Issue: issue, Sender: issue.User})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = m.pollEvents(ctx, target, name+":events")
+	if err != nil {
+		return err
+	}
+
+	return m.pollSince(ctx, target, name+":comments", "issues/comments?sort=updated&direction=asc", func(raw json.RawMessage) error {
+		var comment *github.IssueComment
+		err := json.Unmarshal(raw, &comment)
+		if err != nil {
+			return err
+		}
+		number, err := strconv.Atoi(path.Base(comment.GetIssueURL()))
+		if err != nil {
+			return fmt.Errorf("unable to parse issue of comment %d: %w", comment.GetID(), err)
+		}
+		issue, ok := issues[number]
+		if !ok {
+			apiCtx, cancel := context.WithTimeout(ctx, m.Config.Timeouts.GitHub)
+			issue, _, err = target.client.Issues.Get(apiCtx, target.repository.GetOwner().GetLogin(), target.repository.GetName(), number)
+			cancel()
+			if err != nil {
+				return err
+			}
+			issues[number] = issue
+		}
+		exists, err := m.DBClient.CommentEntryExists(ctx, comment.GetID())
+		if err != nil {
+			return err
+		}
+		action := "created"
+		if exists {
+			action = "edited"
+		}
+		deliveryID := fmt.Sprintf("poll-comment-%d-%d", comment.GetID(), comment.GetUpdatedAt().Unix())
+		return m.ingest(ctx, target, "issue_comment", deliveryID, &types.WebHook{Action: action, Issue: issue, Comment: comment, Sender: comment.User})
+	})
+}
+
+// pollSince passes each item of a listing updated since its cursor to handle, oldest first, and
+// advances the cursor past the items handled. The items at the cursor itself are returned again by
+// the next listing and are skipped.
+func (m *Manager) pollSince(ctx context.Context, target *pollTarget, name, listing string, handle func(raw json.RawMessage) error) error {
+	cursor, err := m.DBClient.GetPollCursor(ctx, name)
+	if err != nil {
+		return err
+	}
+	if cursor == nil {
+		return m.DBClient.SavePollCursor(ctx, &db.PollCursor{Name: name, Position: time.Now().Unix()})
+	}
+
+	since := time.Unix(cursor.Position, 0).UTC().Format(time.RFC3339)
+	next := &db.PollCursor{Name: name, Position: cursor.Position, Seen: cursor.Seen}
+	for page := 1; page != 0; {
+		etag := ""
+		if page == 1 {
+			etag = cursor.ETag
+		}
+		var items []json.RawMessage
+		resp, err := m.pollPage(ctx, target, fmt.Sprintf("%s&since=%s&per_page=%d&page=%d", listing, since, pollPageSize, page), etag, &items)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			return nil
+		}
+		if page == 1 {
+			next.ETag = resp.Header.Get("ETag")
+		}
+
+		for _, raw := range items {
+			var item struct {
+				ID        int64     `json:"id"`
+				UpdatedAt time.Time `json:"updated_at"`
+			}
+			err = json.Unmarshal(raw, &item)
+			if err != nil {
+				return err
+			}
+			updated := item.UpdatedAt.Unix()
+			if updated == cursor.Position && containsID(cursor.Seen, item.ID) {
+				continue
+			}
+
+			err = handle(raw)
+			if err != nil {
+				// Items are handled oldest first, so the cursor can advance up to the failed item.
+				next.ETag = ""
+				saveErr := m.DBClient.SavePollCursor(ctx, next)
+				if saveErr != nil {
+					m.Logger.Warnf("Unable to save %s poll cursor: %v", name, saveErr)
+				}
+				return err
+			}
+			if updated > next.Position {
+				next.Position, next.Seen = updated, nil
+			}
+			if updated == next.Position {
+				next.Seen = append(next.Seen, item.ID)
+			}
+		}
+		page = resp.NextPage
+	}
+	// The ETag only matches the next listing if its since parameter is unchanged.
+	if next.Position != cursor.Position {
+		next.ETag = ""
+	}
+	return m.DBClient.SavePollCursor(ctx, next)
+}
+
+// pollEvents dispatches the issue events created since the last event seen. The listing has no since
+// parameter and is newest first, so it is paged until the last event seen.
+func (m *Manager) pollEvents(ctx context.Context, target *pollTarget, name string) error {
+	cursor, err := m.DBClient.GetPollCursor(ctx, name)
+	if err != nil {
+		return err
+	}
+	next := &db.PollCursor{Name: name}
+	if cursor != nil {
+		next.Position = cursor.Position
+	}
+
+	var events []*github.IssueEvent
+	for page := 1; page != 0; {
+		etag := ""
+		if page == 1 && cursor != nil {
+			etag = cursor.ETag
+		}
+		var listed []*github.IssueEvent
+		resp, err := m.pollPage(ctx, target, fmt.Sprintf("issues/events?per_page=%d&page=%d", pollPageSize, page), etag, &listed)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			return nil
+		}
+		if page == 1 {
+			next.ETag = resp.Header.Get("ETag")
+		}
+
+		page = resp.NextPage
+		for _, event := range listed {
+			if cursor == nil || event.GetID() <= cursor.Position {
+				page = 0
+				break
+			}
+			events = append(events, event)
+		}
+		if cursor == nil && len(listed) > 0 {
+			next.Position = listed[0].GetID()
+		}
+	}
+
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if pollEventActions[event.GetEvent()] && !event.GetIssue().IsPullRequest() {
+			deliveryID := fmt.Sprintf("poll-event-%d", event.GetID())
+			err = m.ingest(ctx, target, "issues", deliveryID, &types.WebHook{Action: event.GetEvent(), Issue: event.Issue, Sender: event.Actor})
+			if err != nil {
+				next.ETag = ""
+				saveErr := m.DBClient.SavePollCursor(ctx, next)
+				if saveErr != nil {
+					m.Logger.Warnf("Unable to save %s poll cursor: %v", name, saveErr)
+				}
+				return err
+			}
+		}
+		next.Position = event.GetID()
+	}
+	return m.DBClient.SavePollCursor(ctx, next)
+}
+
+// pollPage requests a page of a repository listing, conditionally on etag if it is set. A listing that
+// has not changed is reported by a 304 response and leaves v untouched.
+func (m *Manager) pollPage(ctx context.Context, target *pollTarget, listing, etag string, v interface{}) (*github.Response, error) {
+	url := fmt.Sprintf("repos/%s/%s/%s", target.repository.GetOwner().GetLogin(), target.repository.GetName(), listing)
+	req, err := target.client.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	apiCtx, cancel := context.WithTimeout(ctx, m.Config.Timeouts.GitHub)
+	defer cancel()
+	resp, err := target.client.Do(apiCtx, req, v)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ingest dispatches a webhook translated from a polled item. Items that fail are settled like queued
+// deliveries, so polling only stops while the circuit breaker is open.
+func (m *Manager) ingest(ctx context.Context, target *pollTarget, event, deliveryID string, webhook *types.WebHook) error {
+	webhook.Repository = target.repository
+	webhook.Installation = target.installation
+	payload, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+
+	dispatchCtx, cancel := ctx, func() {}
+	if m.Config.Timeouts.Webhook > 0 {
+		dispatchCtx, cancel = context.WithTimeout(ctx, m.Config.Timeouts.Webhook)
+	}
+	err = m.Dispatch(dispatchCtx, target.endpoint, event, deliveryID, payload)
+	cancel()
+	if err != nil {
+		return m.settle(ctx, target.endpoint, event, deliveryID, payload, err)
+	}
+	return nil
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
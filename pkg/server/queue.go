@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lindluni/github-issue-sync/pkg/queue"
+)
+
+// Modes select the part a replica plays when deliveries are queued. Receivers publish the deliveries
+// they receive, workers consume and handle them, and replicas in ModeAll do both.
+const (
+	ModeAll      = "all"
+	ModeReceiver = "receiver"
+	ModeWorker   = "worker"
+)
+
+func (m *Manager) receives() bool {
+	return m.Mode != ModeWorker
+}
+
+func (m *Manager) handles() bool {
+	return m.Mode != ModeReceiver
+}
+
+// consume runs the queue's consumer until ctx is cancelled, and returns once the deliveries it took are
+// settled. There is a single consumer, feeding deliveries to the executor in the order they were
+// queued, so deliveries for the same issue are handled in that order while up to one per worker are
+// handled at once.
+func (m *Manager) consume(ctx context.Context) {
+	err := m.Queue.Consume(ctx, m.Config.Concurrency.Workers, m.handleMessage)
+	if err != nil {
+		m.Logger.Errorf("Queue consumer stopped: %v", err)
+	}
+}
+
+// handleMessage dispatches a queued delivery. Failures are settled like polled items, so a message is
+// only redelivered while the circuit breaker is open or if it could not be parked.
+func (m *Manager) handleMessage(ctx context.Context, message *queue.Message) func() error {
+	dispatchCtx, cancel := ctx, func() {}
+	if m.Config.Timeouts.Webhook > 0 {
+		dispatchCtx, cancel = context.WithTimeout(ctx, m.Config.Timeouts.Webhook)
+	}
+	done := m.dispatch(dispatchCtx, message.Endpoint, message.Event, message.DeliveryID, message.Payload)
+
+	return func() error {
+		err := <-done
+		cancel()
+
+		// The consumer's context is cancelled on shutdown while deliveries in flight are drained, so
+		// their outcome is recorded without it, with each statement bounded by the database timeout.
+		ctx := context.Background()
+		switch {
+		case errors.Is(err, errUnsupportedEvent):
+			m.Logger.Debugf("Unsupported event: %s", message.Event)
+			return nil
+		case err != nil:
+			return m.settle(ctx, message.Endpoint, message.Event, message.DeliveryID, message.Payload, err)
+		}
+		m.forgetDelivery(ctx, message.DeliveryID)
+		return nil
+	}
+}
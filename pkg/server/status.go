@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DoStatus reports this replica's identity, mode, leadership and circuit breaker state, and which
+// replica holds the leader lease.
+func (m *Manager) DoStatus(c *gin.Context) {
+	status := gin.H{
+		"instance": m.Elector.Identity,
+		"mode":     m.Mode,
+		"leader":   m.Elector.IsLeader(),
+		"breaker":  m.Breaker.Status(),
+	}
+	lease, held, err := m.DBClient.GetLease(c.Request.Context(), m.Elector.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if held {
+		status["lease"] = gin.H{
+			"holder":     lease.Holder,
+			"expires_at": lease.ExpiresAt.UTC(),
+			"renewed_at": lease.RenewedAt.UTC(),
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
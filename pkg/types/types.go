@@ -1,19 +1,46 @@
 package types
 
-import "github.com/google/go-github/v41/github"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/go-github/v41/github"
+)
 
 type Config struct {
-	Apps    Apps    `yaml:"apps"`
-	Logging Logging `yaml:"logging"`
-	Repo    Repo    `yaml:"repo"`
-	Server  Server  `yaml:"server"`
+	Admin       Admin       `yaml:"admin"`
+	Apps        Apps        `yaml:"apps"`
+	Attachments Attachments `yaml:"attachments"`
+	Breaker     Breaker     `yaml:"breaker"`
+	Concurrency Concurrency `yaml:"concurrency"`
+	Debounce    Debounce    `yaml:"debounce"`
+	Discussions Discussions `yaml:"discussions"`
+	Leadership  Leadership  `yaml:"leadership"`
+	Logging     Logging     `yaml:"logging"`
+	Mentions    Mentions    `yaml:"mentions"`
+	Moderation  Moderation  `yaml:"moderation"`
+	Parking     Parking     `yaml:"parking"`
+	Poll        Poll        `yaml:"poll"`
+	Queue       Queue       `yaml:"queue"`
+	Reactions   Reactions   `yaml:"reactions"`
+	Reconcile   Reconcile   `yaml:"reconcile"`
+	Recording   Recording   `yaml:"recording"`
+	Repo        Repo        `yaml:"repo"`
+	Server      Server      `yaml:"server"`
+	Templates   Templates   `yaml:"templates"`
+	Timeouts    Timeouts    `yaml:"timeouts"`
+	Tracing     Tracing     `yaml:"tracing"`
+}
+
+// Admin configures the administrative endpoints, which are only served when Token is set. Requests
+// must present the token as a bearer token.
+type Admin struct {
+	Token string `yaml:"token"`
 }
 
 type Apps struct {
-	ClientBotName string `yaml:"clientBotName"`
-	EMUBotName    string `yaml:"emuBotName"`
-	GitHub        App    `yaml:"github"`
-	Client        App    `yaml:"client"`
+	GitHub App `yaml:"github"`
+	Client App `yaml:"client"`
 }
 
 type App struct {
@@ -21,6 +48,62 @@ type App struct {
 	AppID          int64  `yaml:"appID"`
 	InstallationID int64  `yaml:"installationID"`
 	PrivateKey     string `yaml:"privateKey"`
+	BaseURL        string `yaml:"baseURL"`
+	UploadURL      string `yaml:"uploadURL"`
+	GraphQLURL     string `yaml:"graphQLURL"`
+}
+
+type Attachments struct {
+	Enabled    bool                  `yaml:"enabled"`
+	Backend    string                `yaml:"backend"`
+	MaxSize    int64                 `yaml:"maxSize"`
+	Repo       AttachmentsRepo       `yaml:"repo"`
+	Filesystem AttachmentsFilesystem `yaml:"filesystem"`
+}
+
+type AttachmentsRepo struct {
+	Org    string `yaml:"org"`
+	Name   string `yaml:"name"`
+	Branch string `yaml:"branch"`
+	Path   string `yaml:"path"`
+}
+
+type AttachmentsFilesystem struct {
+	Directory string `yaml:"directory"`
+	BaseURL   string `yaml:"baseURL"`
+}
+
+// Breaker configures the circuit breaker around GitHub API requests. It opens after Threshold
+// consecutive 5xx responses or timeouts and lets a probe through once Cooldown has passed.
+type Breaker struct {
+	Threshold int           `yaml:"threshold"`
+	Cooldown  time.Duration `yaml:"cooldown"`
+}
+
+// Concurrency limits the number of events handled at once. Events for the same issue are always
+// handled one at a time; with AdvisoryLocks, replicas sharing the database also take a MySQL advisory
+// lock per issue.
+type Concurrency struct {
+	Workers       int  `yaml:"workers"`
+	AdvisoryLocks bool `yaml:"advisoryLocks"`
+}
+
+// Debounce collapses a burst of edits to an EMU issue into a single edit of its mirror, made once
+// Window passes without another edit. A zero window mirrors every edit as it arrives.
+type Debounce struct {
+	Window time.Duration `yaml:"window"`
+}
+
+type Discussions struct {
+	CategoryID     string `yaml:"categoryID"`
+	ConvertToIssue bool   `yaml:"convertToIssue"`
+}
+
+// Leadership configures the lease that elects the replica running background jobs. The leader renews
+// it every RenewInterval, and another replica takes over once it has gone unrenewed for LeaseDuration.
+type Leadership struct {
+	LeaseDuration time.Duration `yaml:"leaseDuration"`
+	RenewInterval time.Duration `yaml:"renewInterval"`
 }
 
 type Logging struct {
@@ -33,6 +116,76 @@ type Logging struct {
 	MaxSize      int    `yaml:"maxSize"`
 }
 
+// Mentions maps EMU logins to the github.com logins of the same people.
+type Mentions struct {
+	Users map[string]string `yaml:"users"`
+}
+
+// Moderation selects which side's moderation actions are copied to the other: none, to-emu,
+// to-github or both.
+type Moderation struct {
+	Lock     string        `yaml:"lock"`
+	Minimize string        `yaml:"minimize"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Parking configures the retry of deliveries that arrive before the mapping they depend on.
+type Parking struct {
+	Interval    time.Duration `yaml:"interval"`
+	MaxAttempts int           `yaml:"maxAttempts"`
+}
+
+// Poll ingests events by polling the API every Interval, for deployments GitHub cannot deliver
+// webhooks to.
+type Poll struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Queue puts webhook deliveries on a queue between the replicas receiving them and the workers
+// handling them. Backend is one of sql, file or nats; without a backend deliveries are handled as they
+// are received. Workers poll for messages every PollInterval, retry a failed message after RetryDelay,
+// and a message claimed for longer than VisibilityTimeout is handed to another worker.
+type Queue struct {
+	Backend           string        `yaml:"backend"`
+	PollInterval      time.Duration `yaml:"pollInterval"`
+	RetryDelay        time.Duration `yaml:"retryDelay"`
+	VisibilityTimeout time.Duration `yaml:"visibilityTimeout"`
+	File              QueueFile     `yaml:"file"`
+	NATS              QueueNATS     `yaml:"nats"`
+}
+
+type QueueFile struct {
+	Directory string `yaml:"directory"`
+}
+
+type QueueNATS struct {
+	URL      string `yaml:"url"`
+	Stream   string `yaml:"stream"`
+	Subject  string `yaml:"subject"`
+	Consumer string `yaml:"consumer"`
+}
+
+type Reactions struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type Reconcile struct {
+	RecoverMappings bool `yaml:"recoverMappings"`
+	// OperationsInterval is how often interrupted mirror creations are looked for and finished.
+	OperationsInterval time.Duration `yaml:"operationsInterval"`
+	// RepositoriesInterval is how often mappings recorded without the node ID of their repository
+	// are resolved.
+	RepositoriesInterval time.Duration `yaml:"repositoriesInterval"`
+}
+
+// Recording appends every webhook delivery received to the JSONL file at Path, with secrets redacted,
+// so it can be replayed later. Deliveries are only recorded when Path is set.
+type Recording struct {
+	Path string `yaml:"path"`
+}
+
 type Server struct {
 	Address   string  `yaml:"address"`
 	Port      int     `yaml:"port"`
@@ -46,6 +199,31 @@ type TLS struct {
 	KeyFile  string `yaml:"keyFile"`
 }
 
+type Templates struct {
+	IssueTitle         string `yaml:"issueTitle"`
+	IssueBody          string `yaml:"issueBody"`
+	CommentBody        string `yaml:"commentBody"`
+	ReverseCommentBody string `yaml:"reverseCommentBody"`
+	PullRequestBody    string `yaml:"pullRequestBody"`
+	ReviewCommentBody  string `yaml:"reviewCommentBody"`
+}
+
+type Timeouts struct {
+	Database time.Duration `yaml:"database"`
+	GitHub   time.Duration `yaml:"github"`
+	GraphQL  time.Duration `yaml:"graphql"`
+	Webhook  time.Duration `yaml:"webhook"`
+}
+
+type Tracing struct {
+	Enabled     bool    `yaml:"enabled"`
+	Endpoint    string  `yaml:"endpoint"`
+	Exporter    string  `yaml:"exporter"`
+	Insecure    bool    `yaml:"insecure"`
+	SampleRatio float64 `yaml:"sampleRatio"`
+	ServiceName string  `yaml:"serviceName"`
+}
+
 type Repo struct {
 	Org  string `yaml:"org"`
 	Name string `yaml:"name"`
@@ -55,8 +233,188 @@ type WebHook struct {
 	Action       string               `json:"action"`
 	Comment      *github.IssueComment `json:"comment"`
 	Issue        *github.Issue        `json:"issue"`
+	PullRequest  *github.PullRequest  `json:"pull_request"`
 	Repository   *github.Repository   `json:"repository"`
 	Changes      *github.EditChange   `json:"changes"`
 	Sender       *github.User         `json:"sender"`
 	Installation *github.Installation `json:"installation"`
+	Organization *github.Organization `json:"organization"`
+
+	// Repositories, RepositoriesAdded and RepositoriesRemoved carry the repositories of installation
+	// and installation_repositories events.
+	Repositories        []*github.Repository `json:"repositories"`
+	RepositoriesAdded   []*github.Repository `json:"repositories_added"`
+	RepositoriesRemoved []*github.Repository `json:"repositories_removed"`
+
+	Discussion *Discussion `json:"discussion"`
+
+	// DiscussionComment carries the comment on discussion_comment events, which shares the "comment"
+	// key with issue comments.
+	DiscussionComment *DiscussionComment `json:"-"`
+
+	// Previous carries the coordinates a repository or organization had before it was renamed or
+	// transferred, from the changes of repository and organization events.
+	Previous *Previous `json:"-"`
+
+	// Transfer carries the issue created by an issue transfer and the repository it lives in.
+	Transfer *Transfer `json:"-"`
+
+	// StateReason carries the issue's state_reason, which go-github does not model.
+	StateReason string `json:"-"`
+
+	// ReviewComment carries the review-specific fields of the comment on pull_request_review_comment
+	// events, which share the "comment" key with issue comments.
+	ReviewComment *github.PullRequestComment `json:"-"`
+
+	// Payload is the delivery the webhook was decoded from. Marshalling the webhook drops the fields
+	// above, so the payload is what is stored when the webhook must be decoded again later.
+	Payload json.RawMessage `json:"-"`
+
+	// DeliveryID is the GitHub delivery id the webhook arrived with, if it is known.
+	DeliveryID string `json:"-"`
+}
+
+func (w *WebHook) UnmarshalJSON(data []byte) error {
+	type webhook WebHook
+	err := json.Unmarshal(data, (*webhook)(w))
+	if err != nil {
+		return err
+	}
+	w.Payload = append(json.RawMessage(nil), data...)
+
+	if w.Discussion != nil && w.Comment != nil {
+		var discussion struct {
+			Comment *DiscussionComment `json:"comment"`
+		}
+		err = json.Unmarshal(data, &discussion)
+		if err != nil {
+			return err
+		}
+		w.DiscussionComment = discussion.Comment
+	}
+	if w.Issue != nil {
+		var issue struct {
+			Issue struct {
+				StateReason string `json:"state_reason"`
+			} `json:"issue"`
+		}
+		err = json.Unmarshal(data, &issue)
+		if err != nil {
+			return err
+		}
+		w.StateReason = issue.Issue.StateReason
+	}
+	if w.Issue != nil && w.Action == "transferred" {
+		var changes struct {
+			Changes struct {
+				NewIssue      *github.Issue      `json:"new_issue"`
+				NewRepository *github.Repository `json:"new_repository"`
+			} `json:"changes"`
+		}
+		err = json.Unmarshal(data, &changes)
+		if err != nil {
+			return err
+		}
+		w.Transfer = &Transfer{
+			Issue:      changes.Changes.NewIssue,
+			Repository: changes.Changes.NewRepository,
+		}
+	} else if w.Action == "renamed" || w.Action == "transferred" {
+		var changes struct {
+			Changes struct {
+				Repository struct {
+					Name struct {
+						From string `json:"from"`
+					} `json:"name"`
+				} `json:"repository"`
+				Owner struct {
+					From struct {
+						Organization struct {
+							Login string `json:"login"`
+						} `json:"organization"`
+						User struct {
+							Login string `json:"login"`
+						} `json:"user"`
+					} `json:"from"`
+				} `json:"owner"`
+				Login struct {
+					From string `json:"from"`
+				} `json:"login"`
+			} `json:"changes"`
+		}
+		err = json.Unmarshal(data, &changes)
+		if err != nil {
+			return err
+		}
+		w.Previous = &Previous{
+			Org:  firstNonEmpty(changes.Changes.Login.From, changes.Changes.Owner.From.Organization.Login, changes.Changes.Owner.From.User.Login, w.Repository.GetOwner().GetLogin()),
+			Repo: firstNonEmpty(changes.Changes.Repository.Name.From, w.Repository.GetName()),
+		}
+	}
+	if w.PullRequest != nil && w.Comment != nil {
+		var review struct {
+			Comment *github.PullRequestComment `json:"comment"`
+		}
+		err = json.Unmarshal(data, &review)
+		if err != nil {
+			return err
+		}
+		w.ReviewComment = review.Comment
+	}
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Transfer is the destination of a transferred issue.
+type Transfer struct {
+	Issue      *github.Issue
+	Repository *github.Repository
+}
+
+// Previous is the organization and repository name an event's subject had before it changed.
+type Previous struct {
+	Org  string
+	Repo string
+}
+
+// Discussion is the discussion payload of discussion and discussion_comment events, which go-github
+// does not model.
+type Discussion struct {
+	ID        int64               `json:"id"`
+	NodeID    string              `json:"node_id"`
+	Number    int                 `json:"number"`
+	Title     string              `json:"title"`
+	Body      string              `json:"body"`
+	HTMLURL   string              `json:"html_url"`
+	State     string              `json:"state"`
+	User      *github.User        `json:"user"`
+	Category  *DiscussionCategory `json:"category"`
+	CreatedAt time.Time           `json:"created_at"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+type DiscussionCategory struct {
+	ID     int64  `json:"id"`
+	NodeID string `json:"node_id"`
+	Name   string `json:"name"`
+	Slug   string `json:"slug"`
+}
+
+type DiscussionComment struct {
+	ID        int64        `json:"id"`
+	NodeID    string       `json:"node_id"`
+	ParentID  int64        `json:"parent_id"`
+	Body      string       `json:"body"`
+	HTMLURL   string       `json:"html_url"`
+	User      *github.User `json:"user"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
 }